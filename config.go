@@ -2,13 +2,45 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"net"
 	"os"
+	"promhsd/db"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	envStorageType = "PROMHSD_STORAGE"
-	envStorageArgs = "PROMHSD_%s_ARGS"
+	envStorageType  = "PROMHSD_STORAGE"
+	envStorageArgs  = "PROMHSD_%s_ARGS"
+	envReadTimeout  = "PROMHSD_READ_TIMEOUT"
+	envWriteTimeout = "PROMHSD_WRITE_TIMEOUT"
+	envHistoryFile  = "PROMHSD_HISTORY_FILE"
+	envTrashStorage = "PROMHSD_TRASH_STORAGE"
+	envTrashArgs    = "PROMHSD_TRASH_ARGS"
+	envRetention    = "PROMHSD_TRASH_RETENTION"
+	envCacheTTL     = "PROMHSD_CACHE_TTL"
+	envSnapshots    = "PROMHSD_SNAPSHOTS"
+	envSnapshotDir  = "PROMHSD_SNAPSHOT_DIR"
+	envSnapshotMax  = "PROMHSD_SNAPSHOT_LIMIT"
+	envWatchPoll    = "PROMHSD_WATCH_POLL_INTERVAL"
+	envWebhooks     = "PROMHSD_WEBHOOKS"
+	envWebhookKey   = "PROMHSD_WEBHOOK_SECRET"
+	envReapInterval = "PROMHSD_REAP_INTERVAL"
+	envAuditSink    = "PROMHSD_AUDIT_SINK"
+	envAuditArgs    = "PROMHSD_AUDIT_ARGS"
+	envReconcile    = "PROMHSD_MIRROR_RECONCILE_INTERVAL"
+	envIfMatch      = "PROMHSD_REQUIRE_IF_MATCH"
+	envProxies      = "PROMHSD_TRUSTED_PROXIES"
+)
+
+const (
+	purgeInterval       = time.Hour
+	defaultWatchPoll    = time.Duration(0)
+	defaultReapInterval = time.Minute
+	defaultReconcile    = 10 * time.Minute
+	defaultSnapshotMax  = 10000
 )
 
 func getStorage() string {
@@ -20,3 +52,177 @@ func getStorageArgs(storage string) string {
 	storageArgs := os.Getenv(fmt.Sprintf(envStorageArgs, strings.ToUpper(storage)))
 	return storageArgs
 }
+
+// openStorage opens the storages of PROMHSD_STORAGE, when several are given separated by commas
+// the first one is the primary and changes are mirrored to the others.
+func openStorage(storage string) (db.Storage, error) {
+	ids := strings.Split(storage, ",")
+	storages := make([]db.Storage, 0, len(ids))
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		s, err := db.NewStorage(id, getStorageArgs(id))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		storages = append(storages, s)
+	}
+	if len(storages) == 1 {
+		return storages[0], nil
+	}
+	return db.NewMirror(storages[0], storages[1:]...), nil
+}
+
+func getDuration(env string, defaultVal time.Duration) time.Duration {
+	val := os.Getenv(env)
+	if val == "" {
+		return defaultVal
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Printf("%s is not a valid duration, %s is used instead\n", env, defaultVal)
+		return defaultVal
+	}
+	return d
+}
+
+func getInt(env string, defaultVal int) int {
+	val := os.Getenv(env)
+	if val == "" {
+		return defaultVal
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil || i < 0 {
+		log.Printf("%s is not a valid number, %d is used instead\n", env, defaultVal)
+		return defaultVal
+	}
+	return i
+}
+
+func getBool(env string) bool {
+	val := os.Getenv(env)
+	if val == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Printf("%s is not a valid boolean, false is used instead\n", env)
+		return false
+	}
+	return b
+}
+
+// getTrustedProxies parses addresses and CIDRs of proxies whose X-Forwarded-User and X-Forwarded-For
+// are taken, separated by commas. Headers of other clients are ignored.
+func getTrustedProxies() ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, proxy := range strings.Split(os.Getenv(envProxies), ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("%s should hold addresses or CIDRs, got %q", envProxies, proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%s should hold addresses or CIDRs, got %q", envProxies, proxy)
+		}
+		proxies = append(proxies, cidr)
+	}
+	return proxies, nil
+}
+
+func getTimeouts() db.Timeouts {
+	return db.Timeouts{
+		Read:  getDuration(envReadTimeout, db.DefaultTimeouts.Read),
+		Write: getDuration(envWriteTimeout, db.DefaultTimeouts.Write),
+	}
+}
+
+// getHistory keeps the history in the file when it is set, otherwise in memory.
+func getHistory() (db.History, error) {
+	path := os.Getenv(envHistoryFile)
+	if path == "" {
+		return db.NewMemoryHistory(), nil
+	}
+	return db.OpenFileHistory(path)
+}
+
+// getTrash opens the storage deleted targets are kept in, nil means they are deleted for good.
+// The trash is opt-in, it has no default storage.
+func getTrash() (db.Storage, time.Duration, error) {
+	storage := os.Getenv(envTrashStorage)
+	retention := getDuration(envRetention, db.DefaultRetention)
+	if storage == "" || retention <= 0 {
+		return nil, 0, nil
+	}
+	trash, err := db.NewStorage(storage, os.Getenv(envTrashArgs))
+	if err != nil {
+		return nil, 0, err
+	}
+	return trash, retention, nil
+}
+
+// getSnapshots enables last known targets when PROMHSD_SNAPSHOTS is set, nil means they are disabled.
+// The directory they are written to is created, empty keeps them only in memory.
+func getSnapshots() (db.Option, error) {
+	if !getBool(envSnapshots) {
+		return nil, nil
+	}
+	dir := os.Getenv(envSnapshotDir)
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return db.WithSnapshots(dir, getInt(envSnapshotMax, defaultSnapshotMax)), nil
+}
+
+// getWebhooks reads webhooks changes are posted to, nil means there are none.
+func getWebhooks() (*db.Webhooks, error) {
+	hooks, err := db.ParseWebhooks(os.Getenv(envWebhooks))
+	if err != nil || len(hooks) == 0 {
+		return nil, err
+	}
+	return db.NewWebhooks(hooks, os.Getenv(envWebhookKey)), nil
+}
+
+// getAudit opens the audit log of PROMHSD_AUDIT_SINK, nil means changes aren't audited.
+// The file sink takes the path in PROMHSD_AUDIT_ARGS, the storage sink takes <storage>:<args>
+// or keeps records in the storage of targets when they are empty.
+func getAudit(storage db.Storage) (db.AuditLog, error) {
+	args := os.Getenv(envAuditArgs)
+	switch sink := os.Getenv(envAuditSink); sink {
+	case "":
+		return nil, nil
+	case "stdout":
+		return db.NewStreamAudit(os.Stdout), nil
+	case "file":
+		if args == "" {
+			return nil, fmt.Errorf("%s should be the path of the audit file", envAuditArgs)
+		}
+		return db.OpenFileAudit(args)
+	case "storage":
+		if args != "" {
+			id, storageArgs, err := parseStorageSpec(args)
+			if err != nil {
+				return nil, err
+			}
+			if storage, err = db.NewStorage(id, storageArgs); err != nil {
+				return nil, err
+			}
+		}
+		return db.NewStorageAudit(storage)
+	default:
+		return nil, fmt.Errorf("%s should be stdout, file or storage, got %q", envAuditSink, sink)
+	}
+}
@@ -0,0 +1,260 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord tells who tried to change a target and how it went,
+// Added and Removed are entries of the target which the call changed.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	SourceIP string    `json:"source_ip"`
+	Action   Action    `json:"action"`
+	Target   ID        `json:"target"`
+	Added    []Entry   `json:"added"`
+	Removed  []Entry   `json:"removed"`
+	Code     int       `json:"code"`
+}
+
+// AuditQuery selects records from From to To inclusive, zero times and empty Target aren't applied.
+type AuditQuery struct {
+	From   time.Time
+	To     time.Time
+	Target ID
+}
+
+func (q *AuditQuery) matches(record *AuditRecord) bool {
+	if !q.From.IsZero() && record.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && record.Time.After(q.To) {
+		return false
+	}
+	return q.Target == nilID || q.Target == record.Target
+}
+
+// AuditLog is where audit records are kept, Query returns records oldest first.
+type AuditLog interface {
+	Write(context.Context, *AuditRecord) error
+	Query(context.Context, *AuditQuery, *[]AuditRecord) error
+}
+
+type auditRecordKey struct{}
+
+// WithAuditRecord returns ctx which fills in the entries a change made with it added and removed in the record,
+// the service knows them from the reads the change needs anyway.
+func WithAuditRecord(ctx context.Context, record *AuditRecord) context.Context {
+	return context.WithValue(ctx, auditRecordKey{}, record)
+}
+
+func auditRecordFrom(ctx context.Context) *AuditRecord {
+	record, _ := ctx.Value(auditRecordKey{}).(*AuditRecord)
+	return record
+}
+
+// auditChange fills in the record of ctx with the change of the target from before to after,
+// nil before or after means it didn't exist.
+func auditChange(ctx context.Context, before, after *Target) {
+	record := auditRecordFrom(ctx)
+	if record == nil {
+		return
+	}
+	var from, to []Entry
+	if before != nil {
+		from = before.Entries
+	}
+	if after != nil {
+		to = after.Entries
+	}
+	record.Added, record.Removed = EntriesDiff(from, to)
+}
+
+// EntriesDiff returns entries which are in after but not in before, and the other way around.
+func EntriesDiff(before, after []Entry) (added, removed []Entry) {
+	return subtractEntries(after, before), subtractEntries(before, after)
+}
+
+// fileAudit appends records to a JSON lines file, queries read the file.
+type fileAudit struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenFileAudit returns an audit log kept in the append-only file at path.
+func OpenFileAudit(path string) (AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, &StorageError{Text: "Couldn't open audit file", Err: err}
+	}
+	return &fileAudit{path: path, file: f}, nil
+}
+
+func (a *fileAudit) Write(ctx context.Context, record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err = a.file.Write(append(data, '\n')); err != nil {
+		return &StorageError{Text: "Couldn't write audit file", Err: err}
+	}
+	return nil
+}
+
+func (a *fileAudit) Query(ctx context.Context, query *AuditQuery, records *[]AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.path)
+	if err != nil {
+		return &StorageError{Text: "Couldn't open audit file", Err: err}
+	}
+	defer f.Close()
+	result := []AuditRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return &StorageError{Text: "Couldn't decode audit file", Err: err}
+		}
+		if query.matches(&record) {
+			result = append(result, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return &StorageError{Text: "Couldn't read audit file", Err: err}
+	}
+	*records = result
+	return nil
+}
+
+// recentAuditSize is how many records the stream audit log keeps for queries.
+const recentAuditSize = 1000
+
+// streamAudit writes records as JSON lines to a stream, e.g. stdout collected by a log shipper.
+// The stream can't be read back, so the latest records are kept in memory for queries.
+type streamAudit struct {
+	mu      sync.Mutex
+	w       io.Writer
+	records []AuditRecord
+}
+
+func NewStreamAudit(w io.Writer) AuditLog {
+	return &streamAudit{w: w}
+}
+
+func (a *streamAudit) Write(ctx context.Context, record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.records = append(a.records, *record)
+	if len(a.records) > recentAuditSize {
+		a.records = a.records[len(a.records)-recentAuditSize:]
+	}
+	_, err = a.w.Write(append(data, '\n'))
+	return err
+}
+
+func (a *streamAudit) Query(ctx context.Context, query *AuditQuery, records *[]AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := []AuditRecord{}
+	for i := range a.records {
+		if query.matches(&a.records[i]) {
+			result = append(result, a.records[i])
+		}
+	}
+	*records = result
+	return nil
+}
+
+// AuditStore is implemented by storages which keep audit records apart from targets.
+// QueryAudit returns records from query.From to query.To oldest first, the storage
+// applies the range itself, e.g. with an index on the time, other fields are applied by the caller.
+type AuditStore interface {
+	WriteAudit(context.Context, *AuditRecord) error
+	QueryAudit(context.Context, *AuditQuery, *[]AuditRecord) error
+}
+
+// storageAudit keeps records in the storage of targets or in one of its own.
+type storageAudit struct {
+	store AuditStore
+}
+
+// NewStorageAudit keeps records in the storage, a mirror keeps them in its primary.
+// Storages which aren't an AuditStore are refused.
+func NewStorageAudit(storage Storage) (AuditLog, error) {
+	if mirror, ok := storage.(*Mirror); ok {
+		storage = mirror.primary
+	}
+	store, ok := storage.(AuditStore)
+	if !ok {
+		return nil, &ValidationError{Text: "Storage can't keep audit records"}
+	}
+	return &storageAudit{store: store}, nil
+}
+
+func (a *storageAudit) Write(ctx context.Context, record *AuditRecord) error {
+	return a.store.WriteAudit(ctx, record)
+}
+
+func (a *storageAudit) Query(ctx context.Context, query *AuditQuery, records *[]AuditRecord) error {
+	found := []AuditRecord{}
+	if err := a.store.QueryAudit(ctx, query, &found); err != nil {
+		return err
+	}
+	result := []AuditRecord{}
+	for i := range found {
+		if query.matches(&found[i]) {
+			result = append(result, found[i])
+		}
+	}
+	*records = result
+	return nil
+}
+
+// WithAudit keeps records of changes made through the API in the audit log.
+func WithAudit(audit AuditLog) Option {
+	return func(s *Service) {
+		s.audit = audit
+	}
+}
+
+// Audit writes the record to the audit log, it does nothing when there is none.
+func (s *Service) Audit(ctx context.Context, record *AuditRecord) error {
+	if s.audit == nil {
+		return nil
+	}
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return contextError(ctx, s.audit.Write(ctx, record))
+}
+
+var errAuditDisabled = &ValidationError{Text: "Audit log is disabled"}
+
+// AuditRecords returns records of the audit log the query selects, oldest first.
+func (s *Service) AuditRecords(ctx context.Context, query *AuditQuery, records *[]AuditRecord) error {
+	if s.audit == nil {
+		return errAuditDisabled
+	}
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return contextError(ctx, s.audit.Query(ctx, query, records))
+}
+
+// Audited reports whether changes are written to an audit log.
+func (s *Service) Audited() bool {
+	return s.audit != nil
+}
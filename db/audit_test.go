@@ -0,0 +1,103 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// auditStorage keeps records in a slice in the order they were written, queries apply only the time range.
+type auditStorage struct {
+	mapStorage
+	records []AuditRecord
+}
+
+func (s *auditStorage) WriteAudit(_ context.Context, record *AuditRecord) error {
+	s.records = append(s.records, *record)
+	return nil
+}
+
+func (s *auditStorage) QueryAudit(_ context.Context, query *AuditQuery, records *[]AuditRecord) error {
+	result := []AuditRecord{}
+	for _, record := range s.records {
+		if (query.From.IsZero() || !record.Time.Before(query.From)) && (query.To.IsZero() || !record.Time.After(query.To)) {
+			result = append(result, record)
+		}
+	}
+	*records = result
+	return nil
+}
+
+func TestAuditLogs(t *testing.T) {
+	out := &bytes.Buffer{}
+	file, err := OpenFileAudit(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	storage, err := NewStorageAudit(&auditStorage{mapStorage: mapStorage{targets: map[ID]Target{}}})
+	require.NoError(t, err)
+	logs := map[string]AuditLog{
+		"file":    file,
+		"stream":  NewStreamAudit(out),
+		"storage": storage,
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	records := []AuditRecord{
+		{Time: start, Actor: "alice", SourceIP: "10.0.0.1", Action: ActionCreate, Target: "a", Added: []Entry{{Targets: []string{"a:9100"}, Labels: map[string]string{"env": "prod"}}}, Removed: []Entry{}, Code: 200},
+		{Time: start.Add(time.Minute), Actor: "bob", SourceIP: "10.0.0.2", Action: ActionUpdate, Target: "b", Added: []Entry{}, Removed: []Entry{}, Code: 412},
+		// two records of the same time are both kept
+		{Time: start.Add(time.Minute), Actor: "alice", SourceIP: "10.0.0.1", Action: ActionDelete, Target: "a", Added: []Entry{}, Removed: []Entry{}, Code: 404},
+	}
+	tests := []struct {
+		name  string
+		query AuditQuery
+		want  []AuditRecord
+	}{
+		{name: "all", query: AuditQuery{}, want: records},
+		{name: "target", query: AuditQuery{Target: "a"}, want: []AuditRecord{records[0], records[2]}},
+		{name: "from", query: AuditQuery{From: start.Add(time.Second)}, want: records[1:]},
+		{name: "to", query: AuditQuery{To: start}, want: records[:1]},
+		{name: "none", query: AuditQuery{From: start.Add(time.Hour)}, want: []AuditRecord{}},
+	}
+	for sink, audit := range logs {
+		for i := range records {
+			require.NoError(t, audit.Write(context.Background(), &records[i]), sink)
+		}
+		for _, tt := range tests {
+			t.Run(sink+"/"+tt.name, func(t *testing.T) {
+				got := []AuditRecord{}
+				require.NoError(t, audit.Query(context.Background(), &tt.query, &got))
+				require.Len(t, got, len(tt.want))
+				for i := range got {
+					assert.True(t, tt.want[i].Time.Equal(got[i].Time))
+					got[i].Time = tt.want[i].Time
+				}
+				assert.Equal(t, tt.want, got)
+			})
+		}
+	}
+	assert.Equal(t, 3, bytes.Count(out.Bytes(), []byte("\n")))
+}
+
+func TestNewStorageAudit(t *testing.T) {
+	_, err := NewStorageAudit(&mapStorage{targets: map[ID]Target{}})
+	assert.IsType(t, &ValidationError{}, err)
+
+	// a mirror keeps records in its primary
+	primary := &auditStorage{mapStorage: mapStorage{targets: map[ID]Target{}}}
+	audit, err := NewStorageAudit(NewMirror(primary, &mapStorage{targets: map[ID]Target{}}))
+	require.NoError(t, err)
+	require.NoError(t, audit.Write(context.Background(), &AuditRecord{Time: time.Now(), Target: "a"}))
+	assert.Len(t, primary.records, 1)
+}
+
+func TestService_AuditDisabled(t *testing.T) {
+	s := newHistoryService(nil)
+	assert.False(t, s.Audited())
+	assert.NoError(t, s.Audit(context.Background(), &AuditRecord{}))
+	err := s.AuditRecords(context.Background(), &AuditQuery{}, &[]AuditRecord{})
+	assert.IsType(t, &ValidationError{}, err)
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// WithCache makes Get read targets from memory for ttl after they were read from the storage.
+// Local writes invalidate the cache, writes of other replicas are seen once the target expires.
+func WithCache(ttl time.Duration) Option {
+	return func(s *Service) {
+		if ttl > 0 {
+			s.cache = newTargetCache(ttl)
+		}
+	}
+}
+
+type cachedTarget struct {
+	target  Target
+	expires time.Time
+}
+
+type targetCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	targets map[ID]cachedTarget
+	now     func() time.Time
+}
+
+func newTargetCache(ttl time.Duration) *targetCache {
+	return &targetCache{ttl: ttl, targets: map[ID]cachedTarget{}, now: time.Now}
+}
+
+// get copies the cached target into target, it reports false if there is none or it has expired.
+func (c *targetCache) get(target *Target) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.targets[target.ID]
+	if !ok || !c.now().Before(cached.expires) {
+		delete(c.targets, target.ID)
+		cacheMisses.Inc()
+		return false
+	}
+	cacheHits.Inc()
+	*target = *cached.target.clone()
+	return true
+}
+
+func (c *targetCache) set(target *Target) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.targets[target.ID] = cachedTarget{target: *target.clone(), expires: c.now().Add(c.ttl)}
+}
+
+func (c *targetCache) invalidate(id ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.targets, id)
+}
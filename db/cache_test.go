@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStorage counts reads which reach the storage.
+type countingStorage struct {
+	mapStorage
+	gets int
+}
+
+func (s *countingStorage) Get(ctx context.Context, target *Target) error {
+	s.gets++
+	return s.mapStorage.Get(ctx, target)
+}
+
+func TestService_GetCached(t *testing.T) {
+	storage := &countingStorage{mapStorage: mapStorage{targets: map[ID]Target{}}}
+	s := &Service{storage: storage}
+	WithCache(time.Minute)(s)
+	now := time.Now()
+	s.cache.now = func() time.Time { return now }
+	require.NoError(t, s.Create(context.Background(), historyTarget("a:9100")))
+
+	hits, misses := testutil.ToFloat64(cacheHits), testutil.ToFloat64(cacheMisses)
+	for i := 0; i < 3; i++ {
+		target := &Target{ID: "test"}
+		require.NoError(t, s.Get(context.Background(), target))
+		assert.Equal(t, []string{"a:9100"}, target.Entries[0].Targets)
+		// callers can't change the cached target
+		target.Entries[0].Targets[0] = "changed"
+	}
+	assert.Equal(t, 1, storage.gets)
+	assert.Equal(t, hits+2, testutil.ToFloat64(cacheHits))
+	assert.Equal(t, misses+1, testutil.ToFloat64(cacheMisses))
+
+	// local writes invalidate the target
+	update := historyTarget("b:9100")
+	update.ID, update.Revision = "test", FirstRevision
+	require.NoError(t, s.Update(context.Background(), update))
+	target := &Target{ID: "test"}
+	require.NoError(t, s.Get(context.Background(), target))
+	assert.Equal(t, []string{"b:9100"}, target.Entries[0].Targets)
+	assert.Equal(t, 2, storage.gets)
+
+	// the target expires after ttl
+	now = now.Add(time.Minute)
+	require.NoError(t, s.Get(context.Background(), &Target{ID: "test"}))
+	assert.Equal(t, 3, storage.gets)
+
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+	err := s.Get(context.Background(), &Target{ID: "test"})
+	assert.IsType(t, &NotFoundError{}, err)
+}
+
+func TestWithCache(t *testing.T) {
+	s := &Service{}
+	WithCache(0)(s)
+	assert.Nil(t, s.cache)
+}
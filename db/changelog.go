@@ -0,0 +1,140 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// historyVersions is how many changes are kept for every target, older ones are dropped.
+const historyVersions = 100
+
+// changeLog keeps the latest changes of every target in memory and, when file is set,
+// appends them to it as JSON lines, the file is read back on open. The file is rewritten
+// with the kept changes once the dropped ones make up half of it.
+type changeLog struct {
+	mu      sync.Mutex
+	changes map[ID][]Change
+	limit   int
+	kept    int
+	path    string
+	file    *os.File
+	lines   int
+}
+
+// NewMemoryHistory returns a history which is lost on restart, it has only changes made by this replica.
+func NewMemoryHistory() History {
+	return &changeLog{changes: map[ID][]Change{}, limit: historyVersions}
+}
+
+// OpenFileHistory returns a history kept in the append-only file at path.
+func OpenFileHistory(path string) (History, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, &StorageError{Text: "Couldn't open history file", Err: err}
+	}
+	h := &changeLog{changes: map[ID][]Change{}, limit: historyVersions, path: path, file: f}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		change := Change{}
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			f.Close()
+			return nil, &StorageError{Text: "Couldn't decode history file", Err: err}
+		}
+		h.lines++
+		h.keep(&change)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, &StorageError{Text: "Couldn't read history file", Err: err}
+	}
+	if err := h.compact(); err != nil {
+		h.file.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// keep adds the change to the history of its target, dropping the oldest one over the limit.
+func (h *changeLog) keep(change *Change) {
+	changes := append(h.changes[change.ID], *change)
+	h.kept++
+	if len(changes) > h.limit {
+		changes = changes[len(changes)-h.limit:]
+		h.kept--
+	}
+	h.changes[change.ID] = changes
+}
+
+func (h *changeLog) Append(ctx context.Context, change *Change) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file != nil {
+		data, err := json.Marshal(change)
+		if err != nil {
+			return &StorageError{Text: "Couldn't encode to json", Err: err}
+		}
+		if _, err = h.file.Write(append(data, '\n')); err != nil {
+			return &StorageError{Text: "Couldn't write history file", Err: err}
+		}
+		h.lines++
+	}
+	h.keep(change)
+	return h.compact()
+}
+
+// compact replaces the file with one of the kept changes when at least half of its lines were dropped.
+func (h *changeLog) compact() error {
+	if h.file == nil || h.lines <= 2*h.kept {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), ".history-*")
+	if err != nil {
+		return &StorageError{Text: "Couldn't compact history file", Err: err}
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, changes := range h.changes {
+		for i := range changes {
+			data, err := json.Marshal(&changes[i])
+			if err != nil {
+				tmp.Close()
+				return &StorageError{Text: "Couldn't encode to json", Err: err}
+			}
+			w.Write(append(data, '\n'))
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), h.path)
+	}
+	if err != nil {
+		tmp.Close()
+		return &StorageError{Text: "Couldn't compact history file", Err: err}
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return &StorageError{Text: "Couldn't open history file", Err: err}
+	}
+	h.file.Close()
+	h.file = f
+	h.lines = h.kept
+	return nil
+}
+
+func (h *changeLog) List(ctx context.Context, id ID, changes *[]Change) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*changes = append([]Change{}, h.changes[id]...)
+	return nil
+}
+
+var (
+	_ History = (*changeLog)(nil)
+)
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"log"
 	"time"
 )
@@ -25,20 +27,57 @@ func (id ID) String() string {
 	return string(id)
 }
 
+// Storage implementations are expected to give up once ctx is done.
+//
+// Create stores the first revision of the target. Update is a compare-and-swap:
+// it succeeds only if the stored revision equals target.Revision, stores the next revision
+// and sets it to target.Revision, otherwise it returns ErrConflict.
+// Targets stored before revisions were introduced have revision 0.
 type Storage interface {
-	Create(*Target) error
-	Update(*Target) error
-	Delete(*Target) error
-	Get(*Target) error
-	GetAll(*[]Target) error
-	IsHealthy() bool
+	Create(context.Context, *Target) error
+	Update(context.Context, *Target) error
+	Delete(context.Context, *Target) error
+	Get(context.Context, *Target) error
+	GetAll(context.Context, *ListQuery, *[]Target) error
+	IsHealthy(context.Context) bool
 }
 
+// Importer is a storage which can store a target as it is, keeping its ID and revision,
+// e.g. one copied from another storage or brought back from the trash.
+// Import returns ErrConflict when a target with the ID exists.
+type Importer interface {
+	Import(context.Context, *Target) error
+}
+
+var errNotImportable = &ValidationError{Text: "Storage can't keep the ID of the target, it differs from the name"}
+
+// Import stores the target with its ID when the storage is an Importer,
+// other storages create it, which keeps the ID only if it equals the name.
+func Import(ctx context.Context, storage Storage, target *Target) error {
+	if importer, ok := storage.(Importer); ok {
+		return importer.Import(ctx, target)
+	}
+	if target.ID != ID(target.Name) {
+		return errNotImportable
+	}
+	return storage.Create(ctx, target)
+}
+
+const (
+	// FirstRevision is given to created targets.
+	FirstRevision int64 = 1
+	// AnyRevision makes Service.Update overwrite whatever revision is stored.
+	AnyRevision int64 = -1
+)
+
 type Target struct {
-	ID      ID        `json:"id" bson:"_id,omitempty"`
-	Name    string    `json:"name"`
-	Time    time.Time `json:"time"`
-	Entries []Entry   `json:"entries"`
+	ID       ID        `json:"id" bson:"_id,omitempty"`
+	Name     string    `json:"name"`
+	Time     time.Time `json:"time"`
+	Revision int64     `json:"revision"`
+	Entries  []Entry   `json:"entries"`
+	// ExpiresAt is when the target is deleted by itself, nil means never.
+	ExpiresAt *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
 }
 
 type Entry struct {
@@ -46,23 +85,113 @@ type Entry struct {
 	Labels  map[string]string `json:"labels"`
 }
 
+// Timeouts limit every storage call, zero means no limit.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+var DefaultTimeouts = Timeouts{Read: 5 * time.Second, Write: 10 * time.Second}
+
+type Option func(*Service)
+
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(s *Service) {
+		s.timeouts = timeouts
+	}
+}
+
 type Service struct {
-	storage Storage
+	storage   Storage
+	timeouts  Timeouts
+	history   History
+	trash     Storage
+	retention time.Duration
+	cache     *targetCache
+	snapshots *snapshots
+	events    eventHub
+	webhooks  *Webhooks
+	audit     AuditLog
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError tells a call which ran out of time or was cancelled from other storage failures.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	var (
+		notFound   *NotFoundError
+		conflict   *ConflictError
+		validation *ValidationError
+	)
+	if errors.As(err, &notFound) || errors.As(err, &conflict) || errors.As(err, &validation) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{Text: "Storage didn't respond in time", Err: err}
+	}
+	if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+		return &UnavailableError{Text: "Storage call was cancelled", Err: err}
+	}
+	return err
 }
 
-func (s *Service) IsHealthy() bool {
-	return s.storage.IsHealthy()
+func (s *Service) IsHealthy(ctx context.Context) bool {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.storage.IsHealthy(ctx)
 }
 
-func (s *Service) Create(target *Target) error {
+func (s *Service) Create(ctx context.Context, target *Target) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.create(ctx, target, s.storage.Create)
+}
+
+// recreate stores a target which was deleted with its ID, deleted is the revision it was deleted at
+// or 0 when it isn't known. Its revisions go on after its delete and the latest version in the history,
+// so versions don't repeat.
+func (s *Service) recreate(ctx context.Context, target *Target, deleted int64) error {
+	next := deleted + 1
+	if last := s.lastVersion(ctx, target.ID); last > next {
+		next = last
+	}
+	target.Revision = next + 1
+	return s.create(ctx, target, s.importTarget)
+}
+
+// create stores a new target with store, Create names it after its name and recreate keeps the ID it had.
+func (s *Service) create(ctx context.Context, target *Target, store func(context.Context, *Target) error) error {
 	if err := target.validate(); err != nil {
 		return err
 	}
 	target.Time = time.Now()
-	return s.storage.Create(target)
+	err := contextError(ctx, store(ctx, target))
+	s.invalidate(target.ID)
+	if err != nil {
+		return err
+	}
+	s.remember(target)
+	auditChange(ctx, nil, target)
+	s.record(ctx, ActionCreate, target)
+	s.publish(ActionCreate, target)
+	s.notify(ctx, ActionCreate, nil, target)
+	return nil
 }
 
-func (s *Service) Update(target *Target) error {
+// importTarget stores the target with its ID in the storage of the service.
+func (s *Service) importTarget(ctx context.Context, target *Target) error {
+	return Import(ctx, s.storage, target)
+}
+
+func (s *Service) Update(ctx context.Context, target *Target) error {
 	if target.ID == nilID {
 		return ErrValidation
 	}
@@ -70,33 +199,154 @@ func (s *Service) Update(target *Target) error {
 		return err
 	}
 	target.Time = time.Now()
-	return s.storage.Update(target)
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	// webhooks and the audit log are told about the entries the target had
+	current := &Target{ID: target.ID}
+	if target.Revision == AnyRevision || s.webhooks != nil || auditRecordFrom(ctx) != nil {
+		if err := s.storage.Get(ctx, current); err != nil {
+			return contextError(ctx, err)
+		}
+		if target.Revision == AnyRevision {
+			target.Revision = current.Revision
+		}
+	}
+	err := contextError(ctx, s.storage.Update(ctx, target))
+	s.invalidate(target.ID)
+	if err != nil {
+		return err
+	}
+	s.remember(target)
+	auditChange(ctx, current, target)
+	s.record(ctx, ActionUpdate, target)
+	s.publish(ActionUpdate, target)
+	s.notify(ctx, ActionUpdate, current, target)
+	return nil
+}
+
+func (s *Service) Delete(ctx context.Context, target *Target) error {
+	return s.delete(ctx, target, nil)
 }
 
-func (s *Service) Delete(target *Target) error {
+// delete deletes the target unless unchanged reports false for the stored one, then it fails with ErrConflict.
+// Storages can't delete conditionally, so a write between the check and the delete is still lost.
+func (s *Service) delete(ctx context.Context, target *Target, unchanged func(*Target) bool) error {
 	if target.ID == nilID {
 		return ErrValidation
 	}
-	return s.storage.Delete(target)
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	// the deleted target is kept in the history and the trash, webhooks and the audit log are told about its entries
+	if unchanged != nil || s.history != nil || s.trash != nil || s.webhooks != nil || auditRecordFrom(ctx) != nil {
+		if err := s.storage.Get(ctx, target); err != nil {
+			return contextError(ctx, err)
+		}
+		if unchanged != nil && !unchanged(target) {
+			return ErrConflict
+		}
+	}
+	var err error
+	if s.trash != nil {
+		err = s.moveToTrash(ctx, target)
+	} else {
+		err = s.storage.Delete(ctx, target)
+	}
+	s.invalidate(target.ID)
+	if err := contextError(ctx, err); err != nil {
+		return err
+	}
+	if s.snapshots != nil {
+		s.snapshots.remove(target.ID)
+	}
+	auditChange(ctx, target, nil)
+	s.record(ctx, ActionDelete, target)
+	s.publish(ActionDelete, target)
+	s.notify(ctx, ActionDelete, target, nil)
+	return nil
 }
 
-func (s *Service) Get(target *Target) error {
+// Get reads the target from the cache when it is enabled.
+func (s *Service) Get(ctx context.Context, target *Target) error {
 	if target.ID == nilID {
 		return ErrValidation
 	}
-	err := s.storage.Get(target)
+	if s.cache != nil && s.cache.get(target) {
+		return expiredError(target)
+	}
+	if err := s.read(ctx, target); err != nil {
+		return err
+	}
+	if s.cache != nil {
+		s.cache.set(target)
+	}
+	s.remember(target)
+	return expiredError(target)
+}
+
+func (s *Service) invalidate(id ID) {
+	if s.cache != nil {
+		s.cache.invalidate(id)
+	}
+}
+
+// remember keeps the target as its last known good state.
+func (s *Service) remember(target *Target) {
+	if s.snapshots != nil {
+		s.snapshots.set(target)
+	}
+}
+
+// read gets the target from the storage bypassing the cache.
+func (s *Service) read(ctx context.Context, target *Target) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	err := contextError(ctx, s.storage.Get(ctx, target))
 	if err != nil {
 		log.Println("(Get) Storage returned error: ", err.Error())
 	}
 	return err
 }
 
-func (s *Service) List(targets *[]Target) error {
-	err := s.storage.GetAll(targets)
-	if err != nil {
-		log.Println("(GetAll) Storage returned error: ", err.Error())
+// List reads a page of targets, one extra target is asked from the storage
+// to know whether there is a next page.
+func (s *Service) List(ctx context.Context, query *ListQuery, page *Page) error {
+	if err := query.validate(); err != nil {
+		return err
 	}
-	return err
+	q := *query
+	if q.Limit > 0 {
+		q.Limit++
+	}
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	now := time.Now()
+	targets := []Target{}
+	// expired targets are left out before the limit is applied, so the storage is read
+	// until the page is full or it has no more targets
+	for {
+		batch := []Target{}
+		err := contextError(ctx, s.storage.GetAll(ctx, &q, &batch))
+		if err != nil {
+			log.Println("(GetAll) Storage returned error: ", err.Error())
+			return err
+		}
+		if q.Limit == 0 || len(batch) < q.Limit {
+			targets = append(targets, unexpired(batch, now)...)
+			break
+		}
+		q.After = NewCursor(&batch[len(batch)-1])
+		targets = append(targets, unexpired(batch, now)...)
+		if len(targets) > query.Limit {
+			break
+		}
+	}
+	page.Next = ""
+	if query.Limit > 0 && len(targets) > query.Limit {
+		targets = targets[:query.Limit]
+		page.Next = NewCursor(&targets[len(targets)-1]).String()
+	}
+	page.Targets = targets
+	return nil
 }
 
 func (t *Target) validate() error {
@@ -124,17 +374,39 @@ func (e *Entry) validate() error {
 	return nil
 }
 
-func New(storageID, opt string) (*Service, error) {
+// NewStorage opens a registered storage, Service uses it for targets and the trash.
+func NewStorage(storageID, opt string) (Storage, error) {
 	if newFunc, ok := storages[storageID]; ok {
 		storage, err := newFunc(opt)
 		if err != nil {
 			return nil, &StorageError{Text: "storage returned error", Err: err}
 		}
-		return &Service{storage}, nil
+		return storage, nil
 	}
 	return nil, &StorageError{Text: "storage is not implemented"}
 }
 
+func New(storageID, opt string, options ...Option) (*Service, error) {
+	storage, err := NewStorage(storageID, opt)
+	if err != nil {
+		return nil, err
+	}
+	return NewService(storage, options...), nil
+}
+
+// NewService serves targets of a storage which is already open, e.g. a Mirror.
+// The history is kept in memory unless WithHistory is given, so every replica has its own.
+func NewService(storage Storage, options ...Option) *Service {
+	s := &Service{storage: storage, timeouts: DefaultTimeouts, history: NewMemoryHistory()}
+	for _, option := range options {
+		option(s)
+	}
+	if mirror, ok := storage.(*Mirror); ok {
+		mirror.timeout = s.timeouts.Write
+	}
+	return s
+}
+
 func NewTarget() *Target {
 	return &Target{Entries: []Entry{}}
 }
@@ -1,7 +1,9 @@
 package db
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -11,31 +13,41 @@ type testStorage struct {
 	//returnItem  *Target
 }
 
-func (s *testStorage) Create(*Target) error {
+func (s *testStorage) Create(context.Context, *Target) error {
 
 	return s.returnError
 }
 
-func (s *testStorage) Update(*Target) error {
+func (s *testStorage) Update(context.Context, *Target) error {
 	return s.returnError
 }
 
-func (s *testStorage) Delete(*Target) error {
+func (s *testStorage) Delete(context.Context, *Target) error {
 	return s.returnError
 }
 
-func (s *testStorage) Get(*Target) error {
+func (s *testStorage) Get(context.Context, *Target) error {
 	return s.returnError
 }
 
-func (s *testStorage) GetAll(*[]Target) error {
+func (s *testStorage) GetAll(context.Context, *ListQuery, *[]Target) error {
 	return s.returnError
 }
 
-func (s *testStorage) IsHealthy() bool {
+func (s *testStorage) IsHealthy(context.Context) bool {
 	return true
 }
 
+// blockingStorage answers only when ctx is done.
+type blockingStorage struct {
+	testStorage
+}
+
+func (s *blockingStorage) Get(ctx context.Context, _ *Target) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
 type testStorageService struct {
 	storage Storage
 }
@@ -79,7 +91,7 @@ func TestService_Get(t *testing.T) {
 			s := &Service{
 				storage: tt.fields.storage,
 			}
-			err := s.Get(tt.args.target)
+			err := s.Get(context.Background(), tt.args.target)
 			if tt.wantErr {
 				assert.Error(t, err)
 			}
@@ -146,7 +158,7 @@ func TestService_Create(t *testing.T) {
 			s := &Service{
 				storage: tt.fields.storage,
 			}
-			err := s.Create(tt.args.target)
+			err := s.Create(context.Background(), tt.args.target)
 			if (err != nil) != tt.wantErr {
 				assert.Error(t, err)
 			}
@@ -195,7 +207,7 @@ func TestService_Update(t *testing.T) {
 			s := &Service{
 				storage: tt.fields.storage,
 			}
-			err := s.Update(tt.args.target)
+			err := s.Update(context.Background(), tt.args.target)
 			if (err != nil) != tt.wantErr {
 				assert.Error(t, err)
 			}
@@ -203,6 +215,52 @@ func TestService_Update(t *testing.T) {
 	}
 }
 
+// revisionStorage keeps the revision of a single target.
+type revisionStorage struct {
+	testStorage
+	revision int64
+	updated  int64
+}
+
+func (s *revisionStorage) Get(_ context.Context, target *Target) error {
+	target.Revision = s.revision
+	return nil
+}
+
+func (s *revisionStorage) Update(_ context.Context, target *Target) error {
+	s.updated = target.Revision
+	return nil
+}
+
+func TestService_UpdateRevision(t *testing.T) {
+	entry := Entry{Labels: map[string]string{"label1": "value"}, Targets: []string{"asd"}}
+	tests := []struct {
+		name     string
+		revision int64
+		want     int64
+	}{
+		{
+			name:     "givenRevision",
+			revision: 2,
+			want:     2,
+		},
+		{
+			name:     "anyRevision",
+			revision: AnyRevision,
+			want:     5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &revisionStorage{revision: 5}
+			s := &Service{storage: storage}
+			err := s.Update(context.Background(), &Target{ID: "test", Name: "test", Revision: tt.revision, Entries: []Entry{entry}})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, storage.updated)
+		})
+	}
+}
+
 func TestService_Delete(t *testing.T) {
 	type fields struct {
 		storage Storage
@@ -234,7 +292,7 @@ func TestService_Delete(t *testing.T) {
 			s := &Service{
 				storage: tt.fields.storage,
 			}
-			err := s.Delete(tt.args.target)
+			err := s.Delete(context.Background(), tt.args.target)
 			if (err != nil) != tt.wantErr {
 				assert.Error(t, err)
 			}
@@ -242,36 +300,74 @@ func TestService_Delete(t *testing.T) {
 	}
 }
 
+// listStorage lists its targets the way storages without native listing do.
+type listStorage struct {
+	testStorage
+	targets []Target
+}
+
+func (s *listStorage) GetAll(_ context.Context, query *ListQuery, list *[]Target) error {
+	*list = query.Apply(s.targets)
+	return nil
+}
+
 func TestService_List(t *testing.T) {
-	targets := []Target{}
-	type fields struct {
-		storage Storage
-	}
+	storage := &listStorage{targets: []Target{{ID: "c"}, {ID: "a"}, {ID: "b"}}}
 	type args struct {
-		targets *[]Target
+		query *ListQuery
 	}
 	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		wantErr bool
+		name     string
+		args     args
+		want     []ID
+		wantNext bool
+		wantErr  bool
 	}{
 		{
-			name:    "ListOK",
-			fields:  fields{&testStorage{}},
-			args:    args{&targets},
-			wantErr: false,
+			name: "ListOK",
+			args: args{&ListQuery{}},
+			want: []ID{"a", "b", "c"},
+		},
+		{
+			name:     "FirstPage",
+			args:     args{&ListQuery{Limit: 2}},
+			want:     []ID{"a", "b"},
+			wantNext: true,
+		},
+		{
+			name: "LastPage",
+			args: args{&ListQuery{Limit: 2, After: &Cursor{ID: "b"}}},
+			want: []ID{"c"},
+		},
+		{
+			name:    "WrongSortField",
+			args:    args{&ListQuery{SortBy: "size"}},
+			wantErr: true,
+		},
+		{
+			name:    "NegativeLimit",
+			args:    args{&ListQuery{Limit: -1}},
+			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Service{
-				storage: tt.fields.storage,
+				storage: storage,
 			}
-			err := s.List(tt.args.targets)
-			if (err != nil) != tt.wantErr {
+			page := Page{}
+			err := s.List(context.Background(), tt.args.query, &page)
+			if tt.wantErr {
 				assert.Error(t, err)
+				return
 			}
+			assert.NoError(t, err)
+			got := []ID{}
+			for _, target := range page.Targets {
+				got = append(got, target.ID)
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantNext, page.Next != "")
 		})
 	}
 }
@@ -363,3 +459,42 @@ func TestID_String(t *testing.T) {
 		})
 	}
 }
+
+func TestService_timeouts(t *testing.T) {
+	s := &Service{storage: &blockingStorage{}, timeouts: Timeouts{Read: time.Millisecond}}
+	tests := []struct {
+		name    string
+		ctx     func() (context.Context, context.CancelFunc)
+		wantErr error
+	}{
+		{
+			name:    "deadlineExceeded",
+			ctx:     func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			wantErr: &TimeoutError{},
+		},
+		{
+			name: "requestCancelled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx, cancel
+			},
+			wantErr: &UnavailableError{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			err := s.Get(ctx, &Target{ID: "test"})
+			assert.IsType(t, tt.wantErr, err)
+		})
+	}
+}
+
+func TestService_contextErrorKeepsStorageErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, ErrNotFound, contextError(ctx, ErrNotFound))
+	assert.Nil(t, contextError(ctx, nil))
+}
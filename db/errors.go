@@ -67,6 +67,32 @@ func (e *ConflictError) Unwrap() error {
 	return e.Err
 }
 
+type TimeoutError struct {
+	Text string
+	Err  error
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Text
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+type UnavailableError struct {
+	Text string
+	Err  error
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Text
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
 var (
 	ErrNotFound   *NotFoundError   = &NotFoundError{Text: "Target was not found"}
 	ErrValidation *ValidationError = &ValidationError{Text: "Provided data is not valid"}
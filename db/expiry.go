@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// reaperActor is who expired targets are deleted by in the history and webhooks.
+const reaperActor = "reaper"
+
+// Expired reports whether the target has an expiry time which isn't after now.
+func (t *Target) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !t.ExpiresAt.After(now)
+}
+
+// expiredError tells an expired target apart from a missing one, both are not found.
+func expiredError(target *Target) error {
+	if target.Expired(time.Now()) {
+		return &NotFoundError{Text: "Target has expired"}
+	}
+	return nil
+}
+
+func unexpired(targets []Target, now time.Time) []Target {
+	result := targets[:0]
+	for i := range targets {
+		if !targets[i].Expired(now) {
+			result = append(result, targets[i])
+		}
+	}
+	return result
+}
+
+// Expirer is a storage which deletes expired targets by itself, e.g. with a TTL index.
+// ExpiresTargets reports whether its expiry is on, the reaper leaves expired targets to it then.
+type Expirer interface {
+	ExpiresTargets() bool
+}
+
+// DeleteExpired deletes targets which have expired like Delete does, so they go to the trash and the history.
+// A target changed since it was listed is left, e.g. its expiry may have been extended.
+// It returns how many were deleted.
+func (s *Service) DeleteExpired(ctx context.Context) (int, error) {
+	readCtx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	targets := []Target{}
+	if err := s.storage.GetAll(readCtx, &ListQuery{}, &targets); err != nil {
+		return 0, contextError(readCtx, err)
+	}
+	ctx = WithActor(ctx, reaperActor)
+	now := time.Now()
+	deleted := 0
+	for i := range targets {
+		if !targets[i].Expired(now) {
+			continue
+		}
+		listed := &targets[i]
+		err := s.delete(ctx, &Target{ID: listed.ID}, func(current *Target) bool {
+			return current.Revision == listed.Revision && current.Expired(time.Now())
+		})
+		var (
+			notFound *NotFoundError
+			conflict *ConflictError
+		)
+		if errors.As(err, &notFound) || errors.As(err, &conflict) {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Reap deletes expired targets every interval until ctx is done, zero interval disables it.
+// Every run reads all targets, so it doesn't run for storages which expire targets by themselves,
+// their expired targets don't go to the trash and the history.
+func (s *Service) Reap(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	if expirer, ok := s.storage.(Expirer); ok && expirer.ExpiresTargets() {
+		log.Println("(Reaper) Storage deletes expired targets by itself, the reaper is off")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		deleted, err := s.DeleteExpired(ctx)
+		if err != nil {
+			log.Println("(Reaper) Failed to delete expired targets:", err)
+		}
+		if deleted > 0 {
+			log.Printf("(Reaper) %d expired targets were deleted\n", deleted)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expiringTarget is a target which expires after ttl, a negative ttl means it has expired.
+func expiringTarget(name string, ttl time.Duration) *Target {
+	t := historyTarget("a:9100")
+	t.Name = name
+	if ttl != 0 {
+		expiresAt := time.Now().Add(ttl)
+		t.ExpiresAt = &expiresAt
+	}
+	return t
+}
+
+func TestService_GetExpired(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{name: "storage"},
+		{name: "cache", options: []Option{WithCache(time.Hour)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewService(&mapStorage{targets: map[ID]Target{}}, tt.options...)
+			require.NoError(t, s.Create(context.Background(), expiringTarget("later", time.Hour)))
+			require.NoError(t, s.Create(context.Background(), expiringTarget("soon", 50*time.Millisecond)))
+			require.NoError(t, s.Get(context.Background(), &Target{ID: "soon"}))
+
+			time.Sleep(100 * time.Millisecond)
+			err := s.Get(context.Background(), &Target{ID: "soon"})
+			assert.IsType(t, &NotFoundError{}, err)
+			assert.NoError(t, s.Get(context.Background(), &Target{ID: "later"}))
+		})
+	}
+}
+
+func TestService_ListHidesExpired(t *testing.T) {
+	storage := &mapStorage{targets: map[ID]Target{}}
+	for _, target := range []*Target{expiringTarget("a", 0), expiringTarget("b", -time.Minute), expiringTarget("c", time.Hour), expiringTarget("d", 0)} {
+		target.ID = ID(target.Name)
+		storage.targets[target.ID] = *target
+	}
+	s := NewService(storage)
+
+	page := &Page{}
+	require.NoError(t, s.List(context.Background(), &ListQuery{Limit: 2}, page))
+	// the expired target doesn't make the page short
+	assert.Equal(t, []ID{"a", "c"}, pageIDs(page))
+	query := &ListQuery{Limit: 2}
+	after, err := ParseCursor(page.Next)
+	require.NoError(t, err)
+	query.After = after
+	require.NoError(t, s.List(context.Background(), query, page))
+	assert.Equal(t, []ID{"d"}, pageIDs(page))
+	assert.Empty(t, page.Next)
+
+	require.NoError(t, s.List(context.Background(), &ListQuery{Limit: 1}, page))
+	assert.Equal(t, []ID{"a"}, pageIDs(page))
+	query = &ListQuery{Limit: 1}
+	query.After, err = ParseCursor(page.Next)
+	require.NoError(t, err)
+	require.NoError(t, s.List(context.Background(), query, page))
+	assert.Equal(t, []ID{"c"}, pageIDs(page))
+}
+
+func pageIDs(page *Page) []ID {
+	ids := []ID{}
+	for _, target := range page.Targets {
+		ids = append(ids, target.ID)
+	}
+	return ids
+}
+
+func TestService_GetLastKnownExpired(t *testing.T) {
+	storage := &failingStorage{mapStorage: mapStorage{targets: map[ID]Target{}}}
+	s := &Service{storage: storage}
+	WithSnapshots("", 0)(s)
+	require.NoError(t, s.Create(context.Background(), expiringTarget("test", 50*time.Millisecond)))
+
+	storage.down = true
+	time.Sleep(100 * time.Millisecond)
+	stale, err := s.GetLastKnown(context.Background(), &Target{ID: "test"})
+	assert.IsType(t, &NotFoundError{}, err)
+	assert.False(t, stale)
+}
+
+func TestService_DeleteExpired(t *testing.T) {
+	s, trash := newTrashService()
+	WithHistory(NewMemoryHistory())(s)
+	storage := s.storage.(*mapStorage)
+	for _, target := range []*Target{expiringTarget("expired", -time.Minute), expiringTarget("later", time.Hour), expiringTarget("never", 0)} {
+		target.ID = ID(target.Name)
+		storage.targets[target.ID] = *target
+	}
+
+	deleted, err := s.DeleteExpired(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.NotContains(t, storage.targets, ID("expired"))
+	assert.Contains(t, storage.targets, ID("later"))
+	assert.Contains(t, storage.targets, ID("never"))
+	// expired targets are deleted like any other, so they can be restored
+	assert.Contains(t, trash.targets, ID("expired"))
+	changes := []Change{}
+	require.NoError(t, s.History(context.Background(), "expired", &changes))
+	require.Len(t, changes, 1)
+	assert.Equal(t, ActionDelete, changes[0].Action)
+	assert.Equal(t, reaperActor, changes[0].Actor)
+
+	deleted, err = s.DeleteExpired(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+
+	restored := &Target{ID: "expired"}
+	require.NoError(t, s.Restore(context.Background(), restored))
+	assert.Nil(t, restored.ExpiresAt)
+	assert.NoError(t, s.Get(context.Background(), &Target{ID: "expired"}))
+}
+
+// extendingStorage extends the expiry of a target after targets are listed, like another replica would.
+type extendingStorage struct {
+	mapStorage
+	extend ID
+}
+
+func (s *extendingStorage) GetAll(ctx context.Context, query *ListQuery, list *[]Target) error {
+	err := s.mapStorage.GetAll(ctx, query, list)
+	target := s.targets[s.extend]
+	expiresAt := time.Now().Add(time.Hour)
+	target.ExpiresAt = &expiresAt
+	target.Revision++
+	s.targets[s.extend] = target
+	return err
+}
+
+func TestService_DeleteExpiredChanged(t *testing.T) {
+	storage := &extendingStorage{mapStorage: mapStorage{targets: map[ID]Target{}}, extend: "extended"}
+	s, trash := newTrashService()
+	s.storage = storage
+	for _, target := range []*Target{expiringTarget("expired", -time.Minute), expiringTarget("extended", -time.Minute)} {
+		target.ID = ID(target.Name)
+		storage.targets[target.ID] = *target
+	}
+
+	deleted, err := s.DeleteExpired(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.NotContains(t, storage.targets, ID("expired"))
+	assert.Contains(t, storage.targets, ID("extended"))
+	// the trash keeps no expiry, a TTL of its storage would delete the target
+	assert.Nil(t, trash.targets["expired"].ExpiresAt)
+}
+
+// expirerStorage deletes expired targets by itself.
+type expirerStorage struct {
+	mapStorage
+}
+
+func (s *expirerStorage) ExpiresTargets() bool {
+	return true
+}
+
+func TestService_ReapSkipsExpirer(t *testing.T) {
+	s := NewService(&expirerStorage{mapStorage: mapStorage{targets: map[ID]Target{}}})
+	done := make(chan struct{})
+	go func() {
+		s.Reap(context.Background(), time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reaper runs for a storage which expires targets by itself")
+	}
+	assert.True(t, NewMirror(s.storage).ExpiresTargets())
+}
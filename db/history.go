@@ -0,0 +1,236 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// Change is an immutable record of the history of a target,
+// Target holds the payload after the change, for ActionDelete it is the deleted target.
+// Version is the revision the change stored, a delete takes the revision after the deleted one.
+type Change struct {
+	ID      ID        `json:"id"`
+	Version int64     `json:"version"`
+	Action  Action    `json:"action"`
+	Actor   string    `json:"actor"`
+	Time    time.Time `json:"time"`
+	Target  Target    `json:"target"`
+}
+
+// History keeps changes of targets apart from the storage,
+// so it works the same way with every storage. It may keep only the latest changes of a target.
+// Histories are local to a replica, changes made by other replicas sharing the storage aren't in it.
+type History interface {
+	// Append stores the change as the latest one of its target.
+	Append(context.Context, *Change) error
+	// List returns changes of the target, oldest first.
+	List(context.Context, ID, *[]Change) error
+}
+
+// Diff tells which entries were added and removed between two versions of a target,
+// Name and ExpiresAt are set only when they changed.
+type Diff struct {
+	From      int64       `json:"from"`
+	To        int64       `json:"to"`
+	Added     []Entry     `json:"added"`
+	Removed   []Entry     `json:"removed"`
+	Name      *NameDiff   `json:"name,omitempty"`
+	ExpiresAt *ExpiryDiff `json:"expires_at,omitempty"`
+}
+
+// NameDiff is the name of the target in both versions.
+type NameDiff struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ExpiryDiff is the expiry of the target in both versions, nil means it didn't expire.
+type ExpiryDiff struct {
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+}
+
+func WithHistory(history History) Option {
+	return func(s *Service) {
+		s.history = history
+	}
+}
+
+type actorKey struct{}
+
+// WithActor returns ctx which attributes changes made with it to the actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// record appends the change after it has been stored, the change isn't undone
+// if the history fails, so the failure is only logged.
+func (s *Service) record(ctx context.Context, action Action, target *Target) {
+	if s.history == nil {
+		return
+	}
+	version := target.Revision
+	if action == ActionDelete {
+		version++
+	}
+	change := &Change{
+		ID:      target.ID,
+		Version: version,
+		Action:  action,
+		Actor:   actorFrom(ctx),
+		Time:    time.Now(),
+		Target:  *target.clone(),
+	}
+	if err := s.history.Append(ctx, change); err != nil {
+		log.Println("(History) Failed to record the change:", err)
+	}
+}
+
+// History returns all changes of the target, oldest first.
+func (s *Service) History(ctx context.Context, id ID, changes *[]Change) error {
+	if id == nilID {
+		return ErrValidation
+	}
+	if s.history == nil {
+		*changes = []Change{}
+		return nil
+	}
+	return s.history.List(ctx, id, changes)
+}
+
+func (s *Service) change(ctx context.Context, id ID, version int64) (*Change, error) {
+	changes := []Change{}
+	if err := s.History(ctx, id, &changes); err != nil {
+		return nil, err
+	}
+	// the latest one wins if a target created without the history started its versions again
+	for i := len(changes) - 1; i >= 0; i-- {
+		if changes[i].Version == version {
+			return &changes[i], nil
+		}
+	}
+	return nil, &NotFoundError{Text: "Version not found"}
+}
+
+// lastVersion returns the version of the latest change of the target, 0 when it has none.
+func (s *Service) lastVersion(ctx context.Context, id ID) int64 {
+	if s.history == nil || id == nilID {
+		return 0
+	}
+	changes := []Change{}
+	if err := s.history.List(ctx, id, &changes); err != nil || len(changes) == 0 {
+		return 0
+	}
+	return changes[len(changes)-1].Version
+}
+
+// Diff compares entries, the name and the expiry of two versions of the target.
+func (s *Service) Diff(ctx context.Context, id ID, from, to int64, diff *Diff) error {
+	fromChange, err := s.change(ctx, id, from)
+	if err != nil {
+		return err
+	}
+	toChange, err := s.change(ctx, id, to)
+	if err != nil {
+		return err
+	}
+	diff.From, diff.To = from, to
+	diff.Added, diff.Removed = EntriesDiff(fromChange.Target.Entries, toChange.Target.Entries)
+	diff.Name, diff.ExpiresAt = nil, nil
+	before, after := &fromChange.Target, &toChange.Target
+	if before.Name != after.Name {
+		diff.Name = &NameDiff{From: before.Name, To: after.Name}
+	}
+	if !sameExpiry(before.ExpiresAt, after.ExpiresAt) {
+		diff.ExpiresAt = &ExpiryDiff{From: before.ExpiresAt, To: after.ExpiresAt}
+	}
+	return nil
+}
+
+func sameExpiry(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// subtractEntries returns entries of a which aren't in b.
+func subtractEntries(a, b []Entry) []Entry {
+	count := map[string]int{}
+	for i := range b {
+		count[b[i].key()]++
+	}
+	result := []Entry{}
+	for i := range a {
+		key := a[i].key()
+		if count[key] > 0 {
+			count[key]--
+			continue
+		}
+		result = append(result, a[i])
+	}
+	return result
+}
+
+// key identifies the entry by its content, json sorts labels by key.
+func (e *Entry) key() string {
+	data, _ := json.Marshal(e)
+	return string(data)
+}
+
+// Rollback stores the payload of the version as the current state of the target,
+// a deleted target is created again with its ID. The rollback becomes a change itself.
+func (s *Service) Rollback(ctx context.Context, id ID, version int64, target *Target) error {
+	change, err := s.change(ctx, id, version)
+	if err != nil {
+		return err
+	}
+	*target = *change.Target.clone()
+	target.ID = id
+	// an expiry which has passed would delete the target again at once
+	if target.Expired(time.Now()) {
+		target.ExpiresAt = nil
+	}
+	current := &Target{ID: id}
+	err = s.read(ctx, current)
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+		defer cancel()
+		return s.recreate(ctx, target, 0)
+	}
+	if err != nil {
+		return err
+	}
+	target.Revision = current.Revision
+	return s.Update(ctx, target)
+}
+
+func (t *Target) clone() *Target {
+	c := *t
+	c.Entries = make([]Entry, 0, len(t.Entries))
+	for _, e := range t.Entries {
+		entry := Entry{Targets: append([]string{}, e.Targets...), Labels: make(map[string]string, len(e.Labels))}
+		for k, v := range e.Labels {
+			entry.Labels[k] = v
+		}
+		c.Entries = append(c.Entries, entry)
+	}
+	return &c
+}
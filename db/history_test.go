@@ -0,0 +1,278 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mapStorage keeps targets with revisions like real storages do.
+type mapStorage struct {
+	testStorage
+	targets map[ID]Target
+}
+
+func (s *mapStorage) Create(_ context.Context, target *Target) error {
+	target.ID = ID(target.Name)
+	if _, ok := s.targets[target.ID]; ok {
+		return ErrConflict
+	}
+	target.Revision = FirstRevision
+	s.targets[target.ID] = *target.clone()
+	return nil
+}
+
+func (s *mapStorage) Import(_ context.Context, target *Target) error {
+	if _, ok := s.targets[target.ID]; ok {
+		return ErrConflict
+	}
+	s.targets[target.ID] = *target.clone()
+	return nil
+}
+
+func (s *mapStorage) Update(_ context.Context, target *Target) error {
+	stored, ok := s.targets[target.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Revision != target.Revision {
+		return ErrConflict
+	}
+	target.Revision++
+	s.targets[target.ID] = *target.clone()
+	return nil
+}
+
+func (s *mapStorage) Delete(_ context.Context, target *Target) error {
+	if _, ok := s.targets[target.ID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.targets, target.ID)
+	return nil
+}
+
+func (s *mapStorage) Get(_ context.Context, target *Target) error {
+	stored, ok := s.targets[target.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	*target = *stored.clone()
+	return nil
+}
+
+func (s *mapStorage) GetAll(_ context.Context, query *ListQuery, list *[]Target) error {
+	targets := make([]Target, 0, len(s.targets))
+	for _, target := range s.targets {
+		targets = append(targets, target)
+	}
+	*list = query.Apply(targets)
+	return nil
+}
+
+func newHistoryService(history History) *Service {
+	return &Service{storage: &mapStorage{targets: map[ID]Target{}}, history: history}
+}
+
+func historyTarget(addresses ...string) *Target {
+	t := NewTarget()
+	t.Name = "test"
+	for _, address := range addresses {
+		t.Entries = append(t.Entries, Entry{Targets: []string{address}, Labels: map[string]string{"env": "prod"}})
+	}
+	return t
+}
+
+func TestService_History(t *testing.T) {
+	s := newHistoryService(NewMemoryHistory())
+	ctx := WithActor(context.Background(), "alice")
+	require.NoError(t, s.Create(ctx, historyTarget("a:9100")))
+	update := historyTarget("b:9100")
+	update.ID, update.Revision = "test", AnyRevision
+	require.NoError(t, s.Update(WithActor(context.Background(), "bob"), update))
+	require.NoError(t, s.Delete(ctx, &Target{ID: "test"}))
+
+	changes := []Change{}
+	require.NoError(t, s.History(context.Background(), "test", &changes))
+	require.Len(t, changes, 3)
+	for i, want := range []struct {
+		action  Action
+		actor   string
+		address string
+	}{
+		{ActionCreate, "alice", "a:9100"},
+		{ActionUpdate, "bob", "b:9100"},
+		{ActionDelete, "alice", "b:9100"},
+	} {
+		assert.Equal(t, int64(i+1), changes[i].Version)
+		assert.Equal(t, want.action, changes[i].Action)
+		assert.Equal(t, want.actor, changes[i].Actor)
+		assert.Equal(t, []string{want.address}, changes[i].Target.Entries[0].Targets)
+	}
+}
+
+func TestService_HistoryCreatedAgain(t *testing.T) {
+	s := newHistoryService(NewMemoryHistory())
+	require.NoError(t, s.Create(context.Background(), historyTarget("a:9100")))
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+	target := historyTarget("b:9100")
+	require.NoError(t, s.Create(context.Background(), target))
+	// creating doesn't depend on the history, which other replicas don't share
+	assert.Equal(t, FirstRevision, target.Revision)
+	err := s.Create(context.Background(), historyTarget("c:9100"))
+	assert.IsType(t, &ConflictError{}, err)
+
+	changes := []Change{}
+	require.NoError(t, s.History(context.Background(), "test", &changes))
+	versions := []int64{}
+	for _, change := range changes {
+		versions = append(versions, change.Version)
+	}
+	assert.Equal(t, []int64{1, 2, 1}, versions)
+	// the latest change of a version wins
+	diff := Diff{}
+	require.NoError(t, s.Diff(context.Background(), "test", 2, 1, &diff))
+	assert.Equal(t, []Entry{historyTarget("b:9100").Entries[0]}, diff.Added)
+	assert.Equal(t, []Entry{historyTarget("a:9100").Entries[0]}, diff.Removed)
+}
+
+func TestService_Diff(t *testing.T) {
+	s := newHistoryService(NewMemoryHistory())
+	require.NoError(t, s.Create(context.Background(), historyTarget("a:9100", "b:9100")))
+	update := historyTarget("b:9100", "c:9100")
+	update.ID, update.Revision = "test", FirstRevision
+	require.NoError(t, s.Update(context.Background(), update))
+
+	diff := Diff{}
+	require.NoError(t, s.Diff(context.Background(), "test", 1, 2, &diff))
+	assert.Equal(t, []Entry{historyTarget("c:9100").Entries[0]}, diff.Added)
+	assert.Equal(t, []Entry{historyTarget("a:9100").Entries[0]}, diff.Removed)
+
+	assert.Nil(t, diff.Name)
+	assert.Nil(t, diff.ExpiresAt)
+
+	err := s.Diff(context.Background(), "test", 1, 3, &diff)
+	assert.IsType(t, &NotFoundError{}, err)
+}
+
+func TestService_DiffNameAndExpiry(t *testing.T) {
+	s := newHistoryService(NewMemoryHistory())
+	require.NoError(t, s.Create(context.Background(), historyTarget("a:9100")))
+	update := historyTarget("a:9100")
+	expiresAt := time.Now().Add(time.Hour)
+	update.ID, update.Revision, update.Name, update.ExpiresAt = "test", FirstRevision, "renamed", &expiresAt
+	require.NoError(t, s.Update(context.Background(), update))
+
+	diff := Diff{}
+	require.NoError(t, s.Diff(context.Background(), "test", 1, 2, &diff))
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Equal(t, &NameDiff{From: "test", To: "renamed"}, diff.Name)
+	require.NotNil(t, diff.ExpiresAt)
+	assert.Nil(t, diff.ExpiresAt.From)
+	assert.True(t, expiresAt.Equal(*diff.ExpiresAt.To))
+}
+
+func TestService_Rollback(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete bool
+	}{
+		{name: "existing"},
+		{name: "deleted", delete: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newHistoryService(NewMemoryHistory())
+			require.NoError(t, s.Create(context.Background(), historyTarget("a:9100")))
+			update := historyTarget("b:9100")
+			update.ID, update.Revision = "test", FirstRevision
+			require.NoError(t, s.Update(context.Background(), update))
+			if tt.delete {
+				require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+			}
+
+			target := NewTarget()
+			require.NoError(t, s.Rollback(context.Background(), "test", 1, target))
+			got := &Target{ID: "test"}
+			require.NoError(t, s.Get(context.Background(), got))
+			assert.Equal(t, []string{"a:9100"}, got.Entries[0].Targets)
+			assert.Equal(t, got.Revision, target.Revision)
+
+			changes := []Change{}
+			require.NoError(t, s.History(context.Background(), "test", &changes))
+			last := changes[len(changes)-1]
+			assert.Equal(t, []string{"a:9100"}, last.Target.Entries[0].Targets)
+			assert.Equal(t, changes[len(changes)-2].Version+1, last.Version)
+			assert.Equal(t, target.Revision, last.Version)
+		})
+	}
+}
+
+func TestService_RollbackExpired(t *testing.T) {
+	s := newHistoryService(NewMemoryHistory())
+	require.NoError(t, s.Create(context.Background(), expiringTarget("test", -time.Minute)))
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+
+	target := NewTarget()
+	require.NoError(t, s.Rollback(context.Background(), "test", 1, target))
+	assert.Nil(t, target.ExpiresAt)
+	assert.NoError(t, s.Get(context.Background(), &Target{ID: "test"}))
+}
+
+func TestChangeLog_limit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history, err := OpenFileHistory(path)
+	require.NoError(t, err)
+	log := history.(*changeLog)
+	log.limit = 2
+	for version := int64(1); version <= 9; version++ {
+		require.NoError(t, history.Append(context.Background(), &Change{ID: "test", Version: version, Action: ActionUpdate}))
+	}
+	require.NoError(t, history.Append(context.Background(), &Change{ID: "other", Version: 1, Action: ActionCreate}))
+
+	changes := []Change{}
+	require.NoError(t, history.List(context.Background(), "test", &changes))
+	require.Len(t, changes, 2)
+	assert.Equal(t, int64(8), changes[0].Version)
+	assert.Equal(t, int64(9), changes[1].Version)
+	// the file was rewritten with the kept changes once the dropped ones were the most of it
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Less(t, bytes.Count(data, []byte("\n")), 10)
+
+	// the file may still hold some of the dropped changes until it is rewritten again
+	reopened, err := OpenFileHistory(path)
+	require.NoError(t, err)
+	require.NoError(t, reopened.List(context.Background(), "test", &changes))
+	assert.Less(t, len(changes), 9)
+	assert.Equal(t, int64(9), changes[len(changes)-1].Version)
+	require.NoError(t, reopened.List(context.Background(), "other", &changes))
+	assert.Len(t, changes, 1)
+}
+
+func TestOpenFileHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history, err := OpenFileHistory(path)
+	require.NoError(t, err)
+	s := newHistoryService(history)
+	require.NoError(t, s.Create(context.Background(), historyTarget("a:9100")))
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+
+	// the history is read back after restart
+	reopened, err := OpenFileHistory(path)
+	require.NoError(t, err)
+	changes := []Change{}
+	require.NoError(t, reopened.List(context.Background(), "test", &changes))
+	require.Len(t, changes, 2)
+	assert.Equal(t, ActionDelete, changes[1].Action)
+	assert.Equal(t, int64(2), changes[1].Version)
+
+	_, err = OpenFileHistory(filepath.Join(t.TempDir(), "dirNotExist", "history.jsonl"))
+	assert.Error(t, err)
+}
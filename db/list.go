@@ -0,0 +1,138 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+type SortField string
+
+const (
+	SortByName SortField = "name"
+	SortByTime SortField = "time"
+)
+
+// ListQuery selects targets for Storage.GetAll,
+// zero value selects all targets sorted by name.
+type ListQuery struct {
+	NamePrefix string
+	// Labels have to be matched by a single entry of the target.
+	Labels map[string]string
+	SortBy SortField
+	// After is the last target of the previous page.
+	After *Cursor
+	// Limit is the page size, 0 means no limit.
+	Limit int
+}
+
+// Cursor points at the last target of a page, the next page starts right after it.
+type Cursor struct {
+	ID   ID        `json:"id"`
+	Name string    `json:"name,omitempty"`
+	Time time.Time `json:"time,omitempty"`
+}
+
+// Page is a part of the list of targets, Next is empty on the last page.
+type Page struct {
+	Targets []Target
+	Next    string
+}
+
+func NewCursor(target *Target) *Cursor {
+	return &Cursor{ID: target.ID, Name: target.Name, Time: target.Time}
+}
+
+// String encodes cursor into an opaque token for API clients.
+func (c *Cursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func ParseCursor(token string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, &ValidationError{Text: "Cursor is invalid", Err: err}
+	}
+	c := &Cursor{}
+	err = json.Unmarshal(data, c)
+	if err != nil || c.ID == nilID {
+		return nil, &ValidationError{Text: "Cursor is invalid", Err: err}
+	}
+	return c, nil
+}
+
+func (q *ListQuery) validate() error {
+	switch q.SortBy {
+	case "", SortByName, SortByTime:
+	default:
+		return &ValidationError{Text: "Sort field is invalid"}
+	}
+	if q.Limit < 0 {
+		return &ValidationError{Text: "Limit is invalid"}
+	}
+	return nil
+}
+
+// Match reports whether target passes name prefix and label filters.
+func (q *ListQuery) Match(t *Target) bool {
+	if !strings.HasPrefix(t.Name, q.NamePrefix) {
+		return false
+	}
+	if len(q.Labels) == 0 {
+		return true
+	}
+	for _, e := range t.Entries {
+		if e.hasLabels(q.Labels) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Entry) hasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if value, ok := e.Labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Less orders targets by the sort field, ties are broken by ID.
+func (q *ListQuery) Less(a, b *Target) bool {
+	if q.SortBy == SortByTime {
+		if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+	} else if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.ID < b.ID
+}
+
+// IsAfter reports whether target goes after the cursor.
+func (q *ListQuery) IsAfter(t *Target) bool {
+	if q.After == nil {
+		return true
+	}
+	return q.Less(&Target{ID: q.After.ID, Name: q.After.Name, Time: q.After.Time}, t)
+}
+
+// Apply filters, sorts and cuts the page out of targets,
+// storages which can't do it natively apply the query to what they have read.
+func (q *ListQuery) Apply(targets []Target) []Target {
+	result := make([]Target, 0, len(targets))
+	for i := range targets {
+		if q.Match(&targets[i]) && q.IsAfter(&targets[i]) {
+			result = append(result, targets[i])
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return q.Less(&result[i], &result[j]) })
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+	return result
+}
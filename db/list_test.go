@@ -0,0 +1,90 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCursor(t *testing.T) {
+	cursor := &Cursor{ID: "test", Name: "web", Time: time.Date(2022, 12, 1, 10, 0, 0, 0, time.UTC)}
+	got, err := ParseCursor(cursor.String())
+	assert.NoError(t, err)
+	assert.Equal(t, cursor, got)
+
+	_, err = ParseCursor("not a cursor")
+	assert.IsType(t, &ValidationError{}, err)
+}
+
+func TestListQuery_Match(t *testing.T) {
+	target := &Target{ID: "db-1", Name: "web-1", Entries: []Entry{
+		{Labels: map[string]string{"env": "prod"}},
+		{Labels: map[string]string{"team": "sre"}},
+	}}
+	tests := []struct {
+		name  string
+		query ListQuery
+		want  bool
+	}{
+		{
+			name:  "noFilters",
+			query: ListQuery{},
+			want:  true,
+		},
+		{
+			name:  "namePrefix",
+			query: ListQuery{NamePrefix: "web"},
+			want:  true,
+		},
+		{
+			name:  "otherPrefix",
+			query: ListQuery{NamePrefix: "db"},
+			want:  false,
+		},
+		{
+			name:  "label",
+			query: ListQuery{Labels: map[string]string{"env": "prod"}},
+			want:  true,
+		},
+		{
+			name:  "labelsOfDifferentEntries",
+			query: ListQuery{Labels: map[string]string{"env": "prod", "team": "sre"}},
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.query.Match(target))
+		})
+	}
+}
+
+func TestListQuery_Apply(t *testing.T) {
+	now := time.Now()
+	// a renamed target keeps its ID
+	targets := []Target{
+		{ID: "a", Name: "web-2", Time: now},
+		{ID: "b", Name: "web-1", Time: now.Add(time.Second)},
+		{ID: "c", Name: "web-1", Time: now},
+	}
+	tests := []struct {
+		name  string
+		query ListQuery
+		want  []ID
+	}{
+		{name: "byName", query: ListQuery{}, want: []ID{"b", "c", "a"}},
+		{name: "byNameAfter", query: ListQuery{After: &Cursor{ID: "b", Name: "web-1"}}, want: []ID{"c", "a"}},
+		{name: "byTime", query: ListQuery{SortBy: SortByTime}, want: []ID{"a", "c", "b"}},
+		{name: "byTimeAfter", query: ListQuery{SortBy: SortByTime, After: &Cursor{ID: "a", Name: "web-2", Time: now}, Limit: 1}, want: []ID{"c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []ID{}
+			for _, target := range tt.query.Apply(targets) {
+				got = append(got, target.ID)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
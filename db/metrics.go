@@ -0,0 +1,41 @@
+package db
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "promhsd"
+
+var (
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_hits_total",
+		Help:      "Targets read from the cache.",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_misses_total",
+		Help:      "Targets read from the storage because they weren't cached or had expired.",
+	})
+	staleResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stale_responses_total",
+		Help:      "Last known targets served because the storage failed.",
+	})
+	mirrorDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_dropped_total",
+		Help:      "Changes which weren't copied to a secondary storage by reason, queue_full or failed.",
+	}, []string{"reason"})
+	mirrorReconciled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_reconciled_total",
+		Help:      "Targets of a secondary storage which differed from the primary and were fixed by the reconcile.",
+	})
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Changes posted to webhooks by outcome, delivered or failed.",
+	}, []string{"outcome"})
+)
@@ -0,0 +1,310 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorQueueSize = 1000
+	mirrorAttempts  = 5
+	mirrorBackoff   = 500 * time.Millisecond
+)
+
+type mirrorOp struct {
+	action Action
+	target Target
+}
+
+// secondary applies changes of the primary in the order they were made,
+// mu keeps the reconcile from interleaving with them.
+type secondary struct {
+	mu      sync.Mutex
+	storage Storage
+	queue   chan mirrorOp
+}
+
+// Mirror writes to the primary storage and copies every change to the secondaries in the background,
+// a change which can't be copied is retried with a growing backoff, a dropped one is fixed by Reconcile.
+// Reads fail over to the secondaries when the primary fails. Secondaries keep the revisions of the primary.
+type Mirror struct {
+	primary     Storage
+	secondaries []*secondary
+	attempts    int
+	backoff     time.Duration
+	// timeout limits every attempt to copy a change, NewService sets the write timeout of the service
+	timeout time.Duration
+	// pending counts the queued changes, tests wait for them
+	pending sync.WaitGroup
+}
+
+func NewMirror(primary Storage, secondaries ...Storage) *Mirror {
+	m := &Mirror{primary: primary, attempts: mirrorAttempts, backoff: mirrorBackoff, timeout: DefaultTimeouts.Write}
+	for _, storage := range secondaries {
+		s := &secondary{storage: storage, queue: make(chan mirrorOp, mirrorQueueSize)}
+		m.secondaries = append(m.secondaries, s)
+		go m.run(s)
+	}
+	return m
+}
+
+func (m *Mirror) run(s *secondary) {
+	for op := range s.queue {
+		s.mu.Lock()
+		m.apply(s.storage, op)
+		s.mu.Unlock()
+		m.pending.Done()
+	}
+}
+
+// mirror queues the change for every secondary, it is dropped if a secondary is too far behind.
+func (m *Mirror) mirror(action Action, target *Target) {
+	op := mirrorOp{action: action, target: *target.clone()}
+	for _, s := range m.secondaries {
+		m.pending.Add(1)
+		select {
+		case s.queue <- op:
+		default:
+			m.pending.Done()
+			mirrorDropped.WithLabelValues("queue_full").Inc()
+			log.Printf("(Mirror) Queue is full, %s of %s is dropped until the reconcile\n", action, target.ID)
+		}
+	}
+}
+
+func (m *Mirror) apply(storage Storage, op mirrorOp) {
+	backoff := m.backoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := withTimeout(context.Background(), m.timeout)
+		err := applyChange(ctx, storage, op)
+		cancel()
+		if err == nil {
+			return
+		}
+		if attempt == m.attempts {
+			mirrorDropped.WithLabelValues("failed").Inc()
+			log.Printf("(Mirror) Failed to %s %s, it is dropped until the reconcile: %s\n", op.action, op.target.ID, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// applyChange makes the secondary hold the same target as the primary, whatever it held before.
+// The target is imported with the revision of the primary, so an ETag read from a secondary
+// during a failover holds once the primary is back.
+func applyChange(ctx context.Context, storage Storage, op mirrorOp) error {
+	var notFound *NotFoundError
+	err := storage.Delete(ctx, &Target{ID: op.target.ID})
+	if err != nil && !errors.As(err, &notFound) {
+		return err
+	}
+	if op.action == ActionDelete {
+		return nil
+	}
+	return Import(ctx, storage, op.target.clone())
+}
+
+func (m *Mirror) Create(ctx context.Context, target *Target) error {
+	if err := m.primary.Create(ctx, target); err != nil {
+		return err
+	}
+	m.mirror(ActionCreate, target)
+	return nil
+}
+
+// Import keeps the ID in the primary and the secondaries.
+func (m *Mirror) Import(ctx context.Context, target *Target) error {
+	if err := Import(ctx, m.primary, target); err != nil {
+		return err
+	}
+	m.mirror(ActionCreate, target)
+	return nil
+}
+
+func (m *Mirror) Update(ctx context.Context, target *Target) error {
+	if err := m.primary.Update(ctx, target); err != nil {
+		return err
+	}
+	m.mirror(ActionUpdate, target)
+	return nil
+}
+
+func (m *Mirror) Delete(ctx context.Context, target *Target) error {
+	if err := m.primary.Delete(ctx, target); err != nil {
+		return err
+	}
+	m.mirror(ActionDelete, target)
+	return nil
+}
+
+// failover tells errors of a failing storage from answers of a working one.
+func failover(err error) bool {
+	var (
+		notFound   *NotFoundError
+		validation *ValidationError
+	)
+	return err != nil && !errors.As(err, &notFound) && !errors.As(err, &validation)
+}
+
+// share returns ctx of one of the left attempts, it gets an equal share of the time ctx has left,
+// so a primary which hangs leaves time for the secondaries.
+func share(ctx context.Context, left int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || left <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(left))
+}
+
+// read calls read with the primary, then with the secondaries until one of them answers.
+func (m *Mirror) read(ctx context.Context, action string, read func(context.Context, Storage) error) error {
+	left := len(m.secondaries) + 1
+	attemptCtx, cancel := share(ctx, left)
+	err := read(attemptCtx, m.primary)
+	cancel()
+	for _, s := range m.secondaries {
+		if !failover(err) || ctx.Err() != nil {
+			break
+		}
+		log.Printf("(Mirror) Primary failed, %s a secondary: %s\n", action, err)
+		left--
+		attemptCtx, cancel = share(ctx, left)
+		err = read(attemptCtx, s.storage)
+		cancel()
+	}
+	return err
+}
+
+func (m *Mirror) Get(ctx context.Context, target *Target) error {
+	return m.read(ctx, "reading from", func(ctx context.Context, storage Storage) error {
+		return storage.Get(ctx, target)
+	})
+}
+
+func (m *Mirror) GetAll(ctx context.Context, query *ListQuery, list *[]Target) error {
+	return m.read(ctx, "listing", func(ctx context.Context, storage Storage) error {
+		return storage.GetAll(ctx, query, list)
+	})
+}
+
+// Reconcile makes every secondary hold the same targets as the primary, it copies changes
+// which were dropped. It returns how many targets of the secondaries were fixed.
+func (m *Mirror) Reconcile(ctx context.Context) (int, error) {
+	fixed := 0
+	for _, s := range m.secondaries {
+		n, err := m.reconcile(ctx, s)
+		fixed += n
+		if err != nil {
+			return fixed, err
+		}
+	}
+	return fixed, nil
+}
+
+func (m *Mirror) reconcile(ctx context.Context, s *secondary) (int, error) {
+	// queued changes are applied before the primary is read or after the secondary is fixed
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want, err := readAll(ctx, m.primary)
+	if err != nil {
+		return 0, err
+	}
+	got, err := readAll(ctx, s.storage)
+	if err != nil {
+		return 0, err
+	}
+	ops := []mirrorOp{}
+	for id, target := range want {
+		current, ok := got[id]
+		if !ok {
+			ops = append(ops, mirrorOp{action: ActionCreate, target: target})
+		} else if !sameTarget(&current, &target) {
+			ops = append(ops, mirrorOp{action: ActionUpdate, target: target})
+		}
+	}
+	for id, target := range got {
+		if _, ok := want[id]; !ok {
+			ops = append(ops, mirrorOp{action: ActionDelete, target: target})
+		}
+	}
+	fixed := 0
+	for _, op := range ops {
+		if err := applyChange(ctx, s.storage, op); err != nil {
+			return fixed, err
+		}
+		mirrorReconciled.Inc()
+		fixed++
+	}
+	return fixed, nil
+}
+
+func readAll(ctx context.Context, storage Storage) (map[ID]Target, error) {
+	list := []Target{}
+	if err := storage.GetAll(ctx, &ListQuery{}, &list); err != nil {
+		return nil, err
+	}
+	targets := make(map[ID]Target, len(list))
+	for _, target := range list {
+		targets[target.ID] = target
+	}
+	return targets, nil
+}
+
+// sameTarget compares what a secondary copies, times may lose precision.
+func sameTarget(a, b *Target) bool {
+	if a.Name != b.Name || a.Revision != b.Revision || (a.ExpiresAt == nil) != (b.ExpiresAt == nil) {
+		return false
+	}
+	if a.ExpiresAt != nil && !a.ExpiresAt.Truncate(time.Millisecond).Equal(b.ExpiresAt.Truncate(time.Millisecond)) {
+		return false
+	}
+	added, removed := EntriesDiff(a.Entries, b.Entries)
+	return len(added) == 0 && len(removed) == 0
+}
+
+// Resync reconciles the secondaries every interval until ctx is done, zero interval disables it.
+func (m *Mirror) Resync(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fixed, err := m.Reconcile(ctx)
+		if err != nil {
+			log.Println("(Mirror) Failed to reconcile the secondaries:", err)
+		}
+		if fixed > 0 {
+			log.Printf("(Mirror) %d targets of the secondaries were reconciled\n", fixed)
+		}
+	}
+}
+
+// Watch follows the change feed of the primary.
+func (m *Mirror) Watch(ctx context.Context, events chan<- Event) error {
+	if watcher, ok := m.primary.(Watcher); ok {
+		return watcher.Watch(ctx, events)
+	}
+	return errNotWatchable
+}
+
+// ExpiresTargets reports the primary, expired targets the secondaries keep are deleted by Reconcile.
+func (m *Mirror) ExpiresTargets() bool {
+	expirer, ok := m.primary.(Expirer)
+	return ok && expirer.ExpiresTargets()
+}
+
+// IsHealthy reports the primary, targets can't be changed without it.
+func (m *Mirror) IsHealthy(ctx context.Context) bool {
+	return m.primary.IsHealthy(ctx)
+}
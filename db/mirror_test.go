@@ -0,0 +1,192 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStorage fails the given number of writes before it starts working.
+type flakyStorage struct {
+	mapStorage
+	mu       sync.Mutex
+	failures int
+}
+
+func (s *flakyStorage) fail() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures == 0 {
+		return nil
+	}
+	s.failures--
+	return &StorageError{Text: "storage is down", Err: errors.New("connection refused")}
+}
+
+func (s *flakyStorage) Create(ctx context.Context, target *Target) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.mapStorage.Create(ctx, target)
+}
+
+func (s *flakyStorage) Import(ctx context.Context, target *Target) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.mapStorage.Import(ctx, target)
+}
+
+// wait blocks until the queued changes have been copied.
+func (m *Mirror) wait() {
+	m.pending.Wait()
+}
+
+func newTestMirror(primary Storage, secondaries ...Storage) *Mirror {
+	m := NewMirror(primary, secondaries...)
+	m.backoff = time.Millisecond
+	return m
+}
+
+func TestMirror_copiesChanges(t *testing.T) {
+	primary := &mapStorage{targets: map[ID]Target{}}
+	secondaries := []*mapStorage{{targets: map[ID]Target{}}, {targets: map[ID]Target{}}}
+	m := newTestMirror(primary, secondaries[0], secondaries[1])
+	s := NewService(m)
+
+	target := historyTarget("a:9100")
+	require.NoError(t, s.Create(context.Background(), target))
+	m.wait()
+	for _, secondary := range secondaries {
+		assert.Equal(t, []string{"a:9100"}, secondary.targets["test"].Entries[0].Targets)
+	}
+
+	// the secondary takes the revision of the primary, whatever it held
+	secondaries[0].targets["test"] = Target{ID: "test", Name: "test", Revision: 5}
+	update := historyTarget("b:9100")
+	update.ID, update.Revision = "test", FirstRevision
+	require.NoError(t, s.Update(context.Background(), update))
+	m.wait()
+	for _, secondary := range secondaries {
+		assert.Equal(t, []string{"b:9100"}, secondary.targets["test"].Entries[0].Targets)
+	}
+	for _, secondary := range secondaries {
+		assert.Equal(t, update.Revision, secondary.targets["test"].Revision)
+	}
+
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+	m.wait()
+	for _, secondary := range secondaries {
+		assert.Empty(t, secondary.targets)
+	}
+}
+
+func TestMirror_timeout(t *testing.T) {
+	m := newTestMirror(&mapStorage{targets: map[ID]Target{}})
+	assert.Equal(t, DefaultTimeouts.Write, m.timeout)
+	NewService(m, WithTimeouts(Timeouts{Write: time.Minute}))
+	assert.Equal(t, time.Minute, m.timeout)
+}
+
+func TestMirror_retries(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		copied   bool
+	}{
+		{name: "recovers", failures: mirrorAttempts - 1, copied: true},
+		{name: "givesUp", failures: mirrorAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secondary := &flakyStorage{mapStorage: mapStorage{targets: map[ID]Target{}}, failures: tt.failures}
+			m := newTestMirror(&mapStorage{targets: map[ID]Target{}}, secondary)
+			failed := mirrorDropped.WithLabelValues("failed")
+			failures := testutil.ToFloat64(failed)
+			require.NoError(t, m.Create(context.Background(), historyTarget("a:9100")))
+			m.wait()
+			_, copied := secondary.targets["test"]
+			assert.Equal(t, tt.copied, copied)
+			if tt.copied {
+				assert.Equal(t, failures, testutil.ToFloat64(failed))
+			} else {
+				assert.Equal(t, failures+1, testutil.ToFloat64(failed))
+			}
+		})
+	}
+}
+
+func TestMirror_failover(t *testing.T) {
+	primary := &failingStorage{mapStorage: mapStorage{targets: map[ID]Target{}}}
+	secondary := &mapStorage{targets: map[ID]Target{}}
+	m := newTestMirror(primary, secondary)
+	require.NoError(t, m.Create(context.Background(), historyTarget("a:9100")))
+	m.wait()
+
+	// missing targets don't fail over
+	secondary.targets["other"] = Target{ID: "other", Name: "other"}
+	err := m.Get(context.Background(), &Target{ID: "other"})
+	assert.IsType(t, &NotFoundError{}, err)
+
+	primary.down = true
+	target := &Target{ID: "test"}
+	require.NoError(t, m.Get(context.Background(), target))
+	assert.Equal(t, []string{"a:9100"}, target.Entries[0].Targets)
+	// the ETag of the secondary is the one of the primary
+	assert.Equal(t, FirstRevision, target.Revision)
+	list := []Target{}
+	require.NoError(t, m.GetAll(context.Background(), &ListQuery{}, &list))
+	assert.Len(t, list, 2)
+}
+
+// hangingStorage answers reads only when ctx is done.
+type hangingStorage struct {
+	mapStorage
+}
+
+func (s *hangingStorage) Get(ctx context.Context, target *Target) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestMirror_failoverDeadline(t *testing.T) {
+	secondary := &mapStorage{targets: map[ID]Target{"test": *historyTarget("a:9100")}}
+	m := newTestMirror(&hangingStorage{}, secondary)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// the primary uses up only its share of the time
+	assert.NoError(t, m.Get(ctx, &Target{ID: "test"}))
+}
+
+func TestMirror_Reconcile(t *testing.T) {
+	primary := &mapStorage{targets: map[ID]Target{}}
+	secondary := &mapStorage{targets: map[ID]Target{}}
+	m := newTestMirror(primary, secondary)
+	require.NoError(t, m.Create(context.Background(), historyTarget("a:9100")))
+	m.wait()
+	fixed, err := m.Reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, fixed)
+
+	// changes which were dropped
+	primary.targets["added"] = Target{ID: "added", Name: "added", Revision: 1}
+	changed := primary.targets["test"]
+	changed.Entries = historyTarget("b:9100").Entries
+	primary.targets["test"] = changed
+	secondary.targets["deleted"] = Target{ID: "deleted", Name: "deleted", Revision: 1}
+
+	reconciled := testutil.ToFloat64(mirrorReconciled)
+	fixed, err = m.Reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, fixed)
+	assert.Equal(t, reconciled+3, testutil.ToFloat64(mirrorReconciled))
+	assert.Contains(t, secondary.targets, ID("added"))
+	assert.NotContains(t, secondary.targets, ID("deleted"))
+	assert.Equal(t, []string{"b:9100"}, secondary.targets["test"].Entries[0].Targets)
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// WithSnapshots keeps the last known good state of every target read or written,
+// GetLastKnown serves it while the storage is failing. Snapshots are also written
+// to dir when it is given, so they survive a restart during an outage.
+// At most limit snapshots are kept in memory, the least recently used one is dropped first,
+// its file is kept. Zero limit keeps all of them.
+func WithSnapshots(dir string, limit int) Option {
+	return func(s *Service) {
+		s.snapshots = &snapshots{targets: map[ID]*list.Element{}, order: list.New(), dir: dir, limit: limit}
+	}
+}
+
+type snapshots struct {
+	mu      sync.Mutex
+	targets map[ID]*list.Element
+	// order holds targets, the most recently used one at the front
+	order *list.List
+	dir   string
+	limit int
+}
+
+// keep puts the target to the front of the order, dropping the least recently used one beyond the limit.
+func (s *snapshots) keep(target Target) {
+	if element, ok := s.targets[target.ID]; ok {
+		element.Value = target
+		s.order.MoveToFront(element)
+		return
+	}
+	s.targets[target.ID] = s.order.PushFront(target)
+	if s.limit > 0 && s.order.Len() > s.limit {
+		oldest := s.order.Remove(s.order.Back()).(Target)
+		delete(s.targets, oldest.ID)
+	}
+}
+
+func (s *snapshots) path(id ID) string {
+	return filepath.Join(s.dir, url.PathEscape(id.String())+".json")
+}
+
+// set keeps the target, the file is written only when the target has changed.
+func (s *snapshots) set(target *Target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.targets[target.ID]; ok {
+		current := element.Value.(Target)
+		if current.Revision == target.Revision && current.Time.Equal(target.Time) {
+			s.order.MoveToFront(element)
+			return
+		}
+	}
+	s.keep(*target.clone())
+	if s.dir == "" {
+		return
+	}
+	if err := s.write(target); err != nil {
+		log.Println("(Snapshot) Failed to write the snapshot:", err)
+	}
+}
+
+// write replaces the file by renaming, so a crash never leaves a half-written snapshot.
+func (s *snapshots) write(target *Target) error {
+	data, err := json.Marshal(target)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(target.ID))
+}
+
+// get copies the snapshot into target, snapshots of a previous run are read from dir.
+func (s *snapshots) get(target *Target) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var snapshot Target
+	if element, ok := s.targets[target.ID]; ok {
+		snapshot = element.Value.(Target)
+	} else {
+		if s.dir == "" {
+			return false
+		}
+		data, err := os.ReadFile(s.path(target.ID))
+		if err != nil {
+			return false
+		}
+		if err = json.Unmarshal(data, &snapshot); err != nil {
+			log.Println("(Snapshot) Failed to read the snapshot:", err)
+			return false
+		}
+	}
+	s.keep(snapshot)
+	*target = *snapshot.clone()
+	return true
+}
+
+func (s *snapshots) remove(id ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.targets[id]; ok {
+		s.order.Remove(element)
+		delete(s.targets, id)
+	}
+	if s.dir == "" {
+		return
+	}
+	if err := os.Remove(s.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("(Snapshot) Failed to remove the snapshot:", err)
+	}
+}
+
+// follow keeps snapshots in line with a change seen in the change feed of the storage,
+// changes of other replicas would leave them stale otherwise.
+func (s *snapshots) follow(event *Event) {
+	if event.Action == ActionDelete {
+		s.remove(event.Target.ID)
+		return
+	}
+	s.set(&event.Target)
+}
+
+// GetLastKnown reads the target like Get does, when the storage fails
+// it returns the last known state of the target and reports it is stale.
+func (s *Service) GetLastKnown(ctx context.Context, target *Target) (bool, error) {
+	err := s.Get(ctx, target)
+	if err == nil || s.snapshots == nil {
+		return false, err
+	}
+	var (
+		notFound   *NotFoundError
+		validation *ValidationError
+	)
+	if errors.As(err, &notFound) || errors.As(err, &validation) {
+		return false, err
+	}
+	if !s.snapshots.get(target) {
+		return false, err
+	}
+	if err := expiredError(target); err != nil {
+		return false, err
+	}
+	log.Println("(Get) Serving the last known state of", target.ID)
+	staleResponses.Inc()
+	return true, nil
+}
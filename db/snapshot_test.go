@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStorage fails reads once down is set.
+type failingStorage struct {
+	mapStorage
+	down bool
+}
+
+func (s *failingStorage) Get(ctx context.Context, target *Target) error {
+	if s.down {
+		return &StorageError{Text: "storage is down", Err: errors.New("connection refused")}
+	}
+	return s.mapStorage.Get(ctx, target)
+}
+
+func (s *failingStorage) GetAll(ctx context.Context, query *ListQuery, list *[]Target) error {
+	if s.down {
+		return &StorageError{Text: "storage is down", Err: errors.New("connection refused")}
+	}
+	return s.mapStorage.GetAll(ctx, query, list)
+}
+
+func TestService_GetLastKnown(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  bool
+	}{
+		{name: "memory"},
+		{name: "disk", dir: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := ""
+			if tt.dir {
+				dir = t.TempDir()
+			}
+			storage := &failingStorage{mapStorage: mapStorage{targets: map[ID]Target{}}}
+			s := &Service{storage: storage}
+			WithSnapshots(dir, 0)(s)
+			require.NoError(t, s.Create(context.Background(), historyTarget("a:9100")))
+
+			target := &Target{ID: "test"}
+			stale, err := s.GetLastKnown(context.Background(), target)
+			require.NoError(t, err)
+			assert.False(t, stale)
+
+			storage.down = true
+			served := testutil.ToFloat64(staleResponses)
+			target = &Target{ID: "test"}
+			stale, err = s.GetLastKnown(context.Background(), target)
+			require.NoError(t, err)
+			assert.True(t, stale)
+			assert.Equal(t, []string{"a:9100"}, target.Entries[0].Targets)
+			assert.Equal(t, served+1, testutil.ToFloat64(staleResponses))
+
+			// targets never seen can't be served
+			_, err = s.GetLastKnown(context.Background(), &Target{ID: "other"})
+			assert.IsType(t, &StorageError{}, err)
+
+			if tt.dir {
+				// a restarted service reads snapshots of the previous run
+				restarted := &Service{storage: storage}
+				WithSnapshots(dir, 0)(restarted)
+				target = &Target{ID: "test"}
+				stale, err = restarted.GetLastKnown(context.Background(), target)
+				require.NoError(t, err)
+				assert.True(t, stale)
+				assert.Equal(t, []string{"a:9100"}, target.Entries[0].Targets)
+			}
+
+			// deleted targets are forgotten
+			storage.down = false
+			require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+			storage.down = true
+			_, err = s.GetLastKnown(context.Background(), &Target{ID: "test"})
+			assert.IsType(t, &StorageError{}, err)
+			if tt.dir {
+				restarted := &Service{storage: storage}
+				WithSnapshots(dir, 0)(restarted)
+				_, err = restarted.GetLastKnown(context.Background(), &Target{ID: "test"})
+				assert.IsType(t, &StorageError{}, err)
+			}
+		})
+	}
+}
+
+func TestSnapshots_limit(t *testing.T) {
+	dir := t.TempDir()
+	s := &Service{storage: &mapStorage{targets: map[ID]Target{}}}
+	WithSnapshots(dir, 2)(s)
+	s.snapshots.set(&Target{ID: "a", Revision: 1})
+	s.snapshots.set(&Target{ID: "b", Revision: 1})
+	// a is used more recently than b
+	assert.True(t, s.snapshots.get(&Target{ID: "a"}))
+	s.snapshots.set(&Target{ID: "c", Revision: 1})
+	assert.Len(t, s.snapshots.targets, 2)
+	assert.Contains(t, s.snapshots.targets, ID("a"))
+	assert.NotContains(t, s.snapshots.targets, ID("b"))
+	// the dropped snapshot is read from its file again
+	assert.True(t, s.snapshots.get(&Target{ID: "b"}))
+	assert.NotContains(t, s.snapshots.targets, ID("a"))
+}
+
+func TestService_GetLastKnownNotFound(t *testing.T) {
+	s := &Service{storage: &mapStorage{targets: map[ID]Target{}}}
+	WithSnapshots("", 0)(s)
+	stale, err := s.GetLastKnown(context.Background(), &Target{ID: "missing"})
+	assert.False(t, stale)
+	assert.IsType(t, &NotFoundError{}, err)
+}
@@ -0,0 +1,415 @@
+// Package storagetest provides conformance tests for db.Storage implementations.
+//
+// Every storage runs the same suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) db.Storage {
+//			return newEmptyStorage(t)
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"promhsd/db"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new empty storage, it is called for every sub-test.
+type Factory func(t *testing.T) db.Storage
+
+func newTarget(name string) *db.Target {
+	t := db.NewTarget()
+	t.Name = name
+	t.Time = time.Now().UTC().Truncate(time.Millisecond)
+	entry := db.NewEntry()
+	entry.Targets = []string{"127.0.0.1:9100", "127.0.0.1:9101"}
+	entry.Labels["env"] = name
+	t.Entries = append(t.Entries, *entry)
+	return t
+}
+
+func isNotFound(err error) bool {
+	var notFound *db.NotFoundError
+	return errors.As(err, &notFound)
+}
+
+func isConflict(err error) bool {
+	var conflict *db.ConflictError
+	return errors.As(err, &conflict)
+}
+
+func assertTarget(t *testing.T, want, got *db.Target) {
+	t.Helper()
+	assert.Equal(t, want.ID, got.ID)
+	assert.Equal(t, want.Name, got.Name)
+	assert.Equal(t, want.Revision, got.Revision)
+	assert.Equal(t, want.Entries, got.Entries)
+	assert.WithinDuration(t, want.Time, got.Time, time.Millisecond)
+	if assert.Equal(t, want.ExpiresAt == nil, got.ExpiresAt == nil, "expires_at") && want.ExpiresAt != nil {
+		assert.WithinDuration(t, *want.ExpiresAt, *got.ExpiresAt, time.Millisecond)
+	}
+}
+
+// Run checks ID assignment, conflict, not-found, update-of-missing, revision, expiry, listing and paging semantics,
+// also of targets renamed after they were created.
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s db.Storage)
+	}{
+		{"IsHealthy", testIsHealthy},
+		{"CreateAssignsID", testCreateAssignsID},
+		{"CreateConflict", testCreateConflict},
+		{"GetNotFound", testGetNotFound},
+		{"GetCreated", testGetCreated},
+		{"UpdateReplaces", testUpdateReplaces},
+		{"UpdateStale", testUpdateStale},
+		{"UpdateMissing", testUpdateMissing},
+		{"ExpiresAtKept", testExpiresAtKept},
+		{"Import", testImport},
+		{"DeleteRemoves", testDeleteRemoves},
+		{"DeleteMissing", testDeleteMissing},
+		{"GetAllEmpty", testGetAllEmpty},
+		{"GetAll", testGetAll},
+		{"GetAllNamePrefix", testGetAllNamePrefix},
+		{"GetAllLabels", testGetAllLabels},
+		{"GetAllSortByTime", testGetAllSortByTime},
+		{"GetAllPages", testGetAllPages},
+		{"GetAllRenamed", testGetAllRenamed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func testIsHealthy(t *testing.T, s db.Storage) {
+	assert.True(t, s.IsHealthy(context.Background()))
+}
+
+func testCreateAssignsID(t *testing.T, s db.Storage) {
+	target := newTarget("test")
+	target.ID = "ignored"
+	require.NoError(t, s.Create(context.Background(), target))
+	assert.Equal(t, db.ID("test"), target.ID)
+}
+
+func testCreateConflict(t *testing.T, s db.Storage) {
+	require.NoError(t, s.Create(context.Background(), newTarget("test")))
+	err := s.Create(context.Background(), newTarget("test"))
+	assert.True(t, isConflict(err), "want ConflictError, got %v", err)
+}
+
+func testGetNotFound(t *testing.T, s db.Storage) {
+	err := s.Get(context.Background(), &db.Target{ID: "test"})
+	assert.True(t, isNotFound(err), "want NotFoundError, got %v", err)
+}
+
+func testGetCreated(t *testing.T, s db.Storage) {
+	want := newTarget("test")
+	require.NoError(t, s.Create(context.Background(), want))
+	got := db.NewTarget()
+	got.ID = want.ID
+	require.NoError(t, s.Get(context.Background(), got))
+	assertTarget(t, want, got)
+}
+
+func testUpdateReplaces(t *testing.T, s db.Storage) {
+	require.NoError(t, s.Create(context.Background(), newTarget("test")))
+	want := newTarget("test")
+	want.ID = "test"
+	want.Entries[0].Targets = []string{"10.0.0.1:9100"}
+	want.Entries[0].Labels = map[string]string{"team": "sre"}
+	want.Revision = db.FirstRevision
+	require.NoError(t, s.Update(context.Background(), want))
+	assert.Equal(t, db.FirstRevision+1, want.Revision)
+	got := db.NewTarget()
+	got.ID = want.ID
+	require.NoError(t, s.Get(context.Background(), got))
+	assertTarget(t, want, got)
+	assert.Equal(t, want.Revision, got.Revision)
+}
+
+func testUpdateStale(t *testing.T, s db.Storage) {
+	require.NoError(t, s.Create(context.Background(), newTarget("test")))
+	first := newTarget("test")
+	first.ID = "test"
+	first.Revision = db.FirstRevision
+	require.NoError(t, s.Update(context.Background(), first))
+	// the second writer still has the first revision
+	stale := newTarget("test")
+	stale.ID = "test"
+	stale.Revision = db.FirstRevision
+	stale.Entries[0].Targets = []string{"10.0.0.1:9100"}
+	err := s.Update(context.Background(), stale)
+	assert.True(t, isConflict(err), "want ConflictError, got %v", err)
+	got := db.NewTarget()
+	got.ID = "test"
+	require.NoError(t, s.Get(context.Background(), got))
+	assertTarget(t, first, got)
+}
+
+func testUpdateMissing(t *testing.T, s db.Storage) {
+	target := newTarget("test")
+	target.ID = "test"
+	err := s.Update(context.Background(), target)
+	assert.True(t, isNotFound(err), "want NotFoundError, got %v", err)
+	// update must not create the target
+	err = s.Get(context.Background(), &db.Target{ID: "test"})
+	assert.True(t, isNotFound(err), "want NotFoundError, got %v", err)
+}
+
+// testExpiresAtKept stores the expiry, it is far ahead so that storages with a native expiry keep the target.
+func testExpiresAtKept(t *testing.T, s db.Storage) {
+	target := newTarget("test")
+	expiresAt := time.Now().UTC().Add(24 * time.Hour).Truncate(time.Millisecond)
+	target.ExpiresAt = &expiresAt
+	require.NoError(t, s.Create(context.Background(), target))
+	got := db.NewTarget()
+	got.ID = target.ID
+	require.NoError(t, s.Get(context.Background(), got))
+	assertTarget(t, target, got)
+	list := []db.Target{}
+	require.NoError(t, s.GetAll(context.Background(), &db.ListQuery{}, &list))
+	require.Len(t, list, 1)
+	assertTarget(t, target, &list[0])
+	// an update without the expiry makes the target permanent
+	target.ExpiresAt = nil
+	require.NoError(t, s.Update(context.Background(), target))
+	got = db.NewTarget()
+	got.ID = target.ID
+	require.NoError(t, s.Get(context.Background(), got))
+	assertTarget(t, target, got)
+}
+
+// testImport keeps the ID and revision of the target, storages which aren't a db.Importer skip it.
+func testImport(t *testing.T, s db.Storage) {
+	importer, ok := s.(db.Importer)
+	if !ok {
+		t.Skip("storage isn't a db.Importer")
+	}
+	target := newTarget("test")
+	target.ID = "other"
+	target.Revision = 7
+	require.NoError(t, importer.Import(context.Background(), target))
+	assert.Equal(t, db.ID("other"), target.ID)
+	got := db.NewTarget()
+	got.ID = target.ID
+	require.NoError(t, s.Get(context.Background(), got))
+	assertTarget(t, target, got)
+	err := s.Get(context.Background(), &db.Target{ID: "test"})
+	assert.True(t, isNotFound(err), "want NotFoundError, got %v", err)
+
+	// the imported revision is the one updates compare with
+	require.NoError(t, s.Update(context.Background(), target))
+	assert.Equal(t, int64(8), target.Revision)
+	// the ID conflicts, not the name
+	other := newTarget("test")
+	other.ID = "other"
+	err = importer.Import(context.Background(), other)
+	assert.True(t, isConflict(err), "want ConflictError, got %v", err)
+}
+
+func testDeleteRemoves(t *testing.T, s db.Storage) {
+	require.NoError(t, s.Create(context.Background(), newTarget("test")))
+	require.NoError(t, s.Delete(context.Background(), &db.Target{ID: "test"}))
+	err := s.Get(context.Background(), &db.Target{ID: "test"})
+	assert.True(t, isNotFound(err), "want NotFoundError, got %v", err)
+}
+
+func testDeleteMissing(t *testing.T, s db.Storage) {
+	err := s.Delete(context.Background(), &db.Target{ID: "test"})
+	assert.True(t, isNotFound(err), "want NotFoundError, got %v", err)
+}
+
+func testGetAllEmpty(t *testing.T, s db.Storage) {
+	list := []db.Target{}
+	require.NoError(t, s.GetAll(context.Background(), &db.ListQuery{}, &list))
+	assert.Empty(t, list)
+}
+
+func testGetAll(t *testing.T, s db.Storage) {
+	want := []*db.Target{newTarget("test"), newTarget("test1"), newTarget("test2")}
+	for _, target := range want {
+		require.NoError(t, s.Create(context.Background(), target))
+	}
+	require.NoError(t, s.Delete(context.Background(), &db.Target{ID: "test1"}))
+	want = append(want[:1], want[2:]...)
+
+	list := []db.Target{}
+	require.NoError(t, s.GetAll(context.Background(), &db.ListQuery{}, &list))
+	require.Len(t, list, len(want))
+	for i := range want {
+		assertTarget(t, want[i], &list[i])
+	}
+}
+
+func ids(list []db.Target) []db.ID {
+	result := make([]db.ID, 0, len(list))
+	for _, target := range list {
+		result = append(result, target.ID)
+	}
+	return result
+}
+
+func createAll(t *testing.T, s db.Storage, targets ...*db.Target) {
+	for _, target := range targets {
+		require.NoError(t, s.Create(context.Background(), target))
+	}
+}
+
+func testGetAllNamePrefix(t *testing.T, s db.Storage) {
+	renamedFrom, renamedTo := newTarget("web-3"), newTarget("api")
+	createAll(t, s, newTarget("web-2"), newTarget("db-1"), newTarget("web-1"), newTarget("we"), renamedFrom, renamedTo)
+	// the prefix is matched by the name, which may differ from the ID after a rename
+	renamedFrom.Name = "db-2"
+	require.NoError(t, s.Update(context.Background(), renamedFrom))
+	renamedTo.Name = "web-4"
+	require.NoError(t, s.Update(context.Background(), renamedTo))
+	list := []db.Target{}
+	require.NoError(t, s.GetAll(context.Background(), &db.ListQuery{NamePrefix: "web-"}, &list))
+	// targets are sorted by the name as well
+	assert.Equal(t, []db.ID{"web-1", "web-2", "api"}, ids(list))
+}
+
+func testGetAllLabels(t *testing.T, s db.Storage) {
+	split := newTarget("split")
+	split.Entries[0].Labels = map[string]string{"env": "prod"}
+	split.Entries = append(split.Entries, db.Entry{Targets: []string{"127.0.0.1:9100"}, Labels: map[string]string{"team": "sre"}})
+	both := newTarget("both")
+	both.Entries[0].Labels = map[string]string{"env": "prod", "team": "sre"}
+	createAll(t, s, split, both, newTarget("other"))
+
+	list := []db.Target{}
+	require.NoError(t, s.GetAll(context.Background(), &db.ListQuery{Labels: map[string]string{"env": "prod"}}, &list))
+	assert.Equal(t, []db.ID{"both", "split"}, ids(list))
+	// all labels have to be matched by the same entry
+	require.NoError(t, s.GetAll(context.Background(), &db.ListQuery{Labels: map[string]string{"env": "prod", "team": "sre"}}, &list))
+	assert.Equal(t, []db.ID{"both"}, ids(list))
+}
+
+func testGetAllSortByTime(t *testing.T, s db.Storage) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	first, second, third := newTarget("c"), newTarget("a"), newTarget("b")
+	first.Time, second.Time, third.Time = now, now.Add(time.Second), now.Add(time.Second)
+	createAll(t, s, third, first, second)
+	list := []db.Target{}
+	require.NoError(t, s.GetAll(context.Background(), &db.ListQuery{SortBy: db.SortByTime}, &list))
+	// ties are broken by ID
+	assert.Equal(t, []db.ID{"c", "a", "b"}, ids(list))
+}
+
+func testGetAllPages(t *testing.T, s db.Storage) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	names := []string{"e", "b", "d", "a", "c"}
+	for i, name := range names {
+		target := newTarget(name)
+		target.Time = now.Add(time.Duration(i) * time.Second)
+		createAll(t, s, target)
+	}
+	tests := []struct {
+		sortBy db.SortField
+		want   []db.ID
+	}{
+		{sortBy: db.SortByName, want: []db.ID{"a", "b", "c", "d", "e"}},
+		{sortBy: db.SortByTime, want: []db.ID{"e", "b", "d", "a", "c"}},
+	}
+	for _, tt := range tests {
+		query := &db.ListQuery{SortBy: tt.sortBy, Limit: 2}
+		got := []db.ID{}
+		for i := 0; i < len(names); i++ {
+			list := []db.Target{}
+			require.NoError(t, s.GetAll(context.Background(), query, &list))
+			require.LessOrEqual(t, len(list), query.Limit)
+			if len(list) == 0 {
+				break
+			}
+			got = append(got, ids(list)...)
+			query.After = db.NewCursor(&list[len(list)-1])
+		}
+		assert.Equal(t, tt.want, got, "sorted by %s", tt.sortBy)
+	}
+}
+
+// testGetAllRenamed sorts renamed targets by their new name, they keep their IDs.
+func testGetAllRenamed(t *testing.T, s db.Storage) {
+	for _, name := range []string{"a", "b", "c", "d"} {
+		createAll(t, s, newTarget(name))
+	}
+	for id, name := range map[db.ID]string{"a": "z", "d": "b"} {
+		target := db.NewTarget()
+		target.ID = id
+		require.NoError(t, s.Get(context.Background(), target))
+		target.Name = name
+		require.NoError(t, s.Update(context.Background(), target))
+	}
+	query := &db.ListQuery{Limit: 2}
+	got := []db.ID{}
+	for i := 0; i < 4; i++ {
+		list := []db.Target{}
+		require.NoError(t, s.GetAll(context.Background(), query, &list))
+		require.LessOrEqual(t, len(list), query.Limit)
+		if len(list) == 0 {
+			break
+		}
+		got = append(got, ids(list)...)
+		query.After = db.NewCursor(&list[len(list)-1])
+	}
+	// ties of names are broken by ID
+	assert.Equal(t, []db.ID{"b", "d", "c", "a"}, got)
+}
+
+// RunAudit checks that audit records are kept apart from targets and that their time range is applied,
+// newStorage should return a db.AuditStore.
+func RunAudit(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	store, ok := s.(db.AuditStore)
+	require.True(t, ok, "storage isn't a db.AuditStore")
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	records := []db.AuditRecord{
+		{Time: start.Add(2 * time.Minute), Actor: "carol", SourceIP: "10.0.0.3", Action: db.ActionDelete, Target: "b", Added: []db.Entry{}, Removed: []db.Entry{}, Code: 200},
+		{Time: start, Actor: "alice", SourceIP: "10.0.0.1", Action: db.ActionCreate, Target: "a", Added: []db.Entry{{Targets: []string{"a:9100"}, Labels: map[string]string{"env": "prod"}}}, Removed: []db.Entry{}, Code: 200},
+		{Time: start.Add(time.Minute), Actor: "bob", SourceIP: "10.0.0.2", Action: db.ActionUpdate, Target: "b", Added: []db.Entry{}, Removed: []db.Entry{}, Code: 412},
+		// records of the same time are both kept
+		{Time: start.Add(time.Minute), Actor: "alice", SourceIP: "10.0.0.1", Action: db.ActionDelete, Target: "a", Added: []db.Entry{}, Removed: []db.Entry{}, Code: 404},
+	}
+	for i := range records {
+		require.NoError(t, store.WriteAudit(context.Background(), &records[i]))
+	}
+	list := []db.Target{}
+	require.NoError(t, s.GetAll(context.Background(), &db.ListQuery{}, &list))
+	assert.Empty(t, list, "audit records are listed as targets")
+
+	tests := []struct {
+		name  string
+		query db.AuditQuery
+		want  []db.AuditRecord
+	}{
+		{name: "all", query: db.AuditQuery{}, want: records},
+		{name: "from", query: db.AuditQuery{From: start.Add(time.Second)}, want: []db.AuditRecord{records[0], records[2], records[3]}},
+		{name: "to", query: db.AuditQuery{To: start.Add(time.Minute)}, want: records[1:]},
+		{name: "range", query: db.AuditQuery{From: start.Add(time.Minute), To: start.Add(time.Minute)}, want: records[2:]},
+		{name: "none", query: db.AuditQuery{From: start.Add(time.Hour)}, want: []db.AuditRecord{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []db.AuditRecord{}
+			require.NoError(t, store.QueryAudit(context.Background(), &tt.query, &got))
+			require.Len(t, got, len(tt.want))
+			for i := range got {
+				if i > 0 {
+					assert.False(t, got[i].Time.Before(got[i-1].Time), "records aren't oldest first")
+				}
+				got[i].Time = got[i].Time.UTC()
+			}
+			assert.ElementsMatch(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// DefaultRetention is how long deleted targets are kept in the trash.
+const DefaultRetention = 7 * 24 * time.Hour
+
+// WithTrash makes Delete move targets into trash, another storage of any kind,
+// where they are kept for retention. Time of a target in the trash is the time it was deleted.
+func WithTrash(trash Storage, retention time.Duration) Option {
+	return func(s *Service) {
+		s.trash = trash
+		s.retention = retention
+	}
+}
+
+var errTrashDisabled = &ValidationError{Text: "Trash is disabled"}
+
+// moveToTrash keeps the target in the trash with its ID before it is deleted from the storage,
+// a target deleted before with the same ID is replaced.
+func (s *Service) moveToTrash(ctx context.Context, target *Target) error {
+	deleted := target.clone()
+	deleted.Time = time.Now()
+	// storages with a TTL index would delete the target from the trash once it expires
+	deleted.ExpiresAt = nil
+	err := Import(ctx, s.trash, deleted)
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		if err = s.trash.Delete(ctx, &Target{ID: target.ID}); err == nil {
+			err = Import(ctx, s.trash, deleted)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.storage.Delete(ctx, target); err != nil {
+		if err := s.trash.Delete(ctx, deleted); err != nil {
+			log.Println("(Trash) Failed to take back the target:", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Deleted returns targets in the trash, the most recently deleted last.
+func (s *Service) Deleted(ctx context.Context, list *[]Target) error {
+	if s.trash == nil {
+		return errTrashDisabled
+	}
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return contextError(ctx, s.trash.GetAll(ctx, &ListQuery{SortBy: SortByTime}, list))
+}
+
+// Restore creates the deleted target again with its ID and takes it out of the trash,
+// it fails with ErrConflict if a target with the same ID has been created since.
+func (s *Service) Restore(ctx context.Context, target *Target) error {
+	if target.ID == nilID {
+		return ErrValidation
+	}
+	if s.trash == nil {
+		return errTrashDisabled
+	}
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	if err := s.trash.Get(ctx, target); err != nil {
+		return contextError(ctx, err)
+	}
+	// the trash keeps no expiry, a target moved there by older versions may have expired,
+	// restoring makes the target permanent
+	target.ExpiresAt = nil
+	if err := s.recreate(ctx, target, target.Revision); err != nil {
+		return err
+	}
+	return contextError(ctx, s.trash.Delete(ctx, &Target{ID: target.ID}))
+}
+
+// Purge removes the target from the trash for good.
+func (s *Service) Purge(ctx context.Context, id ID) error {
+	if id == nilID {
+		return ErrValidation
+	}
+	if s.trash == nil {
+		return errTrashDisabled
+	}
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return contextError(ctx, s.trash.Delete(ctx, &Target{ID: id}))
+}
+
+// PurgeBefore removes targets deleted before the time, it returns how many were removed.
+func (s *Service) PurgeBefore(ctx context.Context, before time.Time) (int, error) {
+	if s.trash == nil {
+		return 0, errTrashDisabled
+	}
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	deleted := []Target{}
+	if err := s.trash.GetAll(ctx, &ListQuery{SortBy: SortByTime}, &deleted); err != nil {
+		return 0, contextError(ctx, err)
+	}
+	purged := 0
+	for i := range deleted {
+		if !deleted[i].Time.Before(before) {
+			break
+		}
+		err := s.trash.Delete(ctx, &deleted[i])
+		var notFound *NotFoundError
+		if err != nil && !errors.As(err, &notFound) {
+			return purged, contextError(ctx, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// PurgeExpired removes targets which have been in the trash longer than the retention.
+func (s *Service) PurgeExpired(ctx context.Context) (int, error) {
+	return s.PurgeBefore(ctx, time.Now().Add(-s.retention))
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTrashService() (*Service, *mapStorage) {
+	trash := &mapStorage{targets: map[ID]Target{}}
+	s := &Service{storage: &mapStorage{targets: map[ID]Target{}}}
+	WithTrash(trash, time.Hour)(s)
+	return s, trash
+}
+
+func TestService_DeleteMovesToTrash(t *testing.T) {
+	s, trash := newTrashService()
+	require.NoError(t, s.Create(context.Background(), historyTarget("a:9100")))
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+
+	err := s.Get(context.Background(), &Target{ID: "test"})
+	assert.IsType(t, &NotFoundError{}, err)
+	deleted := []Target{}
+	require.NoError(t, s.Deleted(context.Background(), &deleted))
+	require.Len(t, deleted, 1)
+	assert.Equal(t, []string{"a:9100"}, deleted[0].Entries[0].Targets)
+
+	// the target deleted again replaces the one in the trash
+	require.NoError(t, s.Create(context.Background(), historyTarget("b:9100")))
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+	assert.Equal(t, []string{"b:9100"}, trash.targets["test"].Entries[0].Targets)
+}
+
+func TestService_Restore(t *testing.T) {
+	s, trash := newTrashService()
+	require.NoError(t, s.Create(context.Background(), historyTarget("a:9100")))
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+
+	target := &Target{ID: "test"}
+	require.NoError(t, s.Restore(context.Background(), target))
+	// the delete took revision 2
+	assert.Equal(t, int64(3), target.Revision)
+	require.NoError(t, s.Get(context.Background(), &Target{ID: "test"}))
+	assert.Empty(t, trash.targets)
+
+	err := s.Restore(context.Background(), &Target{ID: "test"})
+	assert.IsType(t, &NotFoundError{}, err)
+
+	// a target with the same ID has been created since
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+	require.NoError(t, s.Create(context.Background(), historyTarget("b:9100")))
+	err = s.Restore(context.Background(), &Target{ID: "test"})
+	assert.IsType(t, &ConflictError{}, err)
+	assert.Len(t, trash.targets, 1)
+}
+
+func TestService_TrashKeepsID(t *testing.T) {
+	s, trash := newTrashService()
+	storage := s.storage.(*mapStorage)
+	// e.g. a target migrated from a storage which named it differently
+	storage.targets["legacy"] = Target{ID: "legacy", Name: "test", Revision: 4, Entries: historyTarget("a:9100").Entries}
+
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "legacy"}))
+	assert.Contains(t, trash.targets, ID("legacy"))
+	target := &Target{ID: "legacy"}
+	require.NoError(t, s.Restore(context.Background(), target))
+	assert.Equal(t, ID("legacy"), target.ID)
+	require.NoError(t, s.Get(context.Background(), &Target{ID: "legacy"}))
+	assert.NotContains(t, storage.targets, ID("test"))
+	assert.Empty(t, trash.targets)
+}
+
+func TestService_Purge(t *testing.T) {
+	s, trash := newTrashService()
+	now := time.Now()
+	trash.targets["old"] = Target{ID: "old", Time: now.Add(-2 * time.Hour)}
+	trash.targets["older"] = Target{ID: "older", Time: now.Add(-3 * time.Hour)}
+	trash.targets["new"] = Target{ID: "new", Time: now}
+
+	purged, err := s.PurgeExpired(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+	assert.Contains(t, trash.targets, ID("new"))
+
+	require.NoError(t, s.Purge(context.Background(), "new"))
+	assert.Empty(t, trash.targets)
+	err = s.Purge(context.Background(), "new")
+	assert.IsType(t, &NotFoundError{}, err)
+}
+
+func TestService_TrashDisabled(t *testing.T) {
+	s := &Service{storage: &mapStorage{targets: map[ID]Target{}}}
+	require.NoError(t, s.Create(context.Background(), historyTarget("a:9100")))
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+	err := s.Restore(context.Background(), &Target{ID: "test"})
+	assert.IsType(t, &ValidationError{}, err)
+	_, err = s.PurgeExpired(context.Background())
+	assert.IsType(t, &ValidationError{}, err)
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	subscriberBuffer = 100
+	// backlogSize is how many of the latest events are kept for subscribers which resume.
+	backlogSize = 1000
+	// seenRetention is how long a deleted target is remembered to tell its delete seen again.
+	seenRetention = 10 * time.Minute
+)
+
+// Event tells that a target was created, updated or deleted,
+// Target of a deleted target may hold only its ID.
+// Seq numbers events published by the service, it starts over when the service restarts.
+type Event struct {
+	Seq    uint64 `json:"seq"`
+	Action Action `json:"action"`
+	Target Target `json:"target"`
+}
+
+// Watcher is implemented by storages which tell about changes themselves, including changes
+// made by other replicas. Watch sends events until ctx is done or the change feed fails.
+type Watcher interface {
+	Watch(ctx context.Context, events chan<- Event) error
+}
+
+// Changes returns events which turn the before state of a storage into the after one,
+// it serves watchers which can only read all targets.
+func Changes(before, after map[ID]Target) []Event {
+	events := []Event{}
+	for id, target := range after {
+		previous, ok := before[id]
+		switch {
+		case !ok:
+			events = append(events, Event{Action: ActionCreate, Target: target})
+		case previous.Revision != target.Revision || !previous.Time.Equal(target.Time):
+			events = append(events, Event{Action: ActionUpdate, Target: target})
+		}
+	}
+	for id, target := range before {
+		if _, ok := after[id]; !ok {
+			events = append(events, Event{Action: ActionDelete, Target: target})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Target.ID < events[j].Target.ID
+	})
+	return events
+}
+
+// Poll watches any storage by reading all of its targets every interval,
+// a failed read is retried on the next tick.
+func Poll(ctx context.Context, storage Storage, interval time.Duration, events chan<- Event) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var before map[ID]Target
+	for {
+		list := []Target{}
+		if err := storage.GetAll(ctx, &ListQuery{}, &list); err != nil {
+			log.Println("(Watch) Failed to read targets:", err)
+		} else {
+			after := make(map[ID]Target, len(list))
+			for _, target := range list {
+				after[target.ID] = target
+			}
+			// the first read is the state changes are compared to
+			if before != nil {
+				for _, event := range Changes(before, after) {
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			}
+			before = after
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// seenTarget is the last change of a target, deletedAt is set when it was a delete.
+type seenTarget struct {
+	time      time.Time
+	deletedAt time.Time
+}
+
+// eventHub passes events to subscribers, a change seen both as a local write and
+// in the change feed of the storage is passed once. Deleted targets are forgotten
+// after seenRetention, so seen holds only the live targets and the recently deleted ones.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	seen        map[ID]seenTarget
+	pruned      time.Time
+	seq         uint64
+	backlog     []Event
+}
+
+// subscribe sends the kept events published after the after one first, zero sends none.
+func (h *eventHub) subscribe(after uint64) chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers == nil {
+		h.subscribers = map[chan Event]struct{}{}
+	}
+	missed := []Event{}
+	if after > 0 {
+		for _, event := range h.backlog {
+			if event.Seq > after {
+				missed = append(missed, event)
+			}
+		}
+	}
+	events := make(chan Event, subscriberBuffer+len(missed))
+	for _, event := range missed {
+		events <- Event{Seq: event.Seq, Action: event.Action, Target: *event.Target.clone()}
+	}
+	h.subscribers[events] = struct{}{}
+	return events
+}
+
+func (h *eventHub) unsubscribe(events chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, events)
+	close(events)
+}
+
+// known reports whether the event has been published already. Every write sets the time
+// of the target, so a target which isn't newer than the last one seen is a known one.
+func (h *eventHub) known(event *Event) bool {
+	if h.seen == nil {
+		h.seen = map[ID]seenTarget{}
+	}
+	last, ok := h.seen[event.Target.ID]
+	if event.Action == ActionDelete {
+		now := time.Now()
+		h.prune(now)
+		h.seen[event.Target.ID] = seenTarget{time: last.time, deletedAt: now}
+		return ok && !last.deletedAt.IsZero()
+	}
+	if ok && !event.Target.Time.After(last.time) {
+		return true
+	}
+	h.seen[event.Target.ID] = seenTarget{time: event.Target.Time}
+	return false
+}
+
+// prune forgets targets deleted longer than seenRetention ago, at most once in seenRetention.
+func (h *eventHub) prune(now time.Time) {
+	if now.Sub(h.pruned) < seenRetention {
+		return
+	}
+	h.pruned = now
+	for id, last := range h.seen {
+		if !last.deletedAt.IsZero() && now.Sub(last.deletedAt) > seenRetention {
+			delete(h.seen, id)
+		}
+	}
+}
+
+// publish never blocks, a subscriber which doesn't keep up misses events.
+func (h *eventHub) publish(event Event) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.known(&event) {
+		return false
+	}
+	h.seq++
+	event.Seq = h.seq
+	h.backlog = append(h.backlog, event)
+	if len(h.backlog) > backlogSize {
+		h.backlog = h.backlog[len(h.backlog)-backlogSize:]
+	}
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber <- Event{Seq: event.Seq, Action: event.Action, Target: *event.Target.clone()}:
+		default:
+			log.Println("(Watch) Subscriber is too slow, event is dropped:", event.Target.ID)
+		}
+	}
+	return true
+}
+
+// Subscribe returns events of every change of targets until ctx is done, then the channel is closed.
+// Changes made through the service are sent at once, other changes are sent while Watch runs.
+// Recent events published after the after one are sent first, so that a subscriber can resume.
+func (s *Service) Subscribe(ctx context.Context, after uint64) <-chan Event {
+	events := s.events.subscribe(after)
+	go func() {
+		<-ctx.Done()
+		s.events.unsubscribe(events)
+	}()
+	return events
+}
+
+func (s *Service) publish(action Action, target *Target) {
+	s.events.publish(Event{Action: action, Target: *target.clone()})
+}
+
+var errNotWatchable = errors.New("storage can't be watched")
+
+// Watch follows changes of the storage until ctx is done, they invalidate the cache,
+// update the snapshots and are sent to subscribers. Storages which aren't Watchers, or whose change feed fails,
+// are polled every interval, zero interval disables polling.
+func (s *Service) Watch(ctx context.Context, interval time.Duration) error {
+	feed := make(chan Event)
+	done := make(chan error, 1)
+	watch := func(watcher func(context.Context, chan<- Event) error) {
+		done <- watcher(ctx, feed)
+	}
+	if watcher, ok := s.storage.(Watcher); ok {
+		go watch(watcher.Watch)
+	} else {
+		done <- errNotWatchable
+	}
+	for {
+		select {
+		case event := <-feed:
+			s.invalidate(event.Target.ID)
+			if s.snapshots != nil {
+				s.snapshots.follow(&event)
+			}
+			s.events.publish(event)
+		case err := <-done:
+			if ctx.Err() != nil {
+				return nil
+			}
+			if interval <= 0 {
+				return err
+			}
+			log.Println("(Watch) Storage is polled for changes:", err)
+			go watch(func(ctx context.Context, events chan<- Event) error {
+				return Poll(ctx, s.storage, interval, events)
+			})
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChanges(t *testing.T) {
+	now := time.Now()
+	before := map[ID]Target{
+		"kept":    {ID: "kept", Revision: 1, Time: now},
+		"updated": {ID: "updated", Revision: 1, Time: now},
+		"deleted": {ID: "deleted", Revision: 1, Time: now},
+	}
+	after := map[ID]Target{
+		"kept":    {ID: "kept", Revision: 1, Time: now},
+		"updated": {ID: "updated", Revision: 2, Time: now.Add(time.Second)},
+		"created": {ID: "created", Revision: 1, Time: now},
+	}
+	events := Changes(before, after)
+	require.Len(t, events, 3)
+	assert.Equal(t, Event{Action: ActionCreate, Target: after["created"]}, events[0])
+	assert.Equal(t, Event{Action: ActionDelete, Target: before["deleted"]}, events[1])
+	assert.Equal(t, Event{Action: ActionUpdate, Target: after["updated"]}, events[2])
+	assert.Empty(t, Changes(after, after))
+}
+
+// stateStorage lists the given states one after another, then the last one.
+type stateStorage struct {
+	testStorage
+	mu     sync.Mutex
+	states [][]Target
+}
+
+func (s *stateStorage) GetAll(_ context.Context, _ *ListQuery, list *[]Target) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*list = s.states[0]
+	if len(s.states) > 1 {
+		s.states = s.states[1:]
+	}
+	return nil
+}
+
+func receive(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event was received")
+		return Event{}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	storage := &stateStorage{states: [][]Target{
+		{{ID: "a", Revision: 1}},
+		{{ID: "a", Revision: 2}},
+		{},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan Event)
+	done := make(chan error)
+	go func() { done <- Poll(ctx, storage, time.Millisecond, events) }()
+
+	assert.Equal(t, Event{Action: ActionUpdate, Target: Target{ID: "a", Revision: 2}}, receive(t, events))
+	assert.Equal(t, Event{Action: ActionDelete, Target: Target{ID: "a", Revision: 2}}, receive(t, events))
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestService_Subscribe(t *testing.T) {
+	s := newHistoryService(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := s.Subscribe(ctx, 0)
+
+	require.NoError(t, s.Create(context.Background(), historyTarget("a:9100")))
+	update := historyTarget("b:9100")
+	update.ID, update.Revision = "test", FirstRevision
+	require.NoError(t, s.Update(context.Background(), update))
+	require.NoError(t, s.Delete(context.Background(), &Target{ID: "test"}))
+
+	actions := []Action{}
+	for i := 0; i < 3; i++ {
+		event := receive(t, events)
+		assert.Equal(t, ID("test"), event.Target.ID)
+		actions = append(actions, event.Action)
+	}
+	assert.Equal(t, []Action{ActionCreate, ActionUpdate, ActionDelete}, actions)
+
+	// changes seen in the change feed after the local write aren't sent again
+	assert.False(t, s.events.publish(Event{Action: ActionUpdate, Target: Target{ID: "test", Revision: 2, Time: update.Time}}))
+	assert.False(t, s.events.publish(Event{Action: ActionDelete, Target: Target{ID: "test"}}))
+	// the target is created again
+	assert.True(t, s.events.publish(Event{Action: ActionCreate, Target: Target{ID: "test", Revision: 1, Time: time.Now()}}))
+	receive(t, events)
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestEventHub_forgetsDeleted(t *testing.T) {
+	h := &eventHub{}
+	now := time.Now()
+	h.publish(Event{Action: ActionCreate, Target: Target{ID: "live", Time: now}})
+	h.publish(Event{Action: ActionDelete, Target: Target{ID: "recent"}})
+	h.seen["old"] = seenTarget{time: now.Add(-time.Hour), deletedAt: now.Add(-2 * seenRetention)}
+	h.pruned = time.Time{}
+
+	h.publish(Event{Action: ActionDelete, Target: Target{ID: "other"}})
+	assert.NotContains(t, h.seen, ID("old"))
+	assert.Contains(t, h.seen, ID("recent"))
+	assert.Contains(t, h.seen, ID("live"))
+	// a recent delete seen again is still known
+	assert.False(t, h.publish(Event{Action: ActionDelete, Target: Target{ID: "recent"}}))
+}
+
+// feedStorage is a Watcher which passes events of feed, it fails once feed is closed.
+type feedStorage struct {
+	mapStorage
+	feed chan Event
+}
+
+func (s *feedStorage) Watch(ctx context.Context, events chan<- Event) error {
+	for event := range s.feed {
+		events <- event
+	}
+	return errors.New("change feed is closed")
+}
+
+func TestService_Watch(t *testing.T) {
+	storage := &feedStorage{mapStorage: mapStorage{targets: map[ID]Target{}}, feed: make(chan Event)}
+	s := &Service{storage: storage}
+	WithCache(time.Minute)(s)
+	WithSnapshots("", 0)(s)
+	s.cache.set(&Target{ID: "test", Revision: 1})
+	s.snapshots.set(&Target{ID: "test", Revision: 1})
+	s.snapshots.set(&Target{ID: "deleted", Revision: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	events := s.Subscribe(ctx, 0)
+	done := make(chan error)
+	go func() { done <- s.Watch(ctx, 0) }()
+
+	storage.feed <- Event{Action: ActionUpdate, Target: Target{ID: "test", Revision: 2, Time: time.Now()}}
+	assert.Equal(t, int64(2), receive(t, events).Target.Revision)
+	assert.False(t, s.cache.get(&Target{ID: "test"}))
+	storage.feed <- Event{Action: ActionDelete, Target: Target{ID: "deleted"}}
+	receive(t, events)
+	// snapshots follow the changes of other replicas
+	snapshot := &Target{ID: "test"}
+	assert.True(t, s.snapshots.get(snapshot))
+	assert.Equal(t, int64(2), snapshot.Revision)
+	assert.False(t, s.snapshots.get(&Target{ID: "deleted"}))
+
+	// without polling the failure of the feed ends watching
+	close(storage.feed)
+	assert.Error(t, <-done)
+	cancel()
+}
+
+func TestService_WatchPolls(t *testing.T) {
+	storage := &stateStorage{states: [][]Target{
+		{},
+		{{ID: "a", Revision: 1, Time: time.Now()}},
+	}}
+	s := &Service{storage: storage}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := s.Subscribe(ctx, 0)
+	done := make(chan error)
+	go func() { done <- s.Watch(ctx, time.Millisecond) }()
+
+	event := receive(t, events)
+	assert.Equal(t, ActionCreate, event.Action)
+	assert.Equal(t, ID("a"), event.Target.ID)
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestService_SubscribeResumes(t *testing.T) {
+	s := &Service{}
+	for i := 1; i <= 3; i++ {
+		s.events.publish(Event{Action: ActionUpdate, Target: Target{ID: "test", Revision: int64(i), Time: time.Now().Add(time.Duration(i) * time.Second)}})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := s.Subscribe(ctx, 1)
+	assert.Equal(t, uint64(2), receive(t, events).Seq)
+	assert.Equal(t, uint64(3), receive(t, events).Seq)
+
+	// new subscribers get only new events
+	events = s.Subscribe(ctx, 0)
+	s.events.publish(Event{Action: ActionDelete, Target: Target{ID: "test"}})
+	event := receive(t, events)
+	assert.Equal(t, uint64(4), event.Seq)
+	assert.Equal(t, ActionDelete, event.Action)
+}
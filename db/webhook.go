@@ -0,0 +1,284 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookQueueSize = 1000
+	webhookAttempts  = 5
+	webhookBackoff   = time.Second
+	webhookTimeout   = 10 * time.Second
+	// deliveryLogSize is how many of the latest deliveries are kept.
+	deliveryLogSize = 1000
+
+	SignatureHeader = "X-Promhsd-Signature"
+	EventHeader     = "X-Promhsd-Event"
+	DeliveryHeader  = "X-Promhsd-Delivery"
+)
+
+// Webhook is a URL changes are posted to, Actions limit the changes, none means all of them.
+type Webhook struct {
+	URL     string
+	Actions []Action
+}
+
+func (w *Webhook) wants(action Action) bool {
+	if len(w.Actions) == 0 {
+		return true
+	}
+	for _, a := range w.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseWebhooks reads whitespace separated URLs, actions a webhook wants are given in the fragment,
+// e.g. "https://hooks.example.com/promhsd#create,delete". The fragment isn't sent.
+func ParseWebhooks(spec string) ([]Webhook, error) {
+	hooks := []Webhook{}
+	for _, field := range strings.Fields(spec) {
+		u, err := url.Parse(field)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, &ValidationError{Text: fmt.Sprintf("webhook %q should be an http(s) URL", field)}
+		}
+		hook := Webhook{}
+		if u.Fragment != "" {
+			for _, action := range strings.Split(u.Fragment, ",") {
+				switch Action(action) {
+				case ActionCreate, ActionUpdate, ActionDelete:
+					hook.Actions = append(hook.Actions, Action(action))
+				default:
+					return nil, &ValidationError{Text: fmt.Sprintf("webhook action %q should be create, update or delete", action)}
+				}
+			}
+		}
+		u.Fragment = ""
+		hook.URL = u.String()
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// WebhookPayload is posted to webhooks, entries are empty before a target is created and after it is deleted.
+type WebhookPayload struct {
+	Action     Action    `json:"action"`
+	ID         ID        `json:"id"`
+	Name       string    `json:"name"`
+	OldEntries []Entry   `json:"old_entries"`
+	NewEntries []Entry   `json:"new_entries"`
+	Actor      string    `json:"actor"`
+	Time       time.Time `json:"time"`
+}
+
+// Delivery is the outcome of posting a change to a webhook. Webhook holds only the scheme and the host,
+// paths of chat webhooks are secrets.
+type Delivery struct {
+	ID        uint64    `json:"id"`
+	Webhook   string    `json:"webhook"`
+	Action    Action    `json:"action"`
+	Target    ID        `json:"target"`
+	Attempts  int       `json:"attempts"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Delivered bool      `json:"delivered"`
+	Time      time.Time `json:"time"`
+}
+
+type delivery struct {
+	id      uint64
+	payload WebhookPayload
+}
+
+type webhookQueue struct {
+	hook  Webhook
+	name  string
+	queue chan delivery
+}
+
+// Webhooks posts changes to every webhook in the background, a delivery which fails is retried
+// with a growing backoff. Payloads are signed with HMAC-SHA256 of the secret when it is given.
+type Webhooks struct {
+	hooks      []*webhookQueue
+	secret     []byte
+	client     *http.Client
+	attempts   int
+	backoff    time.Duration
+	mu         sync.Mutex
+	seq        uint64
+	deliveries []Delivery
+	// pending counts the queued deliveries, tests wait for them
+	pending sync.WaitGroup
+}
+
+func NewWebhooks(hooks []Webhook, secret string) *Webhooks {
+	w := &Webhooks{
+		secret:   []byte(secret),
+		client:   &http.Client{Timeout: webhookTimeout},
+		attempts: webhookAttempts,
+		backoff:  webhookBackoff,
+	}
+	for _, hook := range hooks {
+		q := &webhookQueue{hook: hook, name: hook.URL, queue: make(chan delivery, webhookQueueSize)}
+		if u, err := url.Parse(hook.URL); err == nil {
+			q.name = u.Scheme + "://" + u.Host
+		}
+		w.hooks = append(w.hooks, q)
+		go w.run(q)
+	}
+	return w
+}
+
+// WithWebhooks posts every change made through the service to the webhooks.
+func WithWebhooks(webhooks *Webhooks) Option {
+	return func(s *Service) {
+		s.webhooks = webhooks
+	}
+}
+
+func (w *Webhooks) run(q *webhookQueue) {
+	for d := range q.queue {
+		w.log(w.deliver(q, d))
+		w.pending.Done()
+	}
+}
+
+// Sign returns the signature header value of the body.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post reports whether a failed delivery is worth another attempt.
+func (w *Webhooks) post(q *webhookQueue, d delivery, body []byte, result *Delivery) bool {
+	req, err := http.NewRequest(http.MethodPost, q.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(d.payload.Action))
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(d.id, 10))
+	if len(w.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(w.secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		result.Status, result.Error = 0, err.Error()
+		return true
+	}
+	resp.Body.Close()
+	result.Status = resp.StatusCode
+	if resp.StatusCode < 300 {
+		result.Delivered, result.Error = true, ""
+		return false
+	}
+	result.Error = resp.Status
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+func (w *Webhooks) deliver(q *webhookQueue, d delivery) Delivery {
+	result := Delivery{ID: d.id, Webhook: q.name, Action: d.payload.Action, Target: d.payload.ID}
+	body, err := json.Marshal(d.payload)
+	if err != nil {
+		result.Error, result.Time = err.Error(), time.Now()
+		return result
+	}
+	backoff := w.backoff
+	for {
+		result.Attempts++
+		retry := w.post(q, d, body, &result)
+		result.Time = time.Now()
+		if !retry || result.Attempts == w.attempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if !result.Delivered {
+		log.Printf("(Webhook) Failed to deliver %s of %s to %s: %s\n", result.Action, result.Target, result.Webhook, result.Error)
+	}
+	return result
+}
+
+func (w *Webhooks) log(result Delivery) {
+	outcome := "delivered"
+	if !result.Delivered {
+		outcome = "failed"
+	}
+	webhookDeliveries.WithLabelValues(outcome).Inc()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.deliveries = append(w.deliveries, result)
+	if len(w.deliveries) > deliveryLogSize {
+		w.deliveries = w.deliveries[len(w.deliveries)-deliveryLogSize:]
+	}
+}
+
+// notify queues the change for webhooks which want it, it is dropped if a webhook is too far behind.
+func (w *Webhooks) notify(payload WebhookPayload) {
+	for _, q := range w.hooks {
+		if !q.hook.wants(payload.Action) {
+			continue
+		}
+		w.mu.Lock()
+		w.seq++
+		d := delivery{id: w.seq, payload: payload}
+		w.mu.Unlock()
+		w.pending.Add(1)
+		select {
+		case q.queue <- d:
+		default:
+			w.pending.Done()
+			w.log(Delivery{ID: d.id, Webhook: q.name, Action: payload.Action, Target: payload.ID, Error: "queue is full", Time: time.Now()})
+		}
+	}
+}
+
+// Deliveries returns the latest deliveries, oldest first.
+func (w *Webhooks) Deliveries() []Delivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Delivery{}, w.deliveries...)
+}
+
+// notify posts the change to the webhooks, old is nil for created targets and target is nil for deleted ones.
+func (s *Service) notify(ctx context.Context, action Action, old, target *Target) {
+	if s.webhooks == nil {
+		return
+	}
+	payload := WebhookPayload{Action: action, Actor: actorFrom(ctx), Time: time.Now(), OldEntries: []Entry{}, NewEntries: []Entry{}}
+	if old != nil {
+		payload.ID, payload.Name, payload.OldEntries = old.ID, old.Name, old.clone().Entries
+	}
+	if target != nil {
+		payload.ID, payload.Name, payload.NewEntries = target.ID, target.Name, target.clone().Entries
+	}
+	s.webhooks.notify(payload)
+}
+
+var errWebhooksDisabled = &ValidationError{Text: "Webhooks are disabled"}
+
+// Deliveries returns the latest webhook deliveries, oldest first.
+func (s *Service) Deliveries() ([]Delivery, error) {
+	if s.webhooks == nil {
+		return nil, errWebhooksDisabled
+	}
+	return s.webhooks.Deliveries(), nil
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWebhooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []Webhook
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			spec: "",
+			want: []Webhook{},
+		},
+		{
+			name: "actions",
+			spec: "https://hooks.example.com/a  http://relay:8080/b?x=1#create,delete",
+			want: []Webhook{
+				{URL: "https://hooks.example.com/a"},
+				{URL: "http://relay:8080/b?x=1", Actions: []Action{ActionCreate, ActionDelete}},
+			},
+		},
+		{
+			name:    "unknownAction",
+			spec:    "https://hooks.example.com/a#rename",
+			wantErr: true,
+		},
+		{
+			name:    "notHTTP",
+			spec:    "ftp://hooks.example.com/a",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWebhooks(tt.spec)
+			if tt.wantErr {
+				assert.IsType(t, &ValidationError{}, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// webhookServer records payloads it gets, it answers with the given statuses one after another, then 200.
+type webhookServer struct {
+	mu       sync.Mutex
+	statuses []int
+	payloads []WebhookPayload
+	headers  []http.Header
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	payload := WebhookPayload{}
+	json.Unmarshal(body, &payload)
+	s.payloads = append(s.payloads, payload)
+	s.headers = append(s.headers, r.Header.Clone())
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+	// the signature is checked the way receivers do
+	if r.Header.Get(SignatureHeader) != Sign([]byte("secret"), body) {
+		status = http.StatusUnauthorized
+	}
+	w.WriteHeader(status)
+}
+
+// wait blocks until the queued changes have been delivered.
+func (w *Webhooks) wait() {
+	w.pending.Wait()
+}
+
+func newTestWebhooks(hooks []Webhook) *Webhooks {
+	w := NewWebhooks(hooks, "secret")
+	w.backoff = time.Millisecond
+	return w
+}
+
+func TestService_webhooks(t *testing.T) {
+	server := &webhookServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	deletes := &webhookServer{}
+	tsDeletes := httptest.NewServer(deletes)
+	defer tsDeletes.Close()
+	webhooks := newTestWebhooks([]Webhook{{URL: ts.URL + "/hook"}, {URL: tsDeletes.URL, Actions: []Action{ActionDelete}}})
+	s := newHistoryService(nil)
+	WithWebhooks(webhooks)(s)
+	ctx := WithActor(context.Background(), "alice")
+
+	require.NoError(t, s.Create(ctx, historyTarget("a:9100")))
+	update := historyTarget("b:9100")
+	update.ID, update.Revision = "test", FirstRevision
+	require.NoError(t, s.Update(ctx, update))
+	require.NoError(t, s.Delete(ctx, &Target{ID: "test"}))
+	webhooks.wait()
+
+	require.Len(t, server.payloads, 3)
+	created, updated, deleted := server.payloads[0], server.payloads[1], server.payloads[2]
+	assert.Equal(t, ActionCreate, created.Action)
+	assert.Equal(t, ID("test"), created.ID)
+	assert.Empty(t, created.OldEntries)
+	assert.Equal(t, []string{"a:9100"}, created.NewEntries[0].Targets)
+	assert.Equal(t, "alice", created.Actor)
+	assert.Equal(t, []string{"a:9100"}, updated.OldEntries[0].Targets)
+	assert.Equal(t, []string{"b:9100"}, updated.NewEntries[0].Targets)
+	assert.Equal(t, ActionDelete, deleted.Action)
+	assert.Equal(t, []string{"b:9100"}, deleted.OldEntries[0].Targets)
+	assert.Empty(t, deleted.NewEntries)
+	assert.Equal(t, "update", server.headers[1].Get(EventHeader))
+
+	// the second webhook wants only deletes
+	require.Len(t, deletes.payloads, 1)
+	assert.Equal(t, ActionDelete, deletes.payloads[0].Action)
+
+	deliveries, err := s.Deliveries()
+	require.NoError(t, err)
+	assert.Len(t, deliveries, 4)
+	for _, d := range deliveries {
+		assert.True(t, d.Delivered)
+		assert.Equal(t, 1, d.Attempts)
+		// paths of webhooks aren't shown
+		assert.NotContains(t, d.Webhook, "/hook")
+	}
+}
+
+func TestWebhooks_retries(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		delivered bool
+		attempts  int
+	}{
+		{name: "recovers", statuses: []int{http.StatusBadGateway, http.StatusTooManyRequests}, delivered: true, attempts: 3},
+		{name: "givesUp", statuses: []int{500, 500, 500, 500, 500}, attempts: webhookAttempts},
+		{name: "rejected", statuses: []int{http.StatusBadRequest}, attempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &webhookServer{statuses: tt.statuses}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+			webhooks := newTestWebhooks([]Webhook{{URL: ts.URL}})
+			webhooks.notify(WebhookPayload{Action: ActionUpdate, ID: "test"})
+			webhooks.wait()
+
+			deliveries := webhooks.Deliveries()
+			require.Len(t, deliveries, 1)
+			assert.Equal(t, tt.delivered, deliveries[0].Delivered)
+			assert.Equal(t, tt.attempts, deliveries[0].Attempts)
+			assert.Len(t, server.payloads, tt.attempts)
+			if !tt.delivered {
+				assert.NotEmpty(t, deliveries[0].Error)
+			}
+		})
+	}
+}
+
+func TestService_DeliveriesDisabled(t *testing.T) {
+	_, err := newHistoryService(nil).Deliveries()
+	assert.IsType(t, &ValidationError{}, err)
+}
@@ -23,6 +23,80 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/audit": {
+            "get": {
+                "description": "returns records of the audit log, oldest first",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "getAuditHandler",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "RFC 3339 time records start at",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "RFC 3339 time records end at",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "target id",
+                        "name": "target",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/events": {
+            "get": {
+                "description": "streams changes of targets as server-sent events, Last-Event-ID resumes the stream after the given event",
+                "produces": [
+                    "text/event-stream"
+                ],
+                "summary": "eventsHandler",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "target id, can be repeated",
+                        "name": "id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "id of the last received event",
+                        "name": "Last-Event-ID",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/db.Event"
+                        }
+                    }
+                }
+            }
+        },
         "/target/": {
             "post": {
                 "description": "creates target, returns id",
@@ -89,7 +163,7 @@ const docTemplate = `{
                 }
             },
             "post": {
-                "description": "returns id",
+                "description": "returns id, the target is replaced only if If-Match holds its current ETag",
                 "consumes": [
                     "application/json"
                 ],
@@ -105,6 +179,12 @@ const docTemplate = `{
                         "in": "path",
                         "required": true
                     },
+                    {
+                        "type": "string",
+                        "description": "ETag returned by getTargetHandler",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
                     {
                         "description": "name",
                         "name": "payload",
@@ -115,6 +195,162 @@ const docTemplate = `{
                         }
                     }
                 ],
+                "responses": {
+                    "200": {
+                        "description": "id",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "412": {
+                        "description": "target was changed since it was read",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "428": {
+                        "description": "If-Match is missing and PROMHSD_REQUIRE_IF_MATCH is set",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "delete item by id",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "removeTargetHandler",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "target id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "id",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/target/{id}/diff": {
+            "get": {
+                "description": "returns entries added and removed between two versions of the target",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "diffHistoryHandler",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "target id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "version",
+                        "name": "from",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "version",
+                        "name": "to",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/db.Diff"
+                        }
+                    }
+                }
+            }
+        },
+        "/target/{id}/history": {
+            "get": {
+                "description": "returns all changes of the target, oldest first",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "getHistoryHandler",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "target id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/target/{id}/rollback/{version}": {
+            "post": {
+                "description": "restores the target as it was at the version, returns id",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "rollbackTargetHandler",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "target id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "version",
+                        "name": "version",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "id",
@@ -130,7 +366,7 @@ const docTemplate = `{
         },
         "/targets/": {
             "get": {
-                "description": "returns targets",
+                "description": "returns a page of targets, all targets are returned unless limit is given",
                 "consumes": [
                     "application/json"
                 ],
@@ -138,6 +374,169 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "summary": "getTargetsHandler",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "page size, up to 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor of the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "name or time",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "name prefix",
+                        "name": "name_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "key=value, can be repeated",
+                        "name": "label",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/trash/": {
+            "get": {
+                "description": "returns deleted targets kept in the trash, time is the time of deletion",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "getDeletedTargetsHandler",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "empties the trash, returns how many targets were removed",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "purgeTrashHandler",
+                "responses": {
+                    "200": {
+                        "description": "purged",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/trash/{id}": {
+            "delete": {
+                "description": "removes the target from the trash for good",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "purgeTargetHandler",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "target id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/trash/{id}/restore": {
+            "post": {
+                "description": "takes the target out of the trash, returns id",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "restoreTargetHandler",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "target id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "id",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/webhooks/deliveries": {
+            "get": {
+                "description": "returns the latest webhook deliveries, oldest first",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "getDeliveriesHandler",
                 "responses": {
                     "200": {
                         "description": "OK",
@@ -153,6 +552,115 @@ const docTemplate = `{
         }
     },
     "definitions": {
+        "db.Diff": {
+            "type": "object",
+            "properties": {
+                "added": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/db.Entry"
+                    }
+                },
+                "expires_at": {
+                    "$ref": "#/definitions/db.ExpiryDiff"
+                },
+                "from": {
+                    "type": "integer"
+                },
+                "name": {
+                    "$ref": "#/definitions/db.NameDiff"
+                },
+                "removed": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/db.Entry"
+                    }
+                },
+                "to": {
+                    "type": "integer"
+                }
+            }
+        },
+        "db.Entry": {
+            "type": "object",
+            "properties": {
+                "labels": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "targets": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "db.Event": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "seq": {
+                    "type": "integer"
+                },
+                "target": {
+                    "$ref": "#/definitions/db.Target"
+                }
+            }
+        },
+        "db.ExpiryDiff": {
+            "type": "object",
+            "properties": {
+                "from": {
+                    "type": "string"
+                },
+                "to": {
+                    "type": "string"
+                }
+            }
+        },
+        "db.NameDiff": {
+            "type": "object",
+            "properties": {
+                "from": {
+                    "type": "string"
+                },
+                "to": {
+                    "type": "string"
+                }
+            }
+        },
+        "db.Target": {
+            "type": "object",
+            "properties": {
+                "entries": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/db.Entry"
+                    }
+                },
+                "expires_at": {
+                    "description": "ExpiresAt is when the target is deleted by itself, nil means never.",
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "revision": {
+                    "type": "integer"
+                },
+                "time": {
+                    "type": "string"
+                }
+            }
+        },
         "main.createJsonPayload": {
             "type": "object",
             "required": [
@@ -166,8 +674,15 @@ const docTemplate = `{
                         "$ref": "#/definitions/main.entryJsonPayload"
                     }
                 },
+                "expires_at": {
+                    "description": "ExpiresAt and TTL are alternatives, a target without them never expires",
+                    "type": "string"
+                },
                 "name": {
                     "type": "string"
+                },
+                "ttl": {
+                    "type": "string"
                 }
             }
         },
@@ -199,8 +714,15 @@ const docTemplate = `{
                         "$ref": "#/definitions/main.entryJsonPayload"
                     }
                 },
+                "expires_at": {
+                    "description": "ExpiresAt and TTL are alternatives, a target without them never expires",
+                    "type": "string"
+                },
                 "name": {
                     "type": "string"
+                },
+                "ttl": {
+                    "type": "string"
                 }
             }
         }
@@ -209,12 +731,12 @@ const docTemplate = `{
 
 // SwaggerInfo holds exported Swagger Info so clients can modify it
 var SwaggerInfo = &swag.Spec{
-	Version:          "1.0.0",
+	Version:          "0.0.1",
 	Host:             "localhost:8080",
 	BasePath:         "/api/",
 	Schemes:          []string{},
 	Title:            "PromHSD",
-	Description:      "prometheus http static config (PromHSD)",
+	Description:      "prometheus http static config discovery service",
 	InfoInstanceName: "swagger",
 	SwaggerTemplate:  docTemplate,
 }
@@ -1,26 +1,48 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"promhsd/db"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	maxPageSize = 1000
+	// actorHeader is set by an authenticating proxy in front of the service, it is taken only from trustedProxies.
+	actorHeader = "X-Forwarded-User"
+	// staleWarning is sent along with the last known targets when the storage fails.
+	staleWarning = `110 - "Response is Stale"`
+	// keepAliveInterval is how often idle event streams get a comment, so that proxies keep them open.
+	keepAliveInterval = 15 * time.Second
+	// auditTargetKey holds the id of the created target for the audit log, the route has no id.
+	auditTargetKey = "auditTarget"
+)
+
 type readJsonPayload struct {
-	Id      string             `json:"id"`
-	Time    time.Time          `json:"time"`
-	Name    string             `json:"name" binding:"required"`
-	Entries []entryJsonPayload `json:"entries" binding:"required"`
+	Id        string             `json:"id"`
+	Time      time.Time          `json:"time"`
+	Revision  int64              `json:"revision"`
+	Name      string             `json:"name" binding:"required"`
+	Entries   []entryJsonPayload `json:"entries" binding:"required"`
+	ExpiresAt *time.Time         `json:"expires_at,omitempty"`
 }
 
 type createJsonPayload struct {
 	Name    string             `json:"name" binding:"required"`
 	Entries []entryJsonPayload `json:"entries" binding:"required"`
+	// ExpiresAt and TTL are alternatives, a target without them never expires
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL       string     `json:"ttl"`
 }
 
 type entryJsonPayload struct {
@@ -31,6 +53,28 @@ type entryJsonPayload struct {
 type updateJsonPayload struct {
 	Name    string             `json:"name" binding:"required"`
 	Entries []entryJsonPayload `json:"entries" binding:"required"`
+	// ExpiresAt and TTL are alternatives, a target without them never expires
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL       string     `json:"ttl"`
+}
+
+// expiry returns when the target expires, text describes why expires_at or ttl is invalid.
+func expiry(expiresAt *time.Time, ttl string) (*time.Time, string) {
+	if ttl == "" {
+		if expiresAt != nil && !expiresAt.After(time.Now()) {
+			return nil, "Field expires_at should be in the future"
+		}
+		return expiresAt, ""
+	}
+	if expiresAt != nil {
+		return nil, "Only one of expires_at and ttl can be given"
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return nil, "Field ttl should be a positive duration, e.g. 90m"
+	}
+	at := time.Now().Add(d).UTC()
+	return &at, ""
 }
 
 func (p *createJsonPayload) validate() (*db.Target, error) {
@@ -56,6 +100,12 @@ func (p *createJsonPayload) validate() (*db.Target, error) {
 		}
 		t.Entries = append(t.Entries, *entry)
 	}
+	expiresAt, text := expiry(p.ExpiresAt, p.TTL)
+	if text != "" {
+		err.Text = text
+		return nil, err
+	}
+	t.ExpiresAt = expiresAt
 	return t, nil
 }
 
@@ -82,11 +132,33 @@ func (p *updateJsonPayload) validate() (*db.Target, error) {
 		}
 		t.Entries = append(t.Entries, *entry)
 	}
+	expiresAt, text := expiry(p.ExpiresAt, p.TTL)
+	if text != "" {
+		err.Text = text
+		return nil, err
+	}
+	t.ExpiresAt = expiresAt
 	return t, nil
 }
 
+// unavailableStatus maps storage calls which ran out of time or were cancelled
+// to 504 and 503 respectively.
+func unavailableStatus(err error) (int, bool) {
+	var (
+		timeout     *db.TimeoutError
+		unavailable *db.UnavailableError
+	)
+	if errors.As(err, &timeout) {
+		return http.StatusGatewayTimeout, true
+	}
+	if errors.As(err, &unavailable) {
+		return http.StatusServiceUnavailable, true
+	}
+	return 0, false
+}
+
 func convertToJson(t *db.Target) *readJsonPayload {
-	r := &readJsonPayload{Name: t.Name, Id: t.ID.String(), Time: t.Time, Entries: make([]entryJsonPayload, 0, len(t.Entries))}
+	r := &readJsonPayload{Name: t.Name, Id: t.ID.String(), Time: t.Time, Revision: t.Revision, ExpiresAt: t.ExpiresAt, Entries: make([]entryJsonPayload, 0, len(t.Entries))}
 	for _, entry := range t.Entries {
 		labels := make([]string, 0, len(entry.Labels))
 		for k, v := range entry.Labels {
@@ -98,21 +170,151 @@ func convertToJson(t *db.Target) *readJsonPayload {
 	return r
 }
 
+// requestContext attributes changes made by the request to the user the proxy has authenticated,
+// or to the client address when there is no proxy.
+func requestContext(c *gin.Context) context.Context {
+	return db.WithActor(c.Request.Context(), requestActor(c))
+}
+
+// requestActor is the user a trusted proxy has authenticated, or the client address,
+// so that clients can't name the actor themselves.
+func requestActor(c *gin.Context) string {
+	if actor := c.GetHeader(actorHeader); actor != "" && fromTrustedProxy(c) {
+		return actor
+	}
+	return c.ClientIP()
+}
+
+func fromTrustedProxy(c *gin.Context) bool {
+	ip := net.ParseIP(c.RemoteIP())
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// audited writes every call of the handler to the audit log, the service fills in the entries
+// the call changed from the reads it makes anyway. Failures of the audit log are only logged, they don't fail the call.
+func audited(action db.Action) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !dbService.Audited() {
+			c.Next()
+			return
+		}
+		ctx := c.Request.Context()
+		record := &db.AuditRecord{
+			Actor:    requestActor(c),
+			SourceIP: c.ClientIP(),
+			Action:   action,
+			Target:   db.ID(c.Param("id")),
+			Added:    []db.Entry{},
+			Removed:  []db.Entry{},
+		}
+		c.Request = c.Request.WithContext(db.WithAuditRecord(ctx, record))
+		c.Next()
+		record.Time = time.Now()
+		record.Code = c.Writer.Status()
+		if created, ok := c.Get(auditTargetKey); ok {
+			record.Target = created.(db.ID)
+		}
+		if err := dbService.Audit(ctx, record); err != nil {
+			log.Printf("(Audit) Failed to record %s of %s: %s\n", action, record.Target, err)
+		}
+	}
+}
+
+// etag formats the revision of the target as a strong entity tag.
+func etag(revision int64) string {
+	return strconv.Quote(strconv.FormatInt(revision, 10))
+}
+
+// ifMatchRevision reads the revision the client has edited from If-Match, missing header or "*"
+// lets any revision be replaced, ok is false for a tag which isn't a revision.
+// A missing header is rejected before when requireIfMatch is set.
+func ifMatchRevision(c *gin.Context) (revision int64, ok bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return db.AnyRevision, true
+	}
+	revision, err := strconv.ParseInt(strings.Trim(header, `"`), 10, 64)
+	if err != nil || revision < 0 {
+		return 0, false
+	}
+	return revision, true
+}
+
+// listQuery reads paging, sorting and filtering parameters of the targets list.
+func listQuery(c *gin.Context) (*db.ListQuery, error) {
+	query := &db.ListQuery{
+		NamePrefix: c.Query("name_prefix"),
+		SortBy:     db.SortField(c.DefaultQuery("sort", string(db.SortByName))),
+	}
+	if limit := c.Query("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > maxPageSize {
+			return nil, &db.ValidationError{Text: fmt.Sprintf("limit should be between 1 and %d", maxPageSize)}
+		}
+		query.Limit = l
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		after, err := db.ParseCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		query.After = after
+	}
+	for _, label := range c.QueryArray("label") {
+		k, v, ok := strings.Cut(label, "=")
+		if !ok {
+			return nil, &db.ValidationError{Text: "label should be key=value"}
+		}
+		if query.Labels == nil {
+			query.Labels = map[string]string{}
+		}
+		query.Labels[k] = v
+	}
+	return query, nil
+}
+
 // sourcesHandler godoc
 // @Summary      getTargetsHandler
-// @Description  returns targets
+// @Description  returns a page of targets, all targets are returned unless limit is given
 // @Produce      json
 // @Accept       json
 // @Success      200  {array}  string  []db.Target{}
+// @Param        limit        query  int     false  "page size, up to 1000"
+// @Param        cursor       query  string  false  "next_cursor of the previous page"
+// @Param        sort         query  string  false  "name or time"
+// @Param        name_prefix  query  string  false  "name prefix"
+// @Param        label        query  string  false  "key=value, can be repeated"
 // @Router       /targets/ [get]
 func getTargetsHandler(c *gin.Context) {
-	targets := []db.Target{}
-	err := dbService.List(&targets)
+	query, err := listQuery(c)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+		return
+	}
+	page := db.Page{}
+	err = dbService.List(c.Request.Context(), query, &page)
+	if err != nil {
+		var validation *db.ValidationError
+		if errors.As(err, &validation) {
+			c.JSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+			return
+		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
 		c.String(http.StatusInternalServerError, "Internal error occured. Please check logs")
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"targets": targets})
+	c.JSON(http.StatusOK, gin.H{"targets": page.Targets, "next_cursor": page.Next})
 }
 
 // sourcesHandler godoc
@@ -134,17 +336,27 @@ func createTargetHandler(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, gin.H{"err_fields": err.Error()})
 		return
 	}
-	err = dbService.Create(t)
+	err = dbService.Create(requestContext(c), t)
+	c.Set(auditTargetKey, t.ID)
 	if err != nil {
-		if errors.As(err, &db.ErrValidation) {
+		var (
+			validation *db.ValidationError
+			conflict   *db.ConflictError
+		)
+		if errors.As(err, &validation) {
 			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
 			return
 		}
-		if errors.As(err, &db.ErrConflict) {
+		if errors.As(err, &conflict) {
 			c.JSON(http.StatusConflict, gin.H{"err": err.Error()})
 			return
 		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
 		c.String(http.StatusInternalServerError, "Internal error occured. Please check logs")
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{"id": t.ID})
 }
@@ -160,30 +372,42 @@ func createTargetHandler(c *gin.Context) {
 func getTargetHandler(c *gin.Context) {
 	t := db.NewTarget()
 	t.ID = db.ID(c.Param("id"))
-	err := dbService.Get(t)
+	err := dbService.Get(c.Request.Context(), t)
 	if err != nil {
-		if errors.As(err, &db.ErrNotFound) {
+		var (
+			notFound   *db.NotFoundError
+			validation *db.ValidationError
+		)
+		if errors.As(err, &notFound) {
 			c.JSON(http.StatusNotFound, gin.H{})
 			return
 		}
-		if errors.As(err, &db.ErrValidation) {
+		if errors.As(err, &validation) {
 			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
 			return
 		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{})
 		return
 
 	}
+	c.Header("ETag", etag(t.Revision))
 	c.JSON(http.StatusOK, gin.H{"target": convertToJson(t)})
 }
 
 // sourcesHandler godoc
 // @Summary      updateTargetHandler
-// @Description  returns id
+// @Description  returns id, the target is replaced only if If-Match holds its current ETag
 // @Produce      json
 // @Accept       json
 // @Success      200  {array}  string  "id"
-// @Param        id   path     string  true  "target id"
+// @Failure      412  {object}  string  "target was changed since it was read"
+// @Failure      428  {object}  string  "If-Match is missing and PROMHSD_REQUIRE_IF_MATCH is set"
+// @Param        id        path    string  true   "target id"
+// @Param        If-Match  header  string  false  "ETag returned by getTargetHandler"
 // @Router       /target/{id} [post]
 // @Param        payload  body  updateJsonPayload  true  "name"
 func updateTargetHandler(c *gin.Context) {
@@ -198,19 +422,47 @@ func updateTargetHandler(c *gin.Context) {
 		return
 	}
 	t.ID = db.ID(c.Param("id"))
-	err = dbService.Update(t)
+	if requireIfMatch && strings.TrimSpace(c.GetHeader("If-Match")) == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"err": "If-Match should hold the ETag of the target"})
+		return
+	}
+	revision, ok := ifMatchRevision(c)
+	if !ok {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"err": "If-Match should be an ETag of the target"})
+		return
+	}
+	t.Revision = revision
+	err = dbService.Update(requestContext(c), t)
 	if err != nil {
-		if errors.As(err, &db.ErrNotFound) {
+		var (
+			notFound   *db.NotFoundError
+			validation *db.ValidationError
+			conflict   *db.ConflictError
+		)
+		if errors.As(err, &notFound) {
 			c.JSON(http.StatusNotFound, gin.H{})
 			return
 		}
-		if errors.As(err, &db.ErrValidation) {
+		if errors.As(err, &validation) {
 			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
 			return
 		}
+		if errors.As(err, &conflict) {
+			if revision != db.AnyRevision {
+				c.JSON(http.StatusPreconditionFailed, gin.H{"err": "target was changed since it was read"})
+				return
+			}
+			c.JSON(http.StatusConflict, gin.H{"err": err.Error()})
+			return
+		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{})
 		return
 	}
+	c.Header("ETag", etag(t.Revision))
 	c.JSON(http.StatusOK, gin.H{"id": t.ID})
 }
 
@@ -225,44 +477,416 @@ func updateTargetHandler(c *gin.Context) {
 func removeTargetHandler(c *gin.Context) {
 	t := db.NewTarget()
 	t.ID = db.ID(c.Param("id"))
-	err := dbService.Delete(t)
+	err := dbService.Delete(requestContext(c), t)
 	if err != nil {
-		if errors.As(err, &db.ErrNotFound) {
+		var (
+			notFound   *db.NotFoundError
+			validation *db.ValidationError
+		)
+		if errors.As(err, &notFound) {
 			c.JSON(http.StatusNotFound, gin.H{})
 			return
 		}
-		if errors.As(err, &db.ErrValidation) {
+		if errors.As(err, &validation) {
 			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
 			return
 		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{})
 }
 
-func prometheusHandler(c *gin.Context) {
+// sourcesHandler godoc
+// @Summary      getHistoryHandler
+// @Description  returns all changes of the target, oldest first
+// @Produce      json
+// @Accept       json
+// @Success      200  {array}  string  []db.Change{}
+// @Param        id   path     string  true  "target id"
+// @Router       /target/{id}/history [get]
+func getHistoryHandler(c *gin.Context) {
+	changes := []db.Change{}
+	err := dbService.History(c.Request.Context(), db.ID(c.Param("id")), &changes)
+	if err != nil {
+		var validation *db.ValidationError
+		if errors.As(err, &validation) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"changes": changes})
+}
+
+func versionParam(value string) (int64, error) {
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version < 1 {
+		return 0, &db.ValidationError{Text: "version should be a positive number"}
+	}
+	return version, nil
+}
+
+// sourcesHandler godoc
+// @Summary      diffHistoryHandler
+// @Description  returns entries added and removed between two versions of the target
+// @Produce      json
+// @Accept       json
+// @Success      200  {object}  db.Diff
+// @Param        id    path   string  true  "target id"
+// @Param        from  query  int     true  "version"
+// @Param        to    query  int     true  "version"
+// @Router       /target/{id}/diff [get]
+func diffHistoryHandler(c *gin.Context) {
+	from, err := versionParam(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+		return
+	}
+	to, err := versionParam(c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+		return
+	}
+	diff := db.Diff{}
+	err = dbService.Diff(c.Request.Context(), db.ID(c.Param("id")), from, to, &diff)
+	if err != nil {
+		var (
+			notFound   *db.NotFoundError
+			validation *db.ValidationError
+		)
+		if errors.As(err, &notFound) {
+			c.JSON(http.StatusNotFound, gin.H{"err": err.Error()})
+			return
+		}
+		if errors.As(err, &validation) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
+
+// sourcesHandler godoc
+// @Summary      rollbackTargetHandler
+// @Description  restores the target as it was at the version, returns id
+// @Produce      json
+// @Accept       json
+// @Success      200  {array}  string  "id"
+// @Param        id       path  string  true  "target id"
+// @Param        version  path  int     true  "version"
+// @Router       /target/{id}/rollback/{version} [post]
+func rollbackTargetHandler(c *gin.Context) {
+	version, err := versionParam(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+		return
+	}
+	t := db.NewTarget()
+	err = dbService.Rollback(requestContext(c), db.ID(c.Param("id")), version, t)
+	if err != nil {
+		var (
+			notFound   *db.NotFoundError
+			validation *db.ValidationError
+			conflict   *db.ConflictError
+		)
+		if errors.As(err, &notFound) {
+			c.JSON(http.StatusNotFound, gin.H{"err": err.Error()})
+			return
+		}
+		if errors.As(err, &validation) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
+			return
+		}
+		if errors.As(err, &conflict) {
+			c.JSON(http.StatusConflict, gin.H{"err": err.Error()})
+			return
+		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.Header("ETag", etag(t.Revision))
+	c.JSON(http.StatusOK, gin.H{"id": t.ID})
+}
+
+// sourcesHandler godoc
+// @Summary      getDeletedTargetsHandler
+// @Description  returns deleted targets kept in the trash, time is the time of deletion
+// @Produce      json
+// @Accept       json
+// @Success      200  {array}  string  []db.Target{}
+// @Router       /trash/ [get]
+func getDeletedTargetsHandler(c *gin.Context) {
+	targets := []db.Target{}
+	err := dbService.Deleted(c.Request.Context(), &targets)
+	if err != nil {
+		var validation *db.ValidationError
+		if errors.As(err, &validation) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
+			return
+		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"targets": targets})
+}
+
+// sourcesHandler godoc
+// @Summary      restoreTargetHandler
+// @Description  takes the target out of the trash, returns id
+// @Produce      json
+// @Accept       json
+// @Success      200  {array}  string  "id"
+// @Param        id   path     string  true  "target id"
+// @Router       /trash/{id}/restore [post]
+func restoreTargetHandler(c *gin.Context) {
 	t := db.NewTarget()
 	t.ID = db.ID(c.Param("id"))
-	err := dbService.Get(t)
+	err := dbService.Restore(requestContext(c), t)
 	if err != nil {
-		if errors.As(err, &db.ErrNotFound) {
+		var (
+			notFound   *db.NotFoundError
+			validation *db.ValidationError
+			conflict   *db.ConflictError
+		)
+		if errors.As(err, &notFound) {
 			c.JSON(http.StatusNotFound, gin.H{})
 			return
 		}
-		if errors.As(err, &db.ErrValidation) {
+		if errors.As(err, &validation) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
+			return
+		}
+		if errors.As(err, &conflict) {
+			c.JSON(http.StatusConflict, gin.H{"err": err.Error()})
+			return
+		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.Header("ETag", etag(t.Revision))
+	c.JSON(http.StatusOK, gin.H{"id": t.ID})
+}
+
+// sourcesHandler godoc
+// @Summary      purgeTargetHandler
+// @Description  removes the target from the trash for good
+// @Produce      json
+// @Accept       json
+// @Success      200  {array}  string  ""
+// @Param        id   path     string  true  "target id"
+// @Router       /trash/{id} [delete]
+func purgeTargetHandler(c *gin.Context) {
+	err := dbService.Purge(c.Request.Context(), db.ID(c.Param("id")))
+	if err != nil {
+		var (
+			notFound   *db.NotFoundError
+			validation *db.ValidationError
+		)
+		if errors.As(err, &notFound) {
+			c.JSON(http.StatusNotFound, gin.H{})
+			return
+		}
+		if errors.As(err, &validation) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
+			return
+		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// sourcesHandler godoc
+// @Summary      purgeTrashHandler
+// @Description  empties the trash, returns how many targets were removed
+// @Produce      json
+// @Accept       json
+// @Success      200  {array}  string  "purged"
+// @Router       /trash/ [delete]
+func purgeTrashHandler(c *gin.Context) {
+	purged, err := dbService.PurgeBefore(c.Request.Context(), time.Now())
+	if err != nil {
+		var validation *db.ValidationError
+		if errors.As(err, &validation) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
+			return
+		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
+
+// sourcesHandler godoc
+// @Summary      getDeliveriesHandler
+// @Description  returns the latest webhook deliveries, oldest first
+// @Produce      json
+// @Accept       json
+// @Success      200  {array}  string  []db.Delivery{}
+// @Router       /webhooks/deliveries [get]
+func getDeliveriesHandler(c *gin.Context) {
+	deliveries, err := dbService.Deliveries()
+	if err != nil {
+		var validation *db.ValidationError
+		if errors.As(err, &validation) {
 			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
 			return
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
 
+// sourcesHandler godoc
+// @Summary      getAuditHandler
+// @Description  returns records of the audit log, oldest first
+// @Produce      json
+// @Accept       json
+// @Success      200  {array}  string  []db.AuditRecord{}
+// @Param        from    query  string  false  "RFC 3339 time records start at"
+// @Param        to      query  string  false  "RFC 3339 time records end at"
+// @Param        target  query  string  false  "target id"
+// @Router       /audit [get]
+func getAuditHandler(c *gin.Context) {
+	query := &db.AuditQuery{Target: db.ID(c.Query("target"))}
+	for param, value := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if c.Query(param) == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, c.Query(param))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"err": fmt.Sprintf("%s should be an RFC 3339 time", param)})
+			return
+		}
+		*value = t
+	}
+	records := []db.AuditRecord{}
+	err := dbService.AuditRecords(c.Request.Context(), query, &records)
+	if err != nil {
+		var validation *db.ValidationError
+		if errors.As(err, &validation) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
+			return
+		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"records": records})
+}
+
+// sourcesHandler godoc
+// @Summary      eventsHandler
+// @Description  streams changes of targets as server-sent events, Last-Event-ID resumes the stream after the given event
+// @Produce      text/event-stream
+// @Success      200  {object}  db.Event
+// @Param        id             query   string  false  "target id, can be repeated"
+// @Param        Last-Event-ID  header  string  false  "id of the last received event"
+// @Router       /events [get]
+func eventsHandler(c *gin.Context) {
+	var after uint64
+	if lastID := c.GetHeader("Last-Event-ID"); lastID != "" {
+		seq, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"err": "Last-Event-ID should be the id of an event"})
+			return
+		}
+		after = seq
+	}
+	ids := map[db.ID]bool{}
+	for _, id := range c.QueryArray("id") {
+		ids[db.ID(id)] = true
+	}
+	events := dbService.Subscribe(c.Request.Context(), after)
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			// the channel is closed once the client is gone
+			if !ok {
+				return
+			}
+			if len(ids) > 0 && !ids[event.Target.ID] {
+				continue
+			}
+			c.Render(-1, sse.Event{Id: strconv.FormatUint(event.Seq, 10), Event: string(event.Action), Data: event})
+		case <-keepAlive.C:
+			c.Writer.WriteString(": keepalive\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+func prometheusHandler(c *gin.Context) {
+	t := db.NewTarget()
+	t.ID = db.ID(c.Param("id"))
+	stale, err := dbService.GetLastKnown(c.Request.Context(), t)
+	if err != nil {
+		var (
+			notFound   *db.NotFoundError
+			validation *db.ValidationError
+		)
+		if errors.As(err, &notFound) {
+			c.JSON(http.StatusNotFound, gin.H{})
+			return
+		}
+		if errors.As(err, &validation) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
+			return
+		}
+		if code, ok := unavailableStatus(err); ok {
+			c.JSON(code, gin.H{"err": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{})
+		return
+	}
+	if stale {
+		c.Header("Warning", staleWarning)
+	}
 	c.JSON(http.StatusOK, t.Entries)
 }
 
 func healthHandler(c *gin.Context) {
-	if !dbService.IsHealthy() {
+	if !dbService.IsHealthy(c.Request.Context()) {
 		c.JSON(http.StatusInternalServerError, gin.H{"healthy": "no"})
 		return
 	}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"promhsd/db"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,28 +25,28 @@ type testStorage struct {
 	//returnItem  *Target
 }
 
-func (s *testStorage) Create(*db.Target) error {
+func (s *testStorage) Create(context.Context, *db.Target) error {
 
 	return s.returnError
 }
 
-func (s *testStorage) Update(*db.Target) error {
+func (s *testStorage) Update(context.Context, *db.Target) error {
 	return s.returnError
 }
 
-func (s *testStorage) Delete(*db.Target) error {
+func (s *testStorage) Delete(context.Context, *db.Target) error {
 	return s.returnError
 }
 
-func (s *testStorage) Get(*db.Target) error {
+func (s *testStorage) Get(context.Context, *db.Target) error {
 	return s.returnError
 }
 
-func (s *testStorage) GetAll(*[]db.Target) error {
+func (s *testStorage) GetAll(context.Context, *db.ListQuery, *[]db.Target) error {
 	return s.returnError
 }
 
-func (s *testStorage) IsHealthy() bool {
+func (s *testStorage) IsHealthy(context.Context) bool {
 	return true
 }
 
@@ -83,6 +88,63 @@ func Test_getTargetsHandler(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w2.Code)
 }
 
+func Test_getTargetsHandler_query(t *testing.T) {
+	var (
+		err error
+	)
+	dbService, err = db.New("testdb", "")
+	assert.NoError(t, err)
+	storage.returnError = nil
+
+	router := setupRouter()
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{
+			name:  "allParams",
+			query: "?limit=10&sort=time&name_prefix=web&label=env=prod&label=team=sre&cursor=" + (&db.Cursor{ID: "test"}).String(),
+			code:  http.StatusOK,
+		},
+		{
+			name:  "limitTooBig",
+			query: "?limit=1001",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "limitNotNumber",
+			query: "?limit=ten",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "wrongCursor",
+			query: "?cursor=----",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "wrongSort",
+			query: "?sort=size",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "wrongLabel",
+			query: "?label=env",
+			code:  http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/api/targets/"+tt.query, nil)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
+
 func Test_getTargetHandler(t *testing.T) {
 	var (
 		err error
@@ -114,9 +176,19 @@ func Test_getTargetHandler(t *testing.T) {
 		},
 		{
 			name: "notFoundError",
-			err:  &db.NotFoundError{},
+			err:  &db.NotFoundError{Text: "Other text"},
 			code: http.StatusNotFound,
 		},
+		{
+			name: "timeoutError",
+			err:  &db.TimeoutError{},
+			code: http.StatusGatewayTimeout,
+		},
+		{
+			name: "unavailableError",
+			err:  &db.UnavailableError{},
+			code: http.StatusServiceUnavailable,
+		},
 	}
 
 	for _, tt := range tests {
@@ -126,8 +198,13 @@ func Test_getTargetHandler(t *testing.T) {
 			storage.returnError = tt.err
 			router.ServeHTTP(w, req)
 			assert.Equal(t, tt.code, w.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, `"0"`, w.Header().Get("ETag"))
+			}
 		})
 	}
+	// errors of one request don't leak into the sentinels
+	assert.Equal(t, "Target was not found", db.ErrNotFound.Text)
 }
 
 func Test_createTargetHandler(t *testing.T) {
@@ -187,6 +264,36 @@ func Test_createTargetHandler(t *testing.T) {
 			code:    http.StatusConflict,
 			payload: `{"name": "test", "entries": [{"targets": "127.0.0.1:5000", "labels": "key=val,k1=v1"}]}`,
 		},
+		{
+			name:    "timeoutError",
+			err:     &db.TimeoutError{},
+			code:    http.StatusGatewayTimeout,
+			payload: `{"name": "test", "entries": [{"targets": "127.0.0.1:5000", "labels": "key=val,k1=v1"}]}`,
+		},
+		{
+			name:    "ttl",
+			err:     nil,
+			code:    http.StatusOK,
+			payload: `{"name": "test", "ttl": "2h", "entries": [{"targets": "127.0.0.1:5000", "labels": "key=val,k1=v1"}]}`,
+		},
+		{
+			name:    "ttlInvalid",
+			err:     nil,
+			code:    http.StatusUnprocessableEntity,
+			payload: `{"name": "test", "ttl": "soon", "entries": [{"targets": "127.0.0.1:5000", "labels": "key=val,k1=v1"}]}`,
+		},
+		{
+			name:    "expiresAtPast",
+			err:     nil,
+			code:    http.StatusUnprocessableEntity,
+			payload: `{"name": "test", "expires_at": "2020-01-01T00:00:00Z", "entries": [{"targets": "127.0.0.1:5000", "labels": "key=val,k1=v1"}]}`,
+		},
+		{
+			name:    "ttlAndExpiresAt",
+			err:     nil,
+			code:    http.StatusUnprocessableEntity,
+			payload: `{"name": "test", "ttl": "2h", "expires_at": "2999-01-01T00:00:00Z", "entries": [{"targets": "127.0.0.1:5000", "labels": "key=val,k1=v1"}]}`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -214,6 +321,8 @@ func Test_updateTargetHandler(t *testing.T) {
 		err     error
 		code    int
 		payload string
+		ifMatch string
+		require bool
 	}{
 		{
 			name:    "error400",
@@ -257,13 +366,60 @@ func Test_updateTargetHandler(t *testing.T) {
 			code:    http.StatusNotFound,
 			payload: `{"name": "test", "entries": [{"targets": "127.0.0.1:5000", "labels": "k1=v1"}]}`,
 		},
+		{
+			name:    "anyRevision",
+			err:     nil,
+			code:    http.StatusOK,
+			payload: `{"name": "test", "entries": [{"targets": "127.0.0.1:5000", "labels": "k1=v1"}]}`,
+			ifMatch: "*",
+		},
+		{
+			name:    "revisionMismatch",
+			err:     &db.ConflictError{},
+			code:    http.StatusPreconditionFailed,
+			payload: `{"name": "test", "entries": [{"targets": "127.0.0.1:5000", "labels": "k1=v1"}]}`,
+			ifMatch: `"1"`,
+		},
+		{
+			name:    "ifMatchInvalid",
+			err:     nil,
+			code:    http.StatusPreconditionFailed,
+			payload: `{"name": "test", "entries": [{"targets": "127.0.0.1:5000", "labels": "k1=v1"}]}`,
+			ifMatch: `"abc"`,
+		},
+		{
+			name:    "conflictWithoutIfMatch",
+			err:     &db.ConflictError{},
+			code:    http.StatusConflict,
+			payload: `{"name": "test", "entries": [{"targets": "127.0.0.1:5000", "labels": "k1=v1"}]}`,
+		},
+		{
+			name:    "ifMatchRequired",
+			err:     nil,
+			code:    http.StatusPreconditionRequired,
+			payload: `{"name": "test", "entries": [{"targets": "127.0.0.1:5000", "labels": "k1=v1"}]}`,
+			require: true,
+		},
+		{
+			name:    "ifMatchRequiredSent",
+			err:     nil,
+			code:    http.StatusOK,
+			payload: `{"name": "test", "entries": [{"targets": "127.0.0.1:5000", "labels": "k1=v1"}]}`,
+			ifMatch: `"1"`,
+			require: true,
+		},
 	}
+	defer func() { requireIfMatch = false }()
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			w := httptest.NewRecorder()
 			req, _ := http.NewRequest(http.MethodPost, "/api/target/1", strings.NewReader(tt.payload))
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
 			storage.returnError = tt.err
+			requireIfMatch = tt.require
 			router.ServeHTTP(w, req)
 			assert.Equal(t, tt.code, w.Code)
 		})
@@ -372,3 +528,380 @@ func Test_prometheusHandler(t *testing.T) {
 		})
 	}
 }
+
+func Test_prometheusHandler_stale(t *testing.T) {
+	var (
+		err error
+	)
+	dbService, err = db.New("testdb", "", db.WithSnapshots("", 0))
+	assert.NoError(t, err)
+
+	router := setupRouter()
+
+	tests := []struct {
+		name    string
+		err     error
+		code    int
+		warning string
+	}{
+		{
+			name: "NoErrors",
+			err:  nil,
+			code: http.StatusOK,
+		},
+		{
+			name:    "lastKnown",
+			err:     &db.StorageError{},
+			code:    http.StatusOK,
+			warning: staleWarning,
+		},
+		{
+			name: "notFoundError",
+			err:  &db.NotFoundError{},
+			code: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/prom-target/1", nil)
+			storage.returnError = tt.err
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.code, w.Code)
+			assert.Equal(t, tt.warning, w.Header().Get("Warning"))
+		})
+	}
+	storage.returnError = nil
+}
+
+func Test_historyHandlers(t *testing.T) {
+	var (
+		err error
+	)
+	dbService, err = db.New("testdb", "")
+	assert.NoError(t, err)
+	storage.returnError = nil
+
+	router := setupRouter()
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		code   int
+	}{
+		{
+			name:   "history",
+			method: http.MethodGet,
+			url:    "/api/target/1/history",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "diffInvalidVersion",
+			method: http.MethodGet,
+			url:    "/api/target/1/diff?from=0&to=1",
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "diffVersionNotFound",
+			method: http.MethodGet,
+			url:    "/api/target/1/diff?from=1&to=2",
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "rollbackInvalidVersion",
+			method: http.MethodPost,
+			url:    "/api/target/1/rollback/latest",
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "rollbackVersionNotFound",
+			method: http.MethodPost,
+			url:    "/api/target/1/rollback/1",
+			code:   http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, tt.url, nil)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
+
+func Test_trashHandlers(t *testing.T) {
+	router := setupRouter()
+	storage.returnError = nil
+
+	tests := []struct {
+		name    string
+		options []db.Option
+		method  string
+		url     string
+		code    int
+	}{
+		{
+			name:   "trashDisabled",
+			method: http.MethodGet,
+			url:    "/api/trash/",
+			code:   http.StatusUnprocessableEntity,
+		},
+		{
+			name:    "list",
+			options: []db.Option{db.WithTrash(&testStorage{}, time.Hour)},
+			method:  http.MethodGet,
+			url:     "/api/trash/",
+			code:    http.StatusOK,
+		},
+		{
+			name:    "restoreNotFound",
+			options: []db.Option{db.WithTrash(&testStorage{returnError: &db.NotFoundError{}}, time.Hour)},
+			method:  http.MethodPost,
+			url:     "/api/trash/1/restore",
+			code:    http.StatusNotFound,
+		},
+		{
+			name:    "purge",
+			options: []db.Option{db.WithTrash(&testStorage{}, time.Hour)},
+			method:  http.MethodDelete,
+			url:     "/api/trash/1",
+			code:    http.StatusOK,
+		},
+		{
+			name:    "purgeAll",
+			options: []db.Option{db.WithTrash(&testStorage{}, time.Hour)},
+			method:  http.MethodDelete,
+			url:     "/api/trash/",
+			code:    http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			dbService, err = db.New("testdb", "", tt.options...)
+			assert.NoError(t, err)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, tt.url, nil)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
+
+func Test_eventsHandler(t *testing.T) {
+	var (
+		err error
+	)
+	dbService, err = db.New("testdb", "")
+	assert.NoError(t, err)
+	storage.returnError = nil
+	for _, id := range []db.ID{"a", "test", "other"} {
+		assert.NoError(t, dbService.Delete(context.Background(), &db.Target{ID: id}))
+	}
+
+	router := setupRouter()
+
+	tests := []struct {
+		name     string
+		path     string
+		lastID   string
+		code     int
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "resumed",
+			path:     "/api/events",
+			lastID:   "1",
+			code:     http.StatusOK,
+			contains: []string{"id:2\nevent:delete\n", `"id":"test"`, "id:3\nevent:delete\n", `"id":"other"`},
+			excludes: []string{`"id":"a"`},
+		},
+		{
+			name:     "filtered",
+			path:     "/api/events?id=other",
+			lastID:   "1",
+			code:     http.StatusOK,
+			contains: []string{"id:3\nevent:delete\n"},
+			excludes: []string{`"id":"test"`},
+		},
+		{
+			name:   "invalidLastEventID",
+			path:   "/api/events",
+			lastID: "last",
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the stream ends with the request, missed events are sent before that
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, tt.path, nil)
+			req.Header.Set("Last-Event-ID", tt.lastID)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.code, w.Code)
+			for _, s := range tt.contains {
+				assert.Contains(t, w.Body.String(), s)
+			}
+			for _, s := range tt.excludes {
+				assert.NotContains(t, w.Body.String(), s)
+			}
+		})
+	}
+}
+
+func Test_getDeliveriesHandler(t *testing.T) {
+	router := setupRouter()
+
+	tests := []struct {
+		name    string
+		options []db.Option
+		code    int
+	}{
+		{
+			name: "webhooksDisabled",
+			code: http.StatusUnprocessableEntity,
+		},
+		{
+			name:    "list",
+			options: []db.Option{db.WithWebhooks(db.NewWebhooks(nil, ""))},
+			code:    http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			dbService, err = db.New("testdb", "", tt.options...)
+			assert.NoError(t, err)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/api/webhooks/deliveries", nil)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
+
+func Test_auditHandlers(t *testing.T) {
+	var err error
+	dbService, err = db.New("memory", "", db.WithAudit(db.NewStreamAudit(io.Discard)))
+	assert.NoError(t, err)
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies = []*net.IPNet{proxies}
+	defer func() { trustedProxies = nil }()
+	router := setupRouter()
+
+	steps := []struct {
+		method  string
+		url     string
+		payload string
+		remote  string
+		code    int
+	}{
+		{http.MethodPost, "/api/target/", `{"name": "audited", "entries": [{"targets": "a:9100", "labels": "env=prod"}]}`, "10.0.0.1:40000", http.StatusOK},
+		{http.MethodPost, "/api/target/audited", `{"name": "audited", "entries": [{"targets": "b:9100", "labels": "env=prod"}]}`, "10.0.0.1:40000", http.StatusOK},
+		{http.MethodDelete, "/api/target/missing", "", "192.168.1.5:40000", http.StatusNotFound},
+		{http.MethodDelete, "/api/target/audited", "", "10.0.0.1:40000", http.StatusOK},
+	}
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(step.method, step.url, strings.NewReader(step.payload))
+		req.Header.Set(actorHeader, "alice")
+		req.RemoteAddr = step.remote
+		router.ServeHTTP(w, req)
+		assert.Equal(t, step.code, w.Code, step.url)
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		code    int
+		actions []db.Action
+	}{
+		{name: "all", url: "/api/audit", code: http.StatusOK, actions: []db.Action{db.ActionCreate, db.ActionUpdate, db.ActionDelete, db.ActionDelete}},
+		{name: "target", url: "/api/audit?target=audited", code: http.StatusOK, actions: []db.Action{db.ActionCreate, db.ActionUpdate, db.ActionDelete}},
+		{name: "future", url: "/api/audit?from=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), code: http.StatusOK, actions: []db.Action{}},
+		{name: "invalidTime", url: "/api/audit?to=yesterday", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.code, w.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			body := struct{ Records []db.AuditRecord }{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			actions := []db.Action{}
+			for _, record := range body.Records {
+				actions = append(actions, record.Action)
+			}
+			assert.Equal(t, tt.actions, actions)
+		})
+	}
+
+	records := []db.AuditRecord{}
+	assert.NoError(t, dbService.AuditRecords(context.Background(), &db.AuditQuery{}, &records))
+	created, updated, missing, deleted := records[0], records[1], records[2], records[3]
+	assert.Equal(t, db.ID("audited"), created.Target)
+	assert.Equal(t, "alice", created.Actor)
+	assert.Equal(t, "10.0.0.1", created.SourceIP)
+	assert.Equal(t, []string{"a:9100"}, created.Added[0].Targets)
+	assert.Empty(t, created.Removed)
+	assert.Equal(t, []string{"b:9100"}, updated.Added[0].Targets)
+	assert.Equal(t, []string{"a:9100"}, updated.Removed[0].Targets)
+	assert.Equal(t, http.StatusNotFound, missing.Code)
+	// the actor of clients other than the proxy is their address
+	assert.Equal(t, "192.168.1.5", missing.Actor)
+	assert.Empty(t, missing.Added)
+	assert.Empty(t, deleted.Added)
+	assert.Equal(t, []string{"b:9100"}, deleted.Removed[0].Targets)
+
+	dbService, err = db.New("testdb", "")
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/audit", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func Test_expiredTargets(t *testing.T) {
+	var err error
+	dbService, err = db.New("memory", "")
+	assert.NoError(t, err)
+	router := setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/api/target/", strings.NewReader(`{"name": "loadtest", "ttl": "100ms", "entries": [{"targets": "a:9100", "labels": "env=load"}]}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/api/target/loadtest", nil)
+	router.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), `"expires_at"`)
+
+	time.Sleep(150 * time.Millisecond)
+	for _, url := range []string{"/prom-target/loadtest", "/api/target/loadtest"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, url, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code, url)
+	}
+	// the expired error doesn't become the text of every later not found error
+	assert.Equal(t, "Target was not found", db.ErrNotFound.Text)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/api/targets/", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "loadtest")
+}
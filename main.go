@@ -1,12 +1,26 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net"
+	"os"
 	"promhsd/db"
 	_ "promhsd/docs"
+	_ "promhsd/storage/bolt"
+	_ "promhsd/storage/consul"
 	_ "promhsd/storage/dynamo"
+	_ "promhsd/storage/etcd"
 	_ "promhsd/storage/file"
+	_ "promhsd/storage/git"
+	_ "promhsd/storage/kubernetes"
+	_ "promhsd/storage/memory"
 	_ "promhsd/storage/mongo"
+	_ "promhsd/storage/postgres"
+	_ "promhsd/storage/redis"
+	_ "promhsd/storage/s3"
+	_ "promhsd/storage/sqlite"
+	"time"
 )
 
 // @title        PromHSD
@@ -24,16 +38,89 @@ import (
 
 var (
 	dbService *db.Service
+	// requireIfMatch rejects updates which don't tell the revision they replace
+	requireIfMatch bool
+	// trustedProxies may tell the actor and the client address in headers
+	trustedProxies []*net.IPNet
 )
 
 func main() {
-	var err error
-	storage := getStorage()
-	storageArgs := getStorageArgs(storage)
-	dbService, err = db.New(storage, storageArgs)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:], os.Stdout))
+	}
+	requireIfMatch = getBool(envIfMatch)
+	proxies, err := getTrustedProxies()
+	if err != nil {
+		log.Fatal("Can't read trusted proxies: ", err)
+	}
+	trustedProxies = proxies
+	storage, err := openStorage(getStorage())
+	if err != nil {
+		log.Fatal("Can't initialize dbService: ", err)
+	}
+	history, err := getHistory()
+	if err != nil {
+		log.Fatal("Can't open history: ", err)
+	}
+	options := []db.Option{db.WithTimeouts(getTimeouts()), db.WithHistory(history), db.WithCache(getDuration(envCacheTTL, 0))}
+	snapshots, err := getSnapshots()
+	if err != nil {
+		log.Fatal("Can't create the snapshot directory: ", err)
+	}
+	if snapshots != nil {
+		options = append(options, snapshots)
+	}
+	webhooks, err := getWebhooks()
+	if err != nil {
+		log.Fatal("Can't configure webhooks: ", err)
+	}
+	if webhooks != nil {
+		options = append(options, db.WithWebhooks(webhooks))
+	}
+	audit, err := getAudit(storage)
 	if err != nil {
-		log.Fatal("Can't initialize dbService")
+		log.Fatal("Can't open audit log: ", err)
+	}
+	if audit != nil {
+		options = append(options, db.WithAudit(audit))
+	}
+	trash, retention, err := getTrash()
+	if err != nil {
+		log.Fatal("Can't open trash: ", err)
+	}
+	if trash != nil {
+		options = append(options, db.WithTrash(trash, retention))
+	}
+	dbService = db.NewService(storage, options...)
+	if trash != nil {
+		go purgeTrash(purgeInterval)
+	}
+	go watchStorage(getDuration(envWatchPoll, defaultWatchPoll))
+	go dbService.Reap(context.Background(), getDuration(envReapInterval, defaultReapInterval))
+	if mirror, ok := storage.(*db.Mirror); ok {
+		go mirror.Resync(context.Background(), getDuration(envReconcile, defaultReconcile))
 	}
 	r := setupRouter()
 	r.Run()
 }
+
+// purgeTrash removes targets which have been deleted longer than the retention ago.
+func purgeTrash(interval time.Duration) {
+	for range time.Tick(interval) {
+		purged, err := dbService.PurgeExpired(context.Background())
+		if err != nil {
+			log.Println("Failed to purge the trash:", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("%d deleted targets were purged\n", purged)
+		}
+	}
+}
+
+// watchStorage follows changes made by other replicas, so that they reach subscribers and the cache.
+func watchStorage(pollInterval time.Duration) {
+	if err := dbService.Watch(context.Background(), pollInterval); err != nil {
+		log.Println("Changes of the storage aren't watched:", err)
+	}
+}
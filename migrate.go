@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"promhsd/db"
+	"strings"
+)
+
+const migrateUsage = `Usage: promhsd migrate --from <storage>:<args> --to <storage>:<args> [--dry-run]
+
+Copies every target from one storage to another, e.g.
+  promhsd migrate --from filedb:/data/db.json --to mongodb:mongodb://localhost:27017/promhsd
+`
+
+type migrateReport struct {
+	Copied    int
+	Conflicts int
+	Failed    int
+}
+
+// parseStorageSpec splits "filedb:/data/db.json" into the storage ID and its arguments.
+func parseStorageSpec(spec string) (string, string, error) {
+	id, args, ok := strings.Cut(spec, ":")
+	if !ok || id == "" {
+		return "", "", fmt.Errorf("storage should be given as <storage>:<args>, got %q", spec)
+	}
+	return id, args, nil
+}
+
+func openStorageSpec(spec string) (db.Storage, error) {
+	id, args, err := parseStorageSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return db.NewStorage(id, args)
+}
+
+// migrate copies all targets of from into to with their IDs and revisions, targets which already exist in to
+// are reported as conflicts. A destination which isn't a db.Importer can only keep IDs equal to the names.
+// With dryRun nothing is written, existing targets are still reported.
+func migrate(ctx context.Context, from, to db.Storage, dryRun bool, out io.Writer) (migrateReport, error) {
+	report := migrateReport{}
+	targets := []db.Target{}
+	if err := from.GetAll(ctx, &db.ListQuery{}, &targets); err != nil {
+		return report, err
+	}
+	_, importer := to.(db.Importer)
+	for i := range targets {
+		target := &targets[i]
+		id := target.ID
+		if dryRun {
+			// the target is looked up by the ID it would be stored with
+			err := to.Get(ctx, &db.Target{ID: id})
+			var notFound *db.NotFoundError
+			switch {
+			case !importer && id != db.ID(target.Name):
+				report.Failed++
+				fmt.Fprintf(out, "failed %s: the destination can't keep the ID, it differs from the name %s\n", id, target.Name)
+			case err == nil:
+				report.Conflicts++
+				fmt.Fprintf(out, "conflict %s: exists in the destination\n", id)
+			case errors.As(err, &notFound):
+				report.Copied++
+				fmt.Fprintf(out, "would copy %s\n", id)
+			default:
+				report.Failed++
+				fmt.Fprintf(out, "failed %s: %s\n", id, err)
+			}
+			continue
+		}
+		err := db.Import(ctx, to, target)
+		var conflict *db.ConflictError
+		switch {
+		case err == nil:
+			report.Copied++
+			fmt.Fprintf(out, "copied %s\n", id)
+		case errors.As(err, &conflict):
+			report.Conflicts++
+			fmt.Fprintf(out, "conflict %s: exists in the destination\n", id)
+		default:
+			report.Failed++
+			fmt.Fprintf(out, "failed %s: %s\n", id, err)
+		}
+	}
+	return report, nil
+}
+
+// runMigrate is the migrate subcommand, it returns the exit code.
+func runMigrate(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() { fmt.Fprint(out, migrateUsage) }
+	fromSpec := flags.String("from", "", "source storage")
+	toSpec := flags.String("to", "", "destination storage")
+	dryRun := flags.Bool("dry-run", false, "show what would be copied")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *fromSpec == "" || *toSpec == "" {
+		flags.Usage()
+		return 2
+	}
+	from, err := openStorageSpec(*fromSpec)
+	if err != nil {
+		fmt.Fprintln(out, "Can't open the source storage:", err)
+		return 1
+	}
+	to, err := openStorageSpec(*toSpec)
+	if err != nil {
+		fmt.Fprintln(out, "Can't open the destination storage:", err)
+		return 1
+	}
+	report, err := migrate(context.Background(), from, to, *dryRun, out)
+	if err != nil {
+		fmt.Fprintln(out, "Can't read targets from the source storage:", err)
+		return 1
+	}
+	verb := "copied"
+	if *dryRun {
+		verb = "would be copied"
+	}
+	fmt.Fprintf(out, "%d %s, %d conflicts, %d failed\n", report.Copied, verb, report.Conflicts, report.Failed)
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
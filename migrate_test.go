@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"promhsd/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMigrateTarget(name string) *db.Target {
+	t := db.NewTarget()
+	t.Name = name
+	entry := db.NewEntry()
+	entry.Targets = []string{"127.0.0.1:9100"}
+	entry.Labels["env"] = name
+	t.Entries = append(t.Entries, *entry)
+	return t
+}
+
+func newMigrateStorage(t *testing.T, names ...string) (db.Storage, string) {
+	spec := "filedb:" + filepath.Join(t.TempDir(), "db.json")
+	storage, err := openStorageSpec(spec)
+	require.NoError(t, err)
+	for _, name := range names {
+		require.NoError(t, storage.Create(context.Background(), newMigrateTarget(name)))
+	}
+	return storage, spec
+}
+
+func Test_parseStorageSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		wantID   string
+		wantArgs string
+		wantErr  bool
+	}{
+		{
+			name:     "file",
+			spec:     "filedb:/data/db.json",
+			wantID:   "filedb",
+			wantArgs: "/data/db.json",
+		},
+		{
+			name:     "uri",
+			spec:     "mongodb:mongodb://localhost:27017/promhsd",
+			wantID:   "mongodb",
+			wantArgs: "mongodb://localhost:27017/promhsd",
+		},
+		{
+			name:    "noArgs",
+			spec:    "mongodb",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, args, err := parseStorageSpec(tt.spec)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.wantID, id)
+			assert.Equal(t, tt.wantArgs, args)
+		})
+	}
+}
+
+func Test_migrate(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+		want   migrateReport
+		stored []db.ID
+	}{
+		{
+			name:   "copy",
+			want:   migrateReport{Copied: 2, Conflicts: 1},
+			stored: []db.ID{"a", "b", "c"},
+		},
+		{
+			name:   "dryRun",
+			dryRun: true,
+			want:   migrateReport{Copied: 2, Conflicts: 1},
+			stored: []db.ID{"b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, _ := newMigrateStorage(t, "a", "b", "c")
+			to, _ := newMigrateStorage(t, "b")
+			out := &bytes.Buffer{}
+			report, err := migrate(context.Background(), from, to, tt.dryRun, out)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, report)
+			assert.Contains(t, out.String(), "conflict b")
+
+			list := []db.Target{}
+			require.NoError(t, to.GetAll(context.Background(), &db.ListQuery{}, &list))
+			ids := []db.ID{}
+			for _, target := range list {
+				ids = append(ids, target.ID)
+			}
+			assert.Equal(t, tt.stored, ids)
+		})
+	}
+}
+
+// createStorage is a destination which can only create targets, it isn't a db.Importer.
+type createStorage struct {
+	db.Storage
+}
+
+func Test_migrateKeepsID(t *testing.T) {
+	from, _ := newMigrateStorage(t)
+	target := newMigrateTarget("renamed")
+	target.ID = "a"
+	target.Revision = 3
+	require.NoError(t, from.(db.Importer).Import(context.Background(), target))
+
+	for _, dryRun := range []bool{true, false} {
+		to, _ := newMigrateStorage(t)
+		report, err := migrate(context.Background(), from, createStorage{to}, dryRun, &bytes.Buffer{})
+		require.NoError(t, err)
+		// the ID can't be kept by Create, the dry run tells it like the real one
+		assert.Equal(t, migrateReport{Failed: 1}, report)
+
+		report, err = migrate(context.Background(), from, to, dryRun, &bytes.Buffer{})
+		require.NoError(t, err)
+		assert.Equal(t, migrateReport{Copied: 1}, report)
+		got := &db.Target{ID: "a"}
+		err = to.Get(context.Background(), got)
+		if dryRun {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, "renamed", got.Name)
+		assert.Equal(t, int64(3), got.Revision)
+
+		// the dry run looks the target up by the same ID the copy used
+		report, err = migrate(context.Background(), from, to, true, &bytes.Buffer{})
+		require.NoError(t, err)
+		assert.Equal(t, migrateReport{Conflicts: 1}, report)
+	}
+}
+
+func Test_runMigrate(t *testing.T) {
+	_, from := newMigrateStorage(t, "a")
+	_, to := newMigrateStorage(t)
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{
+			name: "noDestination",
+			args: []string{"--from", from},
+			want: 2,
+		},
+		{
+			name: "unknownStorage",
+			args: []string{"--from", "unknown:args", "--to", to},
+			want: 1,
+		},
+		{
+			name: "copied",
+			args: []string{"--from", from, "--to", to},
+			want: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, runMigrate(tt.args, &bytes.Buffer{}))
+		})
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"io/fs"
 	"net/http"
+	"promhsd/db"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
@@ -18,6 +20,8 @@ var staticAssets embed.FS
 func setupRouter() *gin.Engine {
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"*"}
+	// clients of other origins read the revision to send it back in If-Match
+	config.ExposeHeaders = []string{"ETag"}
 	assets, err := fs.Sub(staticAssets, "assets")
 	if err != nil {
 		fmt.Println("build folder is not readable")
@@ -25,6 +29,15 @@ func setupRouter() *gin.Engine {
 	}
 	assetsFS := http.FS(assets)
 	router := gin.Default()
+	proxies := make([]string, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		proxies = append(proxies, proxy.String())
+	}
+	// X-Forwarded-For of other clients isn't taken as their address
+	if err := router.SetTrustedProxies(proxies); err != nil {
+		fmt.Println("trusted proxies are invalid:", err)
+		return nil
+	}
 	router.Use(cors.New(config))
 	router.GET("/", func(c *gin.Context) {
 		c.Redirect(http.StatusTemporaryRedirect, "/assets/index.html")
@@ -32,15 +45,26 @@ func setupRouter() *gin.Engine {
 	router.StaticFS("/assets/", assetsFS)
 	router.GET("/prom-target/:id", prometheusHandler)
 	router.GET("/health/", healthHandler)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	api := router.Group("/api")
 	{
 		auth := api.Group("/")
 		{
-			auth.POST("/target/", createTargetHandler)
+			auth.POST("/target/", audited(db.ActionCreate), createTargetHandler)
 			auth.GET("/target/:id", getTargetHandler)
-			auth.POST("/target/:id", updateTargetHandler)
-			auth.DELETE("/target/:id", removeTargetHandler)
+			auth.POST("/target/:id", audited(db.ActionUpdate), updateTargetHandler)
+			auth.DELETE("/target/:id", audited(db.ActionDelete), removeTargetHandler)
 			auth.GET("/targets/", getTargetsHandler)
+			auth.GET("/target/:id/history", getHistoryHandler)
+			auth.GET("/target/:id/diff", diffHistoryHandler)
+			auth.POST("/target/:id/rollback/:version", rollbackTargetHandler)
+			auth.GET("/trash/", getDeletedTargetsHandler)
+			auth.DELETE("/trash/", purgeTrashHandler)
+			auth.POST("/trash/:id/restore", restoreTargetHandler)
+			auth.DELETE("/trash/:id", purgeTargetHandler)
+			auth.GET("/events", eventsHandler)
+			auth.GET("/webhooks/deliveries", getDeliveriesHandler)
+			auth.GET("/audit", getAuditHandler)
 		}
 
 	}
@@ -0,0 +1,324 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"promhsd/db"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	StorageID   = "bolt"
+	openTimeout = 10 * time.Second
+)
+
+var (
+	bucketName = []byte("targets")
+	// namesBucket keys IDs of targets by their name and ID, so that a cursor walks them in the order they are listed
+	namesBucket = []byte("names")
+	// auditBucket keys records by their time and a sequence, so that a cursor walks them in time order
+	auditBucket = []byte("audit")
+)
+
+type BoltDB struct {
+	db *bolt.DB
+}
+
+// nameKey separates the name from the ID by a byte which sorts before any other,
+// so that keys sort like the names and then the IDs.
+func nameKey(name string, id db.ID) []byte {
+	return []byte(name + "\x00" + id.String())
+}
+
+// IsHealthy opens a read-only transaction, it doesn't wait for the writer lock.
+func (b *BoltDB) IsHealthy(ctx context.Context) bool {
+	if b.db.IsReadOnly() {
+		log.Println("Database is opened read-only")
+		return false
+	}
+	err := b.view(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketName) == nil {
+			return errors.New("bucket is missing")
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("View returns error:", err.Error())
+		return false
+	}
+	return true
+}
+
+// update runs fn in a read-write transaction unless ctx was done while the writer lock was waited for,
+// bolt can't be interrupted, so ctx is checked once the transaction begins.
+func (b *BoltDB) update(ctx context.Context, fn func(*bolt.Tx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// view is update for read-only transactions.
+func (b *BoltDB) view(ctx context.Context, fn func(*bolt.Tx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+func (b *BoltDB) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return b.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (b *BoltDB) Import(ctx context.Context, target *db.Target) error {
+	value, err := json.Marshal(target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		key := []byte(target.ID.String())
+		if bucket.Get(key) != nil {
+			return db.ErrConflict
+		}
+		if err := tx.Bucket(namesBucket).Put(nameKey(target.Name, target.ID), key); err != nil {
+			return err
+		}
+		return bucket.Put(key, value)
+	})
+}
+
+func (b *BoltDB) Update(ctx context.Context, target *db.Target) error {
+	next := *target
+	next.Revision++
+	value, err := json.Marshal(&next)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	err = b.update(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		key := []byte(target.ID.String())
+		current := bucket.Get(key)
+		if current == nil {
+			return db.ErrNotFound
+		}
+		var stored db.Target
+		if err := json.Unmarshal(current, &stored); err != nil {
+			return &db.StorageError{Text: "Couldn't decode json", Err: err}
+		}
+		if stored.Revision != target.Revision {
+			return db.ErrConflict
+		}
+		if stored.Name != next.Name {
+			names := tx.Bucket(namesBucket)
+			if err := names.Delete(nameKey(stored.Name, stored.ID)); err != nil {
+				return err
+			}
+			if err := names.Put(nameKey(next.Name, next.ID), key); err != nil {
+				return err
+			}
+		}
+		return bucket.Put(key, value)
+	})
+	if err != nil {
+		return err
+	}
+	target.Revision = next.Revision
+	return nil
+}
+
+func (b *BoltDB) Delete(ctx context.Context, target *db.Target) error {
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketName)
+		key := []byte(target.ID.String())
+		current := bucket.Get(key)
+		if current == nil {
+			return db.ErrNotFound
+		}
+		var stored db.Target
+		if err := json.Unmarshal(current, &stored); err != nil {
+			return &db.StorageError{Text: "Couldn't decode json", Err: err}
+		}
+		if err := tx.Bucket(namesBucket).Delete(nameKey(stored.Name, target.ID)); err != nil {
+			return err
+		}
+		return bucket.Delete(key)
+	})
+}
+
+func (b *BoltDB) Get(ctx context.Context, target *db.Target) error {
+	return b.view(ctx, func(tx *bolt.Tx) error {
+		value := tx.Bucket(bucketName).Get([]byte(target.ID.String()))
+		if value == nil {
+			return db.ErrNotFound
+		}
+		err := json.Unmarshal(value, target)
+		if err != nil {
+			return &db.StorageError{Text: "Couldn't decode json", Err: err}
+		}
+		return nil
+	})
+}
+
+// GetAll walks the names bucket starting from the cursor when targets are sorted by name,
+// the walk stops early when the page is full. Targets sorted by time are all read.
+func (b *BoltDB) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	return b.view(ctx, func(tx *bolt.Tx) error {
+		targets := []db.Target{}
+		bucket := tx.Bucket(bucketName)
+		add := func(value []byte) error {
+			// a long walk stops once ctx is done
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var target db.Target
+			if err := json.Unmarshal(value, &target); err != nil {
+				return &db.StorageError{Text: "Couldn't decode json", Err: err}
+			}
+			if query.Match(&target) && query.IsAfter(&target) {
+				targets = append(targets, target)
+			}
+			return nil
+		}
+		if query.SortBy == db.SortByTime {
+			if err := bucket.ForEach(func(_, value []byte) error { return add(value) }); err != nil {
+				return err
+			}
+			*list = query.Apply(targets)
+			return nil
+		}
+		c := tx.Bucket(namesBucket).Cursor()
+		key, id := c.First()
+		if query.After != nil {
+			key, id = c.Seek(nameKey(query.After.Name, query.After.ID))
+		}
+		for ; key != nil; key, id = c.Next() {
+			if query.Limit > 0 && len(targets) == query.Limit {
+				break
+			}
+			if err := add(bucket.Get(id)); err != nil {
+				return err
+			}
+		}
+		*list = query.Apply(targets)
+		return nil
+	})
+}
+
+// auditKey is the big endian time of the record in nanoseconds followed by seq.
+func auditKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func (b *BoltDB) WriteAudit(ctx context.Context, record *db.AuditRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	return b.update(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		return bucket.Put(auditKey(record.Time, seq), value)
+	})
+}
+
+// QueryAudit seeks the first record from query.From and stops after query.To.
+func (b *BoltDB) QueryAudit(ctx context.Context, query *db.AuditQuery, records *[]db.AuditRecord) error {
+	return b.view(ctx, func(tx *bolt.Tx) error {
+		c := tx.Bucket(auditBucket).Cursor()
+		key, value := c.First()
+		if !query.From.IsZero() {
+			key, value = c.Seek(auditKey(query.From, 0))
+		}
+		result := []db.AuditRecord{}
+		for ; key != nil; key, value = c.Next() {
+			var record db.AuditRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return &db.StorageError{Text: "Couldn't decode json", Err: err}
+			}
+			if !query.To.IsZero() && record.Time.After(query.To) {
+				break
+			}
+			result = append(result, record)
+		}
+		*records = result
+		return nil
+	})
+}
+
+// createBucket creates the buckets, the names bucket is filled in for databases of older versions.
+func (b *BoltDB) createBucket() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists(auditBucket); err != nil {
+			return err
+		}
+		if tx.Bucket(namesBucket) != nil {
+			return nil
+		}
+		names, err := tx.CreateBucket(namesBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var target db.Target
+			if err := json.Unmarshal(value, &target); err != nil {
+				return &db.StorageError{Text: "Couldn't decode json", Err: err}
+			}
+			return names.Put(nameKey(target.Name, db.ID(key)), key)
+		})
+	})
+}
+
+type StorageService struct{}
+
+func (s *StorageService) ServiceID() string {
+	return StorageID
+}
+
+func (s *StorageService) New(path string) (db.Storage, error) {
+	conn, err := bolt.Open(path, 0644, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		log.Println(err)
+		return nil, &db.StorageError{Text: "Couldn't open database", Err: err}
+	}
+	db := &BoltDB{db: conn}
+	err = db.createBucket()
+	if err != nil {
+		conn.Close()
+		log.Println(err)
+		return nil, err
+	}
+	return db, nil
+}
+
+func init() {
+	db.RegisterStorage(&StorageService{})
+}
+
+var (
+	_ db.Storage    = (*BoltDB)(nil)
+	_ db.Importer   = (*BoltDB)(nil)
+	_ db.AuditStore = (*BoltDB)(nil)
+)
@@ -0,0 +1,126 @@
+package bolt
+
+import (
+	"context"
+	"path/filepath"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestDB(t *testing.T) *BoltDB {
+	service := StorageService{}
+	storage, err := service.New(filepath.Join(t.TempDir(), "promhsd.bolt"))
+	assert.NoError(t, err)
+	b := storage.(*BoltDB)
+	t.Cleanup(func() { b.db.Close() })
+	return b
+}
+
+func TestBoltDB_IsHealthy(t *testing.T) {
+	b := newTestDB(t)
+	assert.True(t, b.IsHealthy(context.Background()))
+	path := b.db.Path()
+	b.db.Close()
+	assert.False(t, b.IsHealthy(context.Background()))
+
+	conn, err := bolt.Open(path, 0644, &bolt.Options{ReadOnly: true})
+	assert.NoError(t, err)
+	defer conn.Close()
+	readOnly := &BoltDB{db: conn}
+	assert.False(t, readOnly.IsHealthy(context.Background()))
+}
+
+func TestBoltDB_context(t *testing.T) {
+	b := newTestDB(t)
+	assert.NoError(t, b.Create(context.Background(), &db.Target{Name: "test"}))
+	// a running write doesn't hold the health check
+	tx, err := b.db.Begin(true)
+	assert.NoError(t, err)
+	assert.True(t, b.IsHealthy(context.Background()))
+	tx.Rollback()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, b.Get(ctx, &db.Target{ID: "test"}), context.Canceled)
+	assert.ErrorIs(t, b.Update(ctx, &db.Target{ID: "test", Name: "test", Revision: db.FirstRevision}), context.Canceled)
+	list := []db.Target{}
+	assert.ErrorIs(t, b.GetAll(ctx, &db.ListQuery{}, &list), context.Canceled)
+}
+
+func TestNew_fillsNames(t *testing.T) {
+	// databases of older versions have only the targets bucket
+	path := filepath.Join(t.TempDir(), "old.bolt")
+	conn, err := bolt.Open(path, 0644, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket(bucketName)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("old"), []byte(`{"id":"old","name":"renamed","entries":[]}`))
+	}))
+	assert.NoError(t, conn.Close())
+
+	service := StorageService{}
+	storage, err := service.New(path)
+	assert.NoError(t, err)
+	defer storage.(*BoltDB).db.Close()
+	list := []db.Target{}
+	assert.NoError(t, storage.GetAll(context.Background(), &db.ListQuery{NamePrefix: "re"}, &list))
+	assert.Len(t, list, 1)
+}
+
+func TestNew(t *testing.T) {
+	type args struct {
+		path string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "testFile",
+			args: args{
+				path: filepath.Join(t.TempDir(), "test.bolt"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "filenameWrong",
+			args: args{
+				path: filepath.Join("dirNotExist", "wrong.bolt"),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := StorageService{}
+			got, err := service.New(tt.args.path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, got)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotNil(t, got)
+		})
+	}
+}
+
+func TestBoltDB_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		return newTestDB(t)
+	})
+}
+
+func TestBoltDB_Audit(t *testing.T) {
+	storagetest.RunAudit(t, func(t *testing.T) db.Storage {
+		return newTestDB(t)
+	})
+}
@@ -0,0 +1,210 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"promhsd/db"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	StorageID     = "consul"
+	defaultPrefix = "promhsd/targets/"
+	prefixParam   = "prefix"
+)
+
+type Consul struct {
+	kv     *api.KV
+	status *api.Status
+	prefix string
+}
+
+func (c *Consul) key(id db.ID) string {
+	return c.prefix + id.String()
+}
+
+// IsHealthy reports whether the agent is reachable and the cluster has a leader.
+func (c *Consul) IsHealthy(ctx context.Context) bool {
+	leader, err := c.status.LeaderWithQueryOptions((&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		log.Println("Leader returns error:", err.Error())
+		return false
+	}
+	if leader == "" {
+		log.Println("Consul cluster has no leader")
+		return false
+	}
+	return true
+}
+
+func (c *Consul) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return c.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (c *Consul) Import(ctx context.Context, target *db.Target) error {
+	value, err := json.Marshal(target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	// ModifyIndex 0 makes CAS succeed only if the key doesn't exist
+	ok, _, err := c.kv.CAS(&api.KVPair{Key: c.key(target.ID), Value: value}, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		log.Println("Failed to Create the target:", err)
+		return err
+	}
+	if !ok {
+		return db.ErrConflict
+	}
+	return nil
+}
+
+func (c *Consul) Update(ctx context.Context, target *db.Target) error {
+	next := *target
+	next.Revision++
+	value, err := json.Marshal(&next)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	pair, _, err := c.kv.Get(c.key(target.ID), (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		log.Println("Failed to Get the target:", err)
+		return err
+	}
+	if pair == nil {
+		return db.ErrNotFound
+	}
+	var stored db.Target
+	if err := json.Unmarshal(pair.Value, &stored); err != nil {
+		return &db.StorageError{Text: "Couldn't decode json", Err: err}
+	}
+	if stored.Revision != target.Revision {
+		return db.ErrConflict
+	}
+	pair.Value = value
+	ok, _, err := c.kv.CAS(pair, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		log.Println("Failed to Update the target:", err)
+		return err
+	}
+	if !ok {
+		return db.ErrConflict
+	}
+	target.Revision = next.Revision
+	return nil
+}
+
+func (c *Consul) Delete(ctx context.Context, target *db.Target) error {
+	pair, _, err := c.kv.Get(c.key(target.ID), (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		log.Println("Failed to Get the target:", err)
+		return err
+	}
+	if pair == nil {
+		return db.ErrNotFound
+	}
+	ok, _, err := c.kv.DeleteCAS(pair, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		log.Println("Failed to Delete the target:", err)
+		return err
+	}
+	if !ok {
+		return db.ErrConflict
+	}
+	return nil
+}
+
+func (c *Consul) Get(ctx context.Context, target *db.Target) error {
+	pair, _, err := c.kv.Get(c.key(target.ID), (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		log.Println("Failed to Get the target:", err)
+		return err
+	}
+	if pair == nil {
+		return db.ErrNotFound
+	}
+	err = json.Unmarshal(pair.Value, target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't decode json", Err: err}
+	}
+	return nil
+}
+
+func (c *Consul) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	pairs, _, err := c.kv.List(c.key(""), (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		log.Println("Failed to GetAll targets:", err)
+		return err
+	}
+	targets := make([]db.Target, 0, len(pairs))
+	for _, pair := range pairs {
+		var target db.Target
+		err = json.Unmarshal(pair.Value, &target)
+		if err != nil {
+			return &db.StorageError{Text: "Couldn't decode json", Err: err}
+		}
+		targets = append(targets, target)
+	}
+	*list = query.Apply(targets)
+	return nil
+}
+
+// parseArgs builds client config from the agent address,
+// e.g. "http://consul:8500?prefix=promhsd/targets/".
+// Empty address falls back to CONSUL_HTTP_ADDR and the rest of CONSUL_* variables.
+func parseArgs(args string) (*api.Config, string, error) {
+	config := api.DefaultConfig()
+	u, err := url.Parse(args)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Host != "" {
+		config.Address = u.Host
+		config.Scheme = u.Scheme
+	}
+	prefix := u.Query().Get(prefixParam)
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	prefix = strings.TrimPrefix(prefix, "/")
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return config, prefix, nil
+}
+
+type StorageService struct{}
+
+func (s *StorageService) ServiceID() string {
+	return StorageID
+}
+
+func (s *StorageService) New(args string) (db.Storage, error) {
+	config, prefix, err := parseArgs(args)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	db := &Consul{kv: client.KV(), status: client.Status(), prefix: prefix}
+	return db, nil
+}
+
+func init() {
+	db.RegisterStorage(&StorageService{})
+}
+
+var (
+	_ db.Storage  = (*Consul)(nil)
+	_ db.Importer = (*Consul)(nil)
+)
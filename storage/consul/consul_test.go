@@ -0,0 +1,162 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// testConsul is a stand-in for the parts of Consul HTTP API the storage uses.
+type testConsul struct {
+	mu     sync.Mutex
+	index  uint64
+	kv     map[string]*api.KVPair
+	leader string
+}
+
+func (c *testConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", strconv.FormatBool(c.leader != ""))
+	if r.URL.Path == "/v1/status/leader" {
+		json.NewEncoder(w).Encode(c.leader)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		pairs := []*api.KVPair{}
+		for k, pair := range c.kv {
+			if k == key || (query.Has("recurse") && strings.HasPrefix(k, key)) {
+				pairs = append(pairs, pair)
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+		json.NewEncoder(w).Encode(pairs)
+	case http.MethodPut:
+		value, _ := io.ReadAll(r.Body)
+		pair, exists := c.kv[key]
+		if query.Has("cas") {
+			cas, _ := strconv.ParseUint(query.Get("cas"), 10, 64)
+			if (cas == 0 && exists) || (cas != 0 && (!exists || pair.ModifyIndex != cas)) {
+				json.NewEncoder(w).Encode(false)
+				return
+			}
+		}
+		c.index++
+		if !exists {
+			pair = &api.KVPair{Key: key, CreateIndex: c.index}
+			c.kv[key] = pair
+		}
+		pair.Value = value
+		pair.ModifyIndex = c.index
+		json.NewEncoder(w).Encode(true)
+	case http.MethodDelete:
+		pair, exists := c.kv[key]
+		if query.Has("cas") {
+			cas, _ := strconv.ParseUint(query.Get("cas"), 10, 64)
+			if !exists || pair.ModifyIndex != cas {
+				json.NewEncoder(w).Encode(false)
+				return
+			}
+		}
+		c.index++
+		delete(c.kv, key)
+		json.NewEncoder(w).Encode(true)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestDB(t *testing.T) (*Consul, *testConsul) {
+	fake := &testConsul{kv: map[string]*api.KVPair{}, leader: "127.0.0.1:8300"}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	service := StorageService{}
+	storage, err := service.New(server.URL + "?prefix=test")
+	assert.NoError(t, err)
+	c := storage.(*Consul)
+	return c, fake
+}
+
+func TestConsul_keyPrefix(t *testing.T) {
+	c, fake := newTestDB(t)
+	assert.NoError(t, c.Create(context.Background(), &db.Target{Name: "test"}))
+	assert.Contains(t, fake.kv, "test/test")
+}
+
+func TestConsul_IsHealthy(t *testing.T) {
+	c, fake := newTestDB(t)
+	assert.True(t, c.IsHealthy(context.Background()))
+	fake.mu.Lock()
+	fake.leader = ""
+	fake.mu.Unlock()
+	assert.False(t, c.IsHealthy(context.Background()))
+}
+
+func Test_parseArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        string
+		wantAddress string
+		wantScheme  string
+		wantPrefix  string
+	}{
+		{
+			name:        "defaultPrefix",
+			args:        "https://consul:8501",
+			wantAddress: "consul:8501",
+			wantScheme:  "https",
+			wantPrefix:  defaultPrefix,
+		},
+		{
+			name:        "customPrefix",
+			args:        "http://consul:8500?prefix=/team1",
+			wantAddress: "consul:8500",
+			wantScheme:  "http",
+			wantPrefix:  "team1/",
+		},
+		{
+			name:        "defaultAddress",
+			args:        "",
+			wantAddress: api.DefaultConfig().Address,
+			wantScheme:  api.DefaultConfig().Scheme,
+			wantPrefix:  defaultPrefix,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, prefix, err := parseArgs(tt.args)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantAddress, config.Address)
+			assert.Equal(t, tt.wantScheme, config.Scheme)
+			assert.Equal(t, tt.wantPrefix, prefix)
+		})
+	}
+}
+
+func TestConsul_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		storage, _ := newTestDB(t)
+		return storage
+	})
+}
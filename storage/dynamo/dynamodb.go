@@ -1,43 +1,82 @@
 package dynamo
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"promhsd/db"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
 )
 
 const (
 	StorageID = "dynamodb"
+	// streamInterval is how often shards of the stream are read.
+	streamInterval = time.Second
+	// ttlAttribute holds the expiry of a target in epoch seconds, DynamoDB deletes expired items by itself.
+	ttlAttribute = "ttl"
+	// ttlAttempts and ttlBackoff wait for a new table to become active before its TTL is enabled.
+	ttlAttempts = 10
+	ttlBackoff  = 3 * time.Second
+	// listAttribute has the same value in every item, it is the partition key of the indexes which
+	// keep targets in order, so that a page is read with a query instead of a scan of the table.
+	listAttribute = "list"
+	listValue     = "target"
+	byNameIndex   = "by-name"
+	byTimeIndex   = "by-time"
+	// nameKeyAttribute orders items of byNameIndex by name, ties are broken by ID.
+	nameKeyAttribute = "name_key"
+	// timeKeyAttribute orders items of byTimeIndex by time, ties are broken by ID.
+	timeKeyAttribute = "time_key"
+	timeKeyLayout    = "2006-01-02T15:04:05.000000000Z"
 )
 
 type ICreateTable interface {
-	CreateTable(*dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error)
+	CreateTableWithContext(aws.Context, *dynamodb.CreateTableInput, ...request.Option) (*dynamodb.CreateTableOutput, error)
 }
 
 type IDescribeTable interface {
-	DescribeTable(*dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error)
+	DescribeTableWithContext(aws.Context, *dynamodb.DescribeTableInput, ...request.Option) (*dynamodb.DescribeTableOutput, error)
 }
 
 type IGetItem interface {
-	GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	GetItemWithContext(aws.Context, *dynamodb.GetItemInput, ...request.Option) (*dynamodb.GetItemOutput, error)
 }
 
 type IPutItem interface {
-	PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	PutItemWithContext(aws.Context, *dynamodb.PutItemInput, ...request.Option) (*dynamodb.PutItemOutput, error)
 }
 
 type IDeleteItem interface {
-	DeleteItem(*dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
+	DeleteItemWithContext(aws.Context, *dynamodb.DeleteItemInput, ...request.Option) (*dynamodb.DeleteItemOutput, error)
 }
 
 type IScan interface {
-	Scan(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error)
+	ScanWithContext(aws.Context, *dynamodb.ScanInput, ...request.Option) (*dynamodb.ScanOutput, error)
+}
+
+type IQuery interface {
+	QueryWithContext(aws.Context, *dynamodb.QueryInput, ...request.Option) (*dynamodb.QueryOutput, error)
+}
+
+type IStreams interface {
+	DescribeStreamWithContext(aws.Context, *dynamodbstreams.DescribeStreamInput, ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIteratorWithContext(aws.Context, *dynamodbstreams.GetShardIteratorInput, ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecordsWithContext(aws.Context, *dynamodbstreams.GetRecordsInput, ...request.Option) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+type ITimeToLive interface {
+	DescribeTimeToLiveWithContext(aws.Context, *dynamodb.DescribeTimeToLiveInput, ...request.Option) (*dynamodb.DescribeTimeToLiveOutput, error)
+	UpdateTimeToLiveWithContext(aws.Context, *dynamodb.UpdateTimeToLiveInput, ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error)
 }
 
 type DynamoDB struct {
@@ -47,16 +86,24 @@ type DynamoDB struct {
 	IPutItem
 	IDeleteItem
 	IScan
+	IQuery
+	IStreams
+	ITimeToLive
 	tableName string
+	// indexed tells that the table has the indexes of listAttribute, tables created
+	// by older versions don't have them and are scanned
+	indexed bool
+	// expires tells that TTL of the table is on
+	expires bool
 	// svc       *dynamodb.DynamoDB
 }
 
-func (d *DynamoDB) IsHealthy() bool {
+func (d *DynamoDB) IsHealthy(ctx context.Context) bool {
 	input := &dynamodb.DescribeTableInput{
 		TableName: aws.String(d.tableName),
 	}
 
-	result, err := d.DescribeTable(input)
+	result, err := d.DescribeTableWithContext(ctx, input)
 	if err != nil {
 		log.Println("DescribeTable returns error:", err.Error())
 		return false
@@ -69,41 +116,81 @@ func (d *DynamoDB) IsHealthy() bool {
 
 }
 
-func (d *DynamoDB) Create(target *db.Target) error {
+func isConditionFailed(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+func (d *DynamoDB) Create(ctx context.Context, target *db.Target) error {
 	target.ID = db.ID(target.Name)
-	av, err := dynamodbattribute.MarshalMap(target)
+	target.Revision = db.FirstRevision
+	return d.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (d *DynamoDB) Import(ctx context.Context, target *db.Target) error {
+	av, err := marshalTarget(target)
 	if err != nil {
 		return err
 	}
-	err = d.Get(&db.Target{ID: target.ID})
-	if err == nil {
-		return db.ErrConflict
-	}
-	if err != nil && err != db.ErrNotFound {
-		return err
-	}
-	_, err = d.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String(d.tableName),
-		Item:      av,
+	_, err = d.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.tableName),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
 	})
 	if err != nil {
+		if isConditionFailed(err) {
+			return db.ErrConflict
+		}
 		return err
 	}
 	return nil
 }
 
-func (d *DynamoDB) Delete(target *db.Target) error {
+// nameKey separates the name from the ID by a byte which sorts before any other,
+// so that keys sort like the names and then the IDs.
+func nameKey(name string, id db.ID) string {
+	return name + "\x00" + id.String()
+}
+
+func timeKey(t time.Time, id db.ID) string {
+	return t.UTC().Format(timeKeyLayout) + "#" + id.String()
+}
+
+// marshalTarget adds the expiry in the format the TTL of DynamoDB reads and the keys of the indexes,
+// the attributes aren't read back.
+func marshalTarget(target *db.Target) (map[string]*dynamodb.AttributeValue, error) {
+	av, err := dynamodbattribute.MarshalMap(target)
+	if err != nil {
+		return nil, err
+	}
+	av[listAttribute] = &dynamodb.AttributeValue{S: aws.String(listValue)}
+	av[nameKeyAttribute] = &dynamodb.AttributeValue{S: aws.String(nameKey(target.Name, target.ID))}
+	av[timeKeyAttribute] = &dynamodb.AttributeValue{S: aws.String(timeKey(target.Time, target.ID))}
+	if target.ExpiresAt != nil {
+		av[ttlAttribute] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(target.ExpiresAt.Unix(), 10))}
+	}
+	return av, nil
+}
+
+func (d *DynamoDB) Delete(ctx context.Context, target *db.Target) error {
 	input := &dynamodb.DeleteItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": {
 				S: aws.String(target.ID.String()),
 			},
 		},
-		TableName: aws.String(d.tableName),
+		TableName:           aws.String(d.tableName),
+		ConditionExpression: aws.String("attribute_exists(id)"),
 	}
 
-	_, err := d.DeleteItem(input)
+	_, err := d.DeleteItemWithContext(ctx, input)
 	if err != nil {
+		if isConditionFailed(err) {
+			return db.ErrNotFound
+		}
 		if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
 				return db.ErrNotFound
@@ -114,7 +201,7 @@ func (d *DynamoDB) Delete(target *db.Target) error {
 	return nil
 }
 
-func (d *DynamoDB) Get(target *db.Target) error {
+func (d *DynamoDB) Get(ctx context.Context, target *db.Target) error {
 	input := &dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": {
@@ -124,7 +211,7 @@ func (d *DynamoDB) Get(target *db.Target) error {
 		TableName: aws.String(d.tableName),
 	}
 
-	result, err := d.GetItem(input)
+	result, err := d.GetItemWithContext(ctx, input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
@@ -133,6 +220,9 @@ func (d *DynamoDB) Get(target *db.Target) error {
 		}
 		return err
 	}
+	if len(result.Item) == 0 {
+		return db.ErrNotFound
+	}
 	err = dynamodbattribute.UnmarshalMap(result.Item, target)
 	if err != nil {
 		return err
@@ -140,17 +230,41 @@ func (d *DynamoDB) Get(target *db.Target) error {
 	return nil
 }
 
-func (d *DynamoDB) Update(target *db.Target) error {
-	av, err := dynamodbattribute.MarshalMap(target)
+// revisionCondition makes PutItem replace only the expected revision,
+// items stored before revisions have no attribute and match revision 0.
+func revisionCondition(revision int64) string {
+	if revision == 0 {
+		return "attribute_exists(id) AND (attribute_not_exists(revision) OR revision = :revision)"
+	}
+	return "attribute_exists(id) AND revision = :revision"
+}
+
+func (d *DynamoDB) Update(ctx context.Context, target *db.Target) error {
+	next := *target
+	next.Revision++
+	av, err := marshalTarget(&next)
+	if err != nil {
+		return err
+	}
+	revision, err := dynamodbattribute.Marshal(target.Revision)
 	if err != nil {
 		return err
 	}
 
-	_, err = d.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String(d.tableName),
-		Item:      av,
+	_, err = d.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(d.tableName),
+		Item:                      av,
+		ConditionExpression:       aws.String(revisionCondition(target.Revision)),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":revision": revision},
 	})
 	if err != nil {
+		if isConditionFailed(err) {
+			// tell a missing item from an item with another revision
+			if err := d.Get(ctx, &db.Target{ID: target.ID}); err != nil {
+				return err
+			}
+			return db.ErrConflict
+		}
 		if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
 				return db.ErrNotFound
@@ -158,26 +272,139 @@ func (d *DynamoDB) Update(target *db.Target) error {
 		}
 		return err
 	}
+	target.Revision = next.Revision
+	return nil
+}
+
+// namePrefixFilter lets DynamoDB drop targets whose name doesn't start with the prefix.
+func namePrefixFilter(prefix string) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	// name is a reserved word
+	return aws.String("begins_with(#name, :prefix)"),
+		map[string]*string{"#name": aws.String("name")},
+		map[string]*dynamodb.AttributeValue{":prefix": {S: aws.String(prefix)}}
+}
+
+// GetAll queries the index of the sort field page by page starting after the cursor,
+// reading stops once the page is full. Tables without the indexes are scanned.
+func (d *DynamoDB) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	if !d.indexed {
+		return d.scan(ctx, query, list)
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(d.tableName),
+		IndexName:                 aws.String(byNameIndex),
+		KeyConditionExpression:    aws.String("#list = :list"),
+		ExpressionAttributeNames:  map[string]*string{"#list": aws.String(listAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":list": {S: aws.String(listValue)}},
+	}
+	if query.NamePrefix != "" {
+		filter, names, values := namePrefixFilter(query.NamePrefix)
+		input.FilterExpression = filter
+		input.ExpressionAttributeNames["#name"] = names["#name"]
+		input.ExpressionAttributeValues[":prefix"] = values[":prefix"]
+	}
+	if query.SortBy == db.SortByTime {
+		input.IndexName = aws.String(byTimeIndex)
+	}
+	if query.After != nil {
+		after := nameKey(query.After.Name, query.After.ID)
+		rangeKey := nameKeyAttribute
+		if query.SortBy == db.SortByTime {
+			after = timeKey(query.After.Time, query.After.ID)
+			rangeKey = timeKeyAttribute
+		}
+		input.KeyConditionExpression = aws.String("#list = :list AND " + rangeKey + " > :after")
+		input.ExpressionAttributeValues[":after"] = &dynamodb.AttributeValue{S: aws.String(after)}
+	}
+	if query.Limit > 0 {
+		input.Limit = aws.Int64(int64(query.Limit))
+	}
+	targets := []db.Target{}
+	matched := 0
+	for {
+		result, err := d.QueryWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		page := make([]db.Target, 0, aws.Int64Value(result.Count))
+		err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &page)
+		if err != nil {
+			return err
+		}
+		for i := range page {
+			if query.Match(&page[i]) {
+				matched++
+			}
+		}
+		targets = append(targets, page...)
+		if len(result.LastEvaluatedKey) == 0 || (query.Limit > 0 && matched >= query.Limit) {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	*list = query.Apply(targets)
 	return nil
 }
 
-func (d *DynamoDB) GetAll(list *[]db.Target) error {
+// scan reads the whole table page by page, the name prefix is filtered by DynamoDB,
+// scan isn't ordered so sorting and paging are applied to the scanned targets.
+func (d *DynamoDB) scan(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
 	input := &dynamodb.ScanInput{
 		TableName: aws.String(d.tableName),
 	}
-	result, err := d.Scan(input)
-	if err != nil {
-		return err
+	if query.NamePrefix != "" {
+		input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues = namePrefixFilter(query.NamePrefix)
 	}
-	targets := make([]db.Target, 0, *result.Count)
-	dynamodbattribute.UnmarshalListOfMaps(result.Items, &targets)
-	if err != nil {
-		return err
+	targets := []db.Target{}
+	for {
+		result, err := d.ScanWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		page := make([]db.Target, 0, aws.Int64Value(result.Count))
+		err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &page)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, page...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
 	}
-	*list = targets
+	*list = query.Apply(targets)
 	return nil
 }
 
+// listIndex keeps all targets in the order of rangeKey.
+func listIndex(name, rangeKey string) *dynamodb.GlobalSecondaryIndex {
+	return &dynamodb.GlobalSecondaryIndex{
+		IndexName: aws.String(name),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(listAttribute), KeyType: aws.String("HASH")},
+			{AttributeName: aws.String(rangeKey), KeyType: aws.String("RANGE")},
+		},
+		Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(5),
+			WriteCapacityUnits: aws.Int64(5),
+		},
+	}
+}
+
+// hasIndexes reports whether the table has the indexes GetAll queries.
+func (d *DynamoDB) hasIndexes() (bool, error) {
+	table, err := d.DescribeTableWithContext(aws.BackgroundContext(), &dynamodb.DescribeTableInput{TableName: aws.String(d.tableName)})
+	if err != nil {
+		return false, err
+	}
+	found := map[string]bool{}
+	for _, index := range table.Table.GlobalSecondaryIndexes {
+		found[aws.StringValue(index.IndexName)] = true
+	}
+	return found[byNameIndex] && found[byTimeIndex], nil
+}
+
 func (d *DynamoDB) createTable() error {
 	input := &dynamodb.CreateTableInput{
 		AttributeDefinitions: []*dynamodb.AttributeDefinition{
@@ -185,6 +412,22 @@ func (d *DynamoDB) createTable() error {
 				AttributeName: aws.String("id"),
 				AttributeType: aws.String("S"),
 			},
+			{
+				AttributeName: aws.String(listAttribute),
+				AttributeType: aws.String("S"),
+			},
+			{
+				AttributeName: aws.String(nameKeyAttribute),
+				AttributeType: aws.String("S"),
+			},
+			{
+				AttributeName: aws.String(timeKeyAttribute),
+				AttributeType: aws.String("S"),
+			},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			listIndex(byNameIndex, nameKeyAttribute),
+			listIndex(byTimeIndex, timeKeyAttribute),
 		},
 		KeySchema: []*dynamodb.KeySchemaElement{
 			{
@@ -196,9 +439,13 @@ func (d *DynamoDB) createTable() error {
 			ReadCapacityUnits:  aws.Int64(5),
 			WriteCapacityUnits: aws.Int64(5),
 		},
+		StreamSpecification: &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(dynamodb.StreamViewTypeNewImage),
+		},
 		TableName: aws.String(d.tableName),
 	}
-	_, err := d.CreateTable(input)
+	_, err := d.CreateTableWithContext(aws.BackgroundContext(), input)
 	if err != nil {
 		resourceInUseException := &dynamodb.ResourceInUseException{}
 		if errors.As(err, &resourceInUseException) {
@@ -210,6 +457,176 @@ func (d *DynamoDB) createTable() error {
 	return nil
 }
 
+// enableTTL turns on the native expiry of the table unless it is on already. A new table can't be changed
+// until it is active, so the call is retried. Failures are only logged, the service deletes expired targets anyway.
+func (d *DynamoDB) enableTTL() {
+	ctx := aws.BackgroundContext()
+	described, err := d.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(d.tableName)})
+	if err != nil {
+		log.Println("DescribeTimeToLive returns error:", err.Error())
+		return
+	}
+	if status := described.TimeToLiveDescription; status != nil {
+		switch aws.StringValue(status.TimeToLiveStatus) {
+		case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+			d.expires = true
+			return
+		}
+	}
+	input := &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(d.tableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(ttlAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	}
+	for attempt := 1; ; attempt++ {
+		_, err = d.UpdateTimeToLiveWithContext(ctx, input)
+		resourceInUseException := &dynamodb.ResourceInUseException{}
+		if err == nil || !errors.As(err, &resourceInUseException) || attempt == ttlAttempts {
+			break
+		}
+		time.Sleep(ttlBackoff)
+	}
+	if err != nil {
+		log.Println("UpdateTimeToLive returns error:", err.Error())
+		return
+	}
+	d.expires = true
+}
+
+// ExpiresTargets reports whether DynamoDB deletes expired targets by TTL of the table.
+func (d *DynamoDB) ExpiresTargets() bool {
+	return d.expires
+}
+
+// streamEvent translates a record of the stream, only keys of removed items are kept.
+func streamEvent(record *dynamodbstreams.Record) (db.Event, error) {
+	change := record.Dynamodb
+	if change == nil {
+		return db.Event{}, errors.New("record has no change")
+	}
+	var action db.Action
+	switch aws.StringValue(record.EventName) {
+	case dynamodbstreams.OperationTypeInsert:
+		action = db.ActionCreate
+	case dynamodbstreams.OperationTypeModify:
+		action = db.ActionUpdate
+	case dynamodbstreams.OperationTypeRemove:
+		id := change.Keys["id"]
+		if id == nil {
+			return db.Event{}, errors.New("removed item has no id")
+		}
+		return db.Event{Action: db.ActionDelete, Target: db.Target{ID: db.ID(aws.StringValue(id.S))}}, nil
+	default:
+		return db.Event{}, fmt.Errorf("unknown event %q", aws.StringValue(record.EventName))
+	}
+	event := db.Event{Action: action}
+	if err := dynamodbattribute.UnmarshalMap(change.NewImage, &event.Target); err != nil {
+		return db.Event{}, err
+	}
+	return event, nil
+}
+
+// openShards starts reading shards of the stream which aren't read yet. Shards open when watching
+// starts are read from their latest records, shards opened later are read from their beginning.
+func (d *DynamoDB) openShards(ctx context.Context, streamArn *string, iterators map[string]*string, finished map[string]bool, latest bool) error {
+	input := &dynamodbstreams.DescribeStreamInput{StreamArn: streamArn}
+	for {
+		output, err := d.DescribeStreamWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, shard := range output.StreamDescription.Shards {
+			shardID := aws.StringValue(shard.ShardId)
+			if _, ok := iterators[shardID]; ok || finished[shardID] {
+				continue
+			}
+			iteratorType := dynamodbstreams.ShardIteratorTypeTrimHorizon
+			if latest {
+				if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+					finished[shardID] = true
+					continue
+				}
+				iteratorType = dynamodbstreams.ShardIteratorTypeLatest
+			}
+			iterator, err := d.GetShardIteratorWithContext(ctx, &dynamodbstreams.GetShardIteratorInput{
+				StreamArn:         streamArn,
+				ShardId:           shard.ShardId,
+				ShardIteratorType: aws.String(iteratorType),
+			})
+			if err != nil {
+				return err
+			}
+			iterators[shardID] = iterator.ShardIterator
+		}
+		if output.StreamDescription.LastEvaluatedShardId == nil {
+			return nil
+		}
+		input.ExclusiveStartShardId = output.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+// Watch follows DynamoDB Streams of the table, tables created by PromHSD have the stream enabled.
+func (d *DynamoDB) Watch(ctx context.Context, events chan<- db.Event) error {
+	if d.IStreams == nil {
+		return errors.New("streams client is not configured")
+	}
+	table, err := d.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.tableName)})
+	if err != nil {
+		return err
+	}
+	spec := table.Table.StreamSpecification
+	if table.Table.LatestStreamArn == nil || spec == nil || !aws.BoolValue(spec.StreamEnabled) {
+		return errors.New("stream is not enabled on the table")
+	}
+	streamArn := table.Table.LatestStreamArn
+	iterators := map[string]*string{}
+	finished := map[string]bool{}
+	if err = d.openShards(ctx, streamArn, iterators, finished, true); err != nil {
+		return err
+	}
+	for {
+		closed := false
+		for shardID, iterator := range iterators {
+			output, err := d.GetRecordsWithContext(ctx, &dynamodbstreams.GetRecordsInput{ShardIterator: iterator})
+			if err != nil {
+				return err
+			}
+			for _, record := range output.Records {
+				event, err := streamEvent(record)
+				if err != nil {
+					log.Println("Failed to read the stream record:", err)
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if output.NextShardIterator == nil {
+				delete(iterators, shardID)
+				finished[shardID] = true
+				closed = true
+				continue
+			}
+			iterators[shardID] = output.NextShardIterator
+		}
+		// shards are split and rolled over, their children open as they close
+		if closed {
+			if err = d.openShards(ctx, streamArn, iterators, finished, false); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(streamInterval):
+		}
+	}
+}
+
 type StorageService struct{}
 
 func (s *StorageService) ServiceID() string {
@@ -230,11 +647,22 @@ func (s *StorageService) New(tableName string) (db.Storage, error) {
 	db.IPutItem = dynamo
 	db.IDeleteItem = dynamo
 	db.IScan = dynamo
+	db.IQuery = dynamo
+	db.IStreams = dynamodbstreams.New(sess)
+	db.ITimeToLive = dynamo
 	db.tableName = tableName
 	err = db.createTable()
 	if err != nil {
 		return nil, err
 	}
+	db.enableTTL()
+	db.indexed, err = db.hasIndexes()
+	if err != nil {
+		return nil, err
+	}
+	if !db.indexed {
+		log.Printf("Table %s has no %s and %s indexes, targets are listed by scanning it\n", tableName, byNameIndex, byTimeIndex)
+	}
 	return db, nil
 }
 
@@ -243,5 +671,8 @@ func init() {
 }
 
 var (
-	_ db.Storage = (*DynamoDB)(nil)
+	_ db.Storage  = (*DynamoDB)(nil)
+	_ db.Importer = (*DynamoDB)(nil)
+	_ db.Expirer  = (*DynamoDB)(nil)
+	_ db.Watcher  = (*DynamoDB)(nil)
 )
@@ -1,12 +1,20 @@
 package dynamo
 
 import (
+	"context"
+	"fmt"
 	"promhsd/db"
+	"promhsd/db/storagetest"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,7 +22,7 @@ type testGetItem struct {
 	err error
 }
 
-func (item *testGetItem) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+func (item *testGetItem) GetItemWithContext(aws.Context, *dynamodb.GetItemInput, ...request.Option) (*dynamodb.GetItemOutput, error) {
 	return nil, item.err
 }
 
@@ -22,11 +30,11 @@ type testPutItem struct {
 	err error
 }
 
-func (item *testPutItem) PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+func (item *testPutItem) PutItemWithContext(aws.Context, *dynamodb.PutItemInput, ...request.Option) (*dynamodb.PutItemOutput, error) {
 	return nil, item.err
 }
 
-func (item *testPutItem) GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+func (item *testPutItem) GetItemWithContext(aws.Context, *dynamodb.GetItemInput, ...request.Option) (*dynamodb.GetItemOutput, error) {
 	return nil, item.err
 }
 
@@ -34,7 +42,7 @@ type testDeleteItem struct {
 	err error
 }
 
-func (item *testDeleteItem) DeleteItem(*dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+func (item *testDeleteItem) DeleteItemWithContext(aws.Context, *dynamodb.DeleteItemInput, ...request.Option) (*dynamodb.DeleteItemOutput, error) {
 	return nil, item.err
 }
 
@@ -43,11 +51,11 @@ type testTable struct {
 	result *dynamodb.DescribeTableOutput
 }
 
-func (item *testTable) DescribeTable(*dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+func (item *testTable) DescribeTableWithContext(aws.Context, *dynamodb.DescribeTableInput, ...request.Option) (*dynamodb.DescribeTableOutput, error) {
 	return item.result, item.err
 }
 
-func (item *testTable) CreateTable(*dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+func (item *testTable) CreateTableWithContext(aws.Context, *dynamodb.CreateTableInput, ...request.Option) (*dynamodb.CreateTableOutput, error) {
 	return nil, item.err
 }
 
@@ -56,7 +64,7 @@ type testScan struct {
 	err    error
 }
 
-func (item *testScan) Scan(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+func (item *testScan) ScanWithContext(aws.Context, *dynamodb.ScanInput, ...request.Option) (*dynamodb.ScanOutput, error) {
 	return item.result, item.err
 }
 
@@ -87,7 +95,7 @@ func TestDynamoDB_Get(t *testing.T) {
 				IGetItem:  tt.fields.IGetItem,
 				tableName: tt.fields.tableName,
 			}
-			if err := d.Get(tt.args.target); (err != nil) != tt.wantErr {
+			if err := d.Get(context.Background(), tt.args.target); (err != nil) != tt.wantErr {
 				assert.Error(t, err)
 			}
 		})
@@ -124,13 +132,26 @@ func TestDynamoDB_Update(t *testing.T) {
 				IPutItem:  tt.fields.IPutItem,
 				tableName: tt.fields.tableName,
 			}
-			if err := d.Update(tt.args.target); (err != nil) != tt.wantErr {
+			if err := d.Update(context.Background(), tt.args.target); (err != nil) != tt.wantErr {
 				assert.Error(t, err)
 			}
 		})
 	}
 }
 
+func TestDynamoDB_UpdateLegacy(t *testing.T) {
+	// item stored before revisions has no revision attribute
+	tbl := &testTableItems{items: map[string]map[string]*dynamodb.AttributeValue{
+		"test": {"id": {S: aws.String("test")}, "name": {S: aws.String("test")}},
+	}, pageSize: 1}
+	d := &DynamoDB{IGetItem: tbl, IPutItem: tbl, tableName: "table"}
+	err := d.Update(context.Background(), &db.Target{ID: "test", Name: "test", Revision: db.FirstRevision})
+	assert.Equal(t, db.ErrConflict, err)
+	target := &db.Target{ID: "test", Name: "test"}
+	assert.NoError(t, d.Update(context.Background(), target))
+	assert.Equal(t, db.FirstRevision, target.Revision)
+}
+
 func TestDynamoDB_Delete(t *testing.T) {
 	type fields struct {
 		IDeleteItem IDeleteItem
@@ -160,7 +181,7 @@ func TestDynamoDB_Delete(t *testing.T) {
 				IDeleteItem: tt.fields.IDeleteItem,
 				tableName:   tt.fields.tableName,
 			}
-			if err := d.Delete(tt.args.target); (err != nil) != tt.wantErr {
+			if err := d.Delete(context.Background(), tt.args.target); (err != nil) != tt.wantErr {
 				assert.Error(t, err)
 			}
 		})
@@ -202,7 +223,7 @@ func TestDynamoDB_Create(t *testing.T) {
 				IGetItem:  tt.fields.IGetItem,
 				tableName: tt.fields.tableName,
 			}
-			if err := d.Create(tt.args.target); (err != nil) != tt.wantErr {
+			if err := d.Create(context.Background(), tt.args.target); (err != nil) != tt.wantErr {
 				assert.Error(t, err)
 			}
 		})
@@ -254,7 +275,7 @@ func TestDynamoDB_IsHealthy(t *testing.T) {
 				IDescribeTable: tt.fields.IDescribeTable,
 				tableName:      tt.fields.tableName,
 			}
-			assert.Equal(t, tt.want, d.IsHealthy())
+			assert.Equal(t, tt.want, d.IsHealthy(context.Background()))
 		})
 	}
 }
@@ -296,7 +317,7 @@ func TestDynamoDB_GetAll(t *testing.T) {
 				IScan:     tt.fields.IScan,
 				tableName: tt.fields.tableName,
 			}
-			if err := d.GetAll(tt.args.list); (err != nil) != tt.wantErr {
+			if err := d.GetAll(context.Background(), &db.ListQuery{}, tt.args.list); (err != nil) != tt.wantErr {
 				assert.Error(t, err)
 			}
 		})
@@ -376,3 +397,292 @@ func TestStorageService_New(t *testing.T) {
 		})
 	}
 }
+
+// testTableItems is an in-memory table which understands
+// the condition expressions DynamoDB storage relies on.
+type testTableItems struct {
+	items    map[string]map[string]*dynamodb.AttributeValue
+	pageSize int
+	// queried counts items read by queries
+	queried int
+}
+
+func (tbl *testTableItems) checkCondition(expression *string, values map[string]*dynamodb.AttributeValue, id string) error {
+	item, exists := tbl.items[id]
+	ok := true
+	switch aws.StringValue(expression) {
+	case "attribute_not_exists(id)":
+		ok = !exists
+	case "attribute_exists(id)":
+		ok = exists
+	case revisionCondition(0), revisionCondition(db.FirstRevision):
+		ok = exists
+		if exists && item["revision"] == nil {
+			ok = aws.StringValue(values[":revision"].N) == "0"
+		} else if exists {
+			ok = aws.StringValue(item["revision"].N) == aws.StringValue(values[":revision"].N)
+		}
+	}
+	if !ok {
+		return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "conditional check failed", nil)
+	}
+	return nil
+}
+
+func (tbl *testTableItems) GetItemWithContext(_ aws.Context, input *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: tbl.items[*input.Key["id"].S]}, nil
+}
+
+func (tbl *testTableItems) PutItemWithContext(_ aws.Context, input *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	id := *input.Item["id"].S
+	if err := tbl.checkCondition(input.ConditionExpression, input.ExpressionAttributeValues, id); err != nil {
+		return nil, err
+	}
+	tbl.items[id] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (tbl *testTableItems) DeleteItemWithContext(_ aws.Context, input *dynamodb.DeleteItemInput, _ ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	id := *input.Key["id"].S
+	if err := tbl.checkCondition(input.ConditionExpression, input.ExpressionAttributeValues, id); err != nil {
+		return nil, err
+	}
+	delete(tbl.items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// ScanWithContext returns pageSize items at most, like DynamoDB does with its 1 MB pages.
+func (tbl *testTableItems) ScanWithContext(_ aws.Context, input *dynamodb.ScanInput, _ ...request.Option) (*dynamodb.ScanOutput, error) {
+	ids := []string{}
+	for id := range tbl.items {
+		if input.ExclusiveStartKey == nil || id > *input.ExclusiveStartKey["id"].S {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	output := &dynamodb.ScanOutput{}
+	if len(ids) > tbl.pageSize {
+		ids = ids[:tbl.pageSize]
+		output.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{"id": {S: aws.String(ids[len(ids)-1])}}
+	}
+	for _, id := range ids {
+		output.Items = append(output.Items, tbl.items[id])
+	}
+	output.Count = aws.Int64(int64(len(output.Items)))
+	return output, nil
+}
+
+// QueryWithContext reads an index like DynamoDB does: in the order of its range key, after the key
+// condition and the exclusive start key, Limit or pageSize items at most before they are filtered.
+func (tbl *testTableItems) QueryWithContext(_ aws.Context, input *dynamodb.QueryInput, _ ...request.Option) (*dynamodb.QueryOutput, error) {
+	rangeKey := nameKeyAttribute
+	if aws.StringValue(input.IndexName) == byTimeIndex {
+		rangeKey = timeKeyAttribute
+	}
+	after := ""
+	if value := input.ExpressionAttributeValues[":after"]; value != nil {
+		after = aws.StringValue(value.S)
+	}
+	if start := input.ExclusiveStartKey[rangeKey]; start != nil && aws.StringValue(start.S) > after {
+		after = aws.StringValue(start.S)
+	}
+	items := []map[string]*dynamodb.AttributeValue{}
+	for _, item := range tbl.items {
+		if aws.StringValue(item[listAttribute].S) == listValue && aws.StringValue(item[rangeKey].S) > after {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return aws.StringValue(items[i][rangeKey].S) < aws.StringValue(items[j][rangeKey].S)
+	})
+	limit := tbl.pageSize
+	if input.Limit != nil && int(*input.Limit) < limit {
+		limit = int(*input.Limit)
+	}
+	output := &dynamodb.QueryOutput{}
+	if len(items) > limit {
+		items = items[:limit]
+		last := items[len(items)-1]
+		output.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{"id": last["id"], listAttribute: last[listAttribute], rangeKey: last[rangeKey]}
+	}
+	prefix := ""
+	if value := input.ExpressionAttributeValues[":prefix"]; value != nil {
+		prefix = aws.StringValue(value.S)
+	}
+	for _, item := range items {
+		if strings.HasPrefix(aws.StringValue(item["name"].S), prefix) {
+			output.Items = append(output.Items, item)
+		}
+	}
+	output.Count = aws.Int64(int64(len(output.Items)))
+	tbl.queried += len(items)
+	return output, nil
+}
+
+func TestDynamoDB_Conformance(t *testing.T) {
+	active := &testTable{result: &dynamodb.DescribeTableOutput{
+		Table: &dynamodb.TableDescription{TableStatus: aws.String(dynamodb.TableStatusActive)},
+	}}
+	for _, indexed := range []bool{false, true} {
+		t.Run(map[bool]string{false: "Scan", true: "Query"}[indexed], func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) db.Storage {
+				tbl := &testTableItems{items: map[string]map[string]*dynamodb.AttributeValue{}, pageSize: 2}
+				return &DynamoDB{
+					IDescribeTable: active,
+					IGetItem:       tbl,
+					IPutItem:       tbl,
+					IDeleteItem:    tbl,
+					IScan:          tbl,
+					IQuery:         tbl,
+					tableName:      "table",
+					indexed:        indexed,
+				}
+			})
+		})
+	}
+}
+
+func TestDynamoDB_GetAllReadsPage(t *testing.T) {
+	tbl := &testTableItems{items: map[string]map[string]*dynamodb.AttributeValue{}, pageSize: 100}
+	d := &DynamoDB{IGetItem: tbl, IPutItem: tbl, IQuery: tbl, tableName: "table", indexed: true}
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, d.Create(context.Background(), &db.Target{Name: fmt.Sprintf("test%02d", i), Time: time.Unix(int64(100-i), 0)}))
+	}
+	for _, sortBy := range []db.SortField{db.SortByName, db.SortByTime} {
+		tbl.queried = 0
+		list := []db.Target{}
+		query := &db.ListQuery{SortBy: sortBy, Limit: 3, After: &db.Cursor{ID: "test15", Time: time.Unix(85, 0)}}
+		assert.NoError(t, d.GetAll(context.Background(), query, &list))
+		assert.Len(t, list, 3)
+		// only the page is read, not the whole table
+		assert.Equal(t, 3, tbl.queried, sortBy)
+	}
+}
+
+// testStreams is a stream with a single shard, which is closed once its records are read.
+type testStreams struct {
+	records []*dynamodbstreams.Record
+}
+
+func (s *testStreams) DescribeStreamWithContext(aws.Context, *dynamodbstreams.DescribeStreamInput, ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error) {
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: &dynamodbstreams.StreamDescription{
+		Shards: []*dynamodbstreams.Shard{
+			{ShardId: aws.String("closed"), SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{EndingSequenceNumber: aws.String("1")}},
+			{ShardId: aws.String("open"), SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{}},
+		},
+	}}, nil
+}
+
+func (s *testStreams) GetShardIteratorWithContext(_ aws.Context, input *dynamodbstreams.GetShardIteratorInput, _ ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: input.ShardId}, nil
+}
+
+func (s *testStreams) GetRecordsWithContext(_ aws.Context, input *dynamodbstreams.GetRecordsInput, _ ...request.Option) (*dynamodbstreams.GetRecordsOutput, error) {
+	if aws.StringValue(input.ShardIterator) != "open" {
+		return nil, awserr.New(dynamodbstreams.ErrCodeExpiredIteratorException, "unknown iterator", nil)
+	}
+	return &dynamodbstreams.GetRecordsOutput{Records: s.records}, nil
+}
+
+func streamRecord(eventName string, revision string) *dynamodbstreams.Record {
+	record := &dynamodbstreams.Record{
+		EventName: aws.String(eventName),
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			Keys: map[string]*dynamodb.AttributeValue{"id": {S: aws.String("test")}},
+		},
+	}
+	if eventName != dynamodbstreams.OperationTypeRemove {
+		record.Dynamodb.NewImage = map[string]*dynamodb.AttributeValue{
+			"id":       {S: aws.String("test")},
+			"name":     {S: aws.String("test")},
+			"revision": {N: aws.String(revision)},
+		}
+	}
+	return record
+}
+
+func TestDynamoDB_Watch(t *testing.T) {
+	table := &testTable{result: &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+		LatestStreamArn:     aws.String("arn"),
+		StreamSpecification: &dynamodb.StreamSpecification{StreamEnabled: aws.Bool(true)},
+	}}}
+	streams := &testStreams{records: []*dynamodbstreams.Record{
+		streamRecord(dynamodbstreams.OperationTypeInsert, "1"),
+		streamRecord(dynamodbstreams.OperationTypeModify, "2"),
+		streamRecord(dynamodbstreams.OperationTypeRemove, ""),
+	}}
+	d := &DynamoDB{IDescribeTable: table, IStreams: streams, tableName: "table"}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan db.Event)
+	done := make(chan error)
+	go func() { done <- d.Watch(ctx, events) }()
+
+	assert.Equal(t, db.Event{Action: db.ActionCreate, Target: db.Target{ID: "test", Name: "test", Revision: 1}}, <-events)
+	assert.Equal(t, db.Event{Action: db.ActionUpdate, Target: db.Target{ID: "test", Name: "test", Revision: 2}}, <-events)
+	assert.Equal(t, db.Event{Action: db.ActionDelete, Target: db.Target{ID: "test"}}, <-events)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestDynamoDB_WatchDisabled(t *testing.T) {
+	table := &testTable{result: &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{}}}
+	d := &DynamoDB{IDescribeTable: table, IStreams: &testStreams{}, tableName: "table"}
+	assert.Error(t, d.Watch(context.Background(), make(chan db.Event)))
+}
+
+func TestDynamoDB_ttlAttribute(t *testing.T) {
+	tbl := &testTableItems{items: map[string]map[string]*dynamodb.AttributeValue{}, pageSize: 1}
+	d := &DynamoDB{IGetItem: tbl, IPutItem: tbl, tableName: "table"}
+	target := db.NewTarget()
+	target.Name = "expiring"
+	expiresAt := time.Unix(1700000000, 0)
+	target.ExpiresAt = &expiresAt
+	assert.NoError(t, d.Create(context.Background(), target))
+	assert.Equal(t, "1700000000", aws.StringValue(tbl.items["expiring"][ttlAttribute].N))
+
+	// a target without the expiry loses the attribute, so DynamoDB keeps it
+	target.ExpiresAt = nil
+	assert.NoError(t, d.Update(context.Background(), target))
+	assert.Nil(t, tbl.items["expiring"][ttlAttribute])
+}
+
+// testTimeToLive records how the TTL of the table is changed.
+type testTimeToLive struct {
+	status  string
+	updates []*dynamodb.UpdateTimeToLiveInput
+	err     error
+}
+
+func (ttl *testTimeToLive) DescribeTimeToLiveWithContext(aws.Context, *dynamodb.DescribeTimeToLiveInput, ...request.Option) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: &dynamodb.TimeToLiveDescription{TimeToLiveStatus: aws.String(ttl.status)}}, nil
+}
+
+func (ttl *testTimeToLive) UpdateTimeToLiveWithContext(_ aws.Context, input *dynamodb.UpdateTimeToLiveInput, _ ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	ttl.updates = append(ttl.updates, input)
+	return &dynamodb.UpdateTimeToLiveOutput{}, ttl.err
+}
+
+func TestDynamoDB_enableTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     *testTimeToLive
+		updates int
+		expires bool
+	}{
+		{name: "disabled", ttl: &testTimeToLive{status: dynamodb.TimeToLiveStatusDisabled}, updates: 1, expires: true},
+		{name: "enabled", ttl: &testTimeToLive{status: dynamodb.TimeToLiveStatusEnabled}, expires: true},
+		{name: "denied", ttl: &testTimeToLive{status: dynamodb.TimeToLiveStatusDisabled, err: awserr.New("AccessDeniedException", "denied", nil)}, updates: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DynamoDB{ITimeToLive: tt.ttl, tableName: "table"}
+			d.enableTTL()
+			assert.Len(t, tt.ttl.updates, tt.updates)
+			assert.Equal(t, tt.expires, d.ExpiresTargets())
+			for _, update := range tt.ttl.updates {
+				assert.Equal(t, ttlAttribute, aws.StringValue(update.TimeToLiveSpecification.AttributeName))
+				assert.True(t, aws.BoolValue(update.TimeToLiveSpecification.Enabled))
+			}
+		})
+	}
+}
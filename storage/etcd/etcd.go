@@ -0,0 +1,402 @@
+package etcd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"promhsd/db"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	StorageID     = "etcd"
+	defaultPrefix = "/promhsd/targets/"
+	prefixParam   = "prefix"
+	dialTimeout   = 5 * time.Second
+	statusTimeout = 5 * time.Second
+	// namesBatch is how many keys of the names index are read at once
+	namesBatch = 100
+)
+
+type Etcd struct {
+	client *clientv3.Client
+	prefix string
+	// named tells that targets stored by older versions got their keys in the names index
+	mu    sync.Mutex
+	named bool
+}
+
+func (e *Etcd) key(id db.ID) string {
+	return e.prefix + id.String()
+}
+
+// namesPrefix is next to the prefix of targets like auditPrefix, its keys sort IDs of targets
+// by their name and ID, values are the IDs.
+func (e *Etcd) namesPrefix() string {
+	return strings.TrimSuffix(e.prefix, "/") + ".names/"
+}
+
+// nameKey separates the name from the ID by a byte which sorts before any other,
+// so that keys sort like the names and then the IDs.
+func (e *Etcd) nameKey(name string, id db.ID) string {
+	return e.namesPrefix() + name + "\x00" + id.String()
+}
+
+// auditPrefix is next to the prefix of targets rather than inside it, so that records aren't listed as targets.
+func (e *Etcd) auditPrefix() string {
+	return strings.TrimSuffix(e.prefix, "/") + ".audit/"
+}
+
+// auditKey sorts records by their time, keys of records of the same time end with a random suffix.
+func (e *Etcd) auditKey(t time.Time) string {
+	return fmt.Sprintf("%s%020d", e.auditPrefix(), t.UnixNano())
+}
+
+// IsHealthy reports whether any endpoint answers and knows the cluster leader.
+func (e *Etcd) IsHealthy(ctx context.Context) bool {
+	for _, endpoint := range e.client.Endpoints() {
+		statusCtx, cancel := context.WithTimeout(ctx, statusTimeout)
+		status, err := e.client.Status(statusCtx, endpoint)
+		cancel()
+		if err != nil {
+			log.Println("Status returns error:", err.Error())
+			continue
+		}
+		if status.Leader != 0 && len(status.Errors) == 0 {
+			return true
+		}
+		log.Println("Endpoint is not healthy:", endpoint, status.Errors)
+	}
+	return false
+}
+
+func (e *Etcd) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return e.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (e *Etcd) Import(ctx context.Context, target *db.Target) error {
+	value, err := json.Marshal(target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	key := e.key(target.ID)
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(value)), clientv3.OpPut(e.nameKey(target.Name, target.ID), target.ID.String())).
+		Commit()
+	if err != nil {
+		log.Println("Failed to Create the target:", err)
+		return err
+	}
+	if !resp.Succeeded {
+		return db.ErrConflict
+	}
+	return nil
+}
+
+// Update replaces the target only if it has the expected revision
+// and nobody has changed it since it was read, otherwise it returns ErrConflict.
+func (e *Etcd) Update(ctx context.Context, target *db.Target) error {
+	next := *target
+	next.Revision++
+	value, err := json.Marshal(&next)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	key := e.key(target.ID)
+	current, err := e.client.Get(ctx, key)
+	if err != nil {
+		log.Println("Failed to Get the target:", err)
+		return err
+	}
+	if len(current.Kvs) == 0 {
+		return db.ErrNotFound
+	}
+	var stored db.Target
+	if err := json.Unmarshal(current.Kvs[0].Value, &stored); err != nil {
+		return &db.StorageError{Text: "Couldn't decode json", Err: err}
+	}
+	if stored.Revision != target.Revision {
+		return db.ErrConflict
+	}
+	ops := []clientv3.Op{clientv3.OpPut(key, string(value))}
+	if stored.Name != next.Name {
+		ops = append(ops, clientv3.OpDelete(e.nameKey(stored.Name, target.ID)), clientv3.OpPut(e.nameKey(next.Name, target.ID), target.ID.String()))
+	}
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", current.Kvs[0].ModRevision)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		log.Println("Failed to Update the target:", err)
+		return err
+	}
+	if !resp.Succeeded {
+		return db.ErrConflict
+	}
+	target.Revision = next.Revision
+	return nil
+}
+
+// Delete removes the target along with its key in the names index,
+// it reads the target again when it was changed in between.
+func (e *Etcd) Delete(ctx context.Context, target *db.Target) error {
+	key := e.key(target.ID)
+	for {
+		current, err := e.client.Get(ctx, key)
+		if err != nil {
+			log.Println("Failed to Get the target:", err)
+			return err
+		}
+		if len(current.Kvs) == 0 {
+			return db.ErrNotFound
+		}
+		var stored db.Target
+		if err := json.Unmarshal(current.Kvs[0].Value, &stored); err != nil {
+			return &db.StorageError{Text: "Couldn't decode json", Err: err}
+		}
+		resp, err := e.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", current.Kvs[0].ModRevision)).
+			Then(clientv3.OpDelete(key), clientv3.OpDelete(e.nameKey(stored.Name, target.ID))).
+			Commit()
+		if err != nil {
+			log.Println("Failed to Delete the target:", err)
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+	}
+}
+
+func (e *Etcd) Get(ctx context.Context, target *db.Target) error {
+	resp, err := e.client.Get(ctx, e.key(target.ID))
+	if err != nil {
+		log.Println("Failed to Get the target:", err)
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return db.ErrNotFound
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't decode json", Err: err}
+	}
+	return nil
+}
+
+// GetAll walks the names index starting right after the cursor when targets are sorted by name,
+// targets are read batch by batch until the page is full. Targets sorted by time are all read.
+func (e *Etcd) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	if query.SortBy == db.SortByTime {
+		prefix := e.key("")
+		resp, err := e.client.Get(ctx, prefix, clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)))
+		if err != nil {
+			log.Println("Failed to GetAll targets:", err)
+			return err
+		}
+		targets := make([]db.Target, 0, len(resp.Kvs))
+		for _, kv := range resp.Kvs {
+			var target db.Target
+			if err = json.Unmarshal(kv.Value, &target); err != nil {
+				return &db.StorageError{Text: "Couldn't decode json", Err: err}
+			}
+			targets = append(targets, target)
+		}
+		*list = query.Apply(targets)
+		return nil
+	}
+	if err := e.fillNames(ctx); err != nil {
+		return err
+	}
+	from, end := e.namesPrefix(), clientv3.GetPrefixRangeEnd(e.namesPrefix())
+	if query.After != nil {
+		from = e.nameKey(query.After.Name, query.After.ID) + "\x00"
+	}
+	targets := []db.Target{}
+	for query.Limit == 0 || len(targets) < query.Limit {
+		names, err := e.client.Get(ctx, from, clientv3.WithRange(end), clientv3.WithLimit(namesBatch))
+		if err != nil {
+			log.Println("Failed to GetAll targets:", err)
+			return err
+		}
+		if len(names.Kvs) == 0 {
+			break
+		}
+		ops := make([]clientv3.Op, 0, len(names.Kvs))
+		for _, kv := range names.Kvs {
+			ops = append(ops, clientv3.OpGet(e.key(db.ID(kv.Value))))
+		}
+		resp, err := e.client.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			log.Println("Failed to GetAll targets:", err)
+			return err
+		}
+		for i, op := range resp.Responses {
+			kvs := op.GetResponseRange().Kvs
+			if len(kvs) == 0 {
+				continue
+			}
+			var target db.Target
+			if err = json.Unmarshal(kvs[0].Value, &target); err != nil {
+				return &db.StorageError{Text: "Couldn't decode json", Err: err}
+			}
+			// the target may have been renamed after the index was read
+			if string(names.Kvs[i].Key) == e.nameKey(target.Name, target.ID) && query.Match(&target) {
+				targets = append(targets, target)
+			}
+		}
+		if !names.More {
+			break
+		}
+		from = string(names.Kvs[len(names.Kvs)-1].Key) + "\x00"
+	}
+	*list = query.Apply(targets)
+	return nil
+}
+
+// fillNames adds keys of targets stored by older versions to the names index, once the index has a key
+// or there are no targets it isn't checked again.
+func (e *Etcd) fillNames(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.named {
+		return nil
+	}
+	names, err := e.client.Get(ctx, e.namesPrefix(), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		log.Println("Failed to read the names index:", err)
+		return err
+	}
+	if names.Count == 0 {
+		prefix := e.key("")
+		resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix())
+		if err != nil {
+			log.Println("Failed to GetAll targets:", err)
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			var target db.Target
+			if err = json.Unmarshal(kv.Value, &target); err != nil {
+				return &db.StorageError{Text: "Couldn't decode json", Err: err}
+			}
+			id := db.ID(strings.TrimPrefix(string(kv.Key), prefix))
+			_, err = e.client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision)).
+				Then(clientv3.OpPut(e.nameKey(target.Name, id), id.String())).
+				Commit()
+			if err != nil {
+				log.Println("Failed to fill the names index:", err)
+				return err
+			}
+		}
+	}
+	e.named = true
+	return nil
+}
+
+func (e *Etcd) WriteAudit(ctx context.Context, record *db.AuditRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	suffix := make([]byte, 8)
+	if _, err = rand.Read(suffix); err != nil {
+		return err
+	}
+	key := e.auditKey(record.Time) + "-" + hex.EncodeToString(suffix)
+	if _, err = e.client.Put(ctx, key, string(value)); err != nil {
+		log.Println("Failed to Put the audit record:", err)
+		return err
+	}
+	return nil
+}
+
+// QueryAudit reads the range of keys from query.From to query.To.
+func (e *Etcd) QueryAudit(ctx context.Context, query *db.AuditQuery, records *[]db.AuditRecord) error {
+	from, end := e.auditPrefix(), clientv3.GetPrefixRangeEnd(e.auditPrefix())
+	if !query.From.IsZero() {
+		from = e.auditKey(query.From)
+	}
+	if !query.To.IsZero() {
+		end = e.auditKey(query.To.Add(time.Nanosecond))
+	}
+	resp, err := e.client.Get(ctx, from, clientv3.WithRange(end))
+	if err != nil {
+		log.Println("Failed to read audit records:", err)
+		return err
+	}
+	result := make([]db.AuditRecord, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var record db.AuditRecord
+		if err = json.Unmarshal(kv.Value, &record); err != nil {
+			return &db.StorageError{Text: "Couldn't decode audit record", Err: err}
+		}
+		result = append(result, record)
+	}
+	*records = result
+	return nil
+}
+
+// parseArgs accepts comma separated endpoints with optional prefix parameter,
+// e.g. "http://etcd1:2379,http://etcd2:2379?prefix=/promhsd/".
+func parseArgs(args string) ([]string, string, error) {
+	endpoints, rawQuery, _ := strings.Cut(args, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := query.Get(prefixParam)
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return strings.Split(endpoints, ","), prefix, nil
+}
+
+type StorageService struct{}
+
+func (s *StorageService) ServiceID() string {
+	return StorageID
+}
+
+func (s *StorageService) New(args string) (db.Storage, error) {
+	endpoints, prefix, err := parseArgs(args)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+	})
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	db := &Etcd{client: client, prefix: prefix}
+	return db, nil
+}
+
+func init() {
+	db.RegisterStorage(&StorageService{})
+}
+
+var (
+	_ db.Storage    = (*Etcd)(nil)
+	_ db.Importer   = (*Etcd)(nil)
+	_ db.AuditStore = (*Etcd)(nil)
+)
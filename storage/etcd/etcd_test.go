@@ -0,0 +1,149 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+var (
+	endpoint string
+)
+
+func freeURL() url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "promhsd-etcd-*")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeURL(), freeURL()
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		log.Fatal("etcd server took too long to start")
+	}
+	endpoint = clientURL.String()
+
+	code := m.Run()
+	server.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newTestDB(t *testing.T) *Etcd {
+	service := StorageService{}
+	storage, err := service.New(fmt.Sprintf("%s?prefix=/%s", endpoint, t.Name()))
+	assert.NoError(t, err)
+	e := storage.(*Etcd)
+	t.Cleanup(func() { e.client.Close() })
+	return e
+}
+
+func TestEtcd_IsHealthy(t *testing.T) {
+	e := newTestDB(t)
+	assert.True(t, e.IsHealthy(context.Background()))
+
+	service := StorageService{}
+	unreachable := freeURL()
+	storage, err := service.New(unreachable.String())
+	assert.NoError(t, err)
+	defer storage.(*Etcd).client.Close()
+	assert.False(t, storage.IsHealthy(context.Background()))
+}
+
+func Test_parseArgs(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          string
+		wantEndpoints []string
+		wantPrefix    string
+		wantErr       bool
+	}{
+		{
+			name:          "defaultPrefix",
+			args:          "http://etcd1:2379,http://etcd2:2379",
+			wantEndpoints: []string{"http://etcd1:2379", "http://etcd2:2379"},
+			wantPrefix:    defaultPrefix,
+		},
+		{
+			name:          "customPrefix",
+			args:          "etcd1:2379?prefix=/team1",
+			wantEndpoints: []string{"etcd1:2379"},
+			wantPrefix:    "/team1/",
+		},
+		{
+			name:    "invalidQuery",
+			args:    "etcd1:2379?prefix=%zz",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoints, prefix, err := parseArgs(tt.args)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantEndpoints, endpoints)
+			assert.Equal(t, tt.wantPrefix, prefix)
+		})
+	}
+}
+
+func TestEtcd_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		return newTestDB(t)
+	})
+}
+
+func TestEtcd_Audit(t *testing.T) {
+	storagetest.RunAudit(t, func(t *testing.T) db.Storage {
+		return newTestDB(t)
+	})
+}
+
+func TestEtcd_fillNames(t *testing.T) {
+	e := newTestDB(t)
+	// targets stored by older versions have no key in the names index
+	_, err := e.client.Put(context.Background(), e.key("old"), `{"id":"old","name":"renamed","entries":[]}`)
+	assert.NoError(t, err)
+	list := []db.Target{}
+	assert.NoError(t, e.GetAll(context.Background(), &db.ListQuery{Limit: 1}, &list))
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, db.ID("old"), list[0].ID)
+	}
+	assert.NoError(t, e.Delete(context.Background(), &db.Target{ID: "old"}))
+	resp, err := e.client.Get(context.Background(), e.namesPrefix(), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), resp.Count)
+}
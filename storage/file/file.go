@@ -1,15 +1,18 @@
 package file
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"promhsd/db"
 	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/gofrs/flock"
 )
 
@@ -23,7 +26,7 @@ type FileDB struct {
 	filelock *flock.Flock
 }
 
-func (f *FileDB) IsHealthy() bool {
+func (f *FileDB) IsHealthy(ctx context.Context) bool {
 	stat, err := os.Stat(f.filepath)
 	if err != nil {
 		return false
@@ -52,21 +55,27 @@ func (f *FileDB) readFile() (map[string]db.Target, error) {
 	return targets, nil
 }
 
-func (f *FileDB) Lock() error {
+func (f *FileDB) Lock(ctx context.Context) error {
 	f.mu.Lock()
 	f.filelock = flock.New(f.filepath + ".lock")
 	for i := 0; i < 10; i++ {
 		locked, err := f.filelock.TryLock()
 		if err != nil {
+			f.mu.Unlock()
 			return err
 		}
 
 		if locked {
 			return nil
 		}
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			f.mu.Unlock()
+			return ctx.Err()
+		case <-time.After(1 * time.Second):
+		}
 	}
-
+	f.mu.Unlock()
 	return errors.New("couldn't lock file")
 }
 
@@ -89,8 +98,15 @@ func (f *FileDB) writeToFile(targets map[string]db.Target) error {
 	return nil
 }
 
-func (f *FileDB) Create(target *db.Target) error {
-	err := f.Lock()
+func (f *FileDB) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return f.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (f *FileDB) Import(ctx context.Context, target *db.Target) error {
+	err := f.Lock(ctx)
 	if err != nil {
 		return &db.StorageError{Text: "Couldn't lock file", Err: err}
 	}
@@ -99,7 +115,6 @@ func (f *FileDB) Create(target *db.Target) error {
 	if err != nil {
 		return err
 	}
-	target.ID = db.ID(target.Name)
 	if _, ok := targets[target.ID.String()]; ok {
 		return db.ErrConflict
 	}
@@ -111,8 +126,8 @@ func (f *FileDB) Create(target *db.Target) error {
 	return nil
 }
 
-func (f *FileDB) Update(target *db.Target) error {
-	err := f.Lock()
+func (f *FileDB) Update(ctx context.Context, target *db.Target) error {
+	err := f.Lock(ctx)
 	if err != nil {
 		return &db.StorageError{Text: "Couldn't lock file", Err: err}
 	}
@@ -121,19 +136,26 @@ func (f *FileDB) Update(target *db.Target) error {
 	if err != nil {
 		return err
 	}
-	if _, ok := targets[target.ID.String()]; !ok {
+	stored, ok := targets[target.ID.String()]
+	if !ok {
 		return db.ErrNotFound
 	}
-	targets[target.ID.String()] = *target
+	if stored.Revision != target.Revision {
+		return db.ErrConflict
+	}
+	next := *target
+	next.Revision++
+	targets[target.ID.String()] = next
 	err = f.writeToFile(targets)
 	if err != nil {
 		return err
 	}
+	target.Revision = next.Revision
 	return nil
 }
 
-func (f *FileDB) Delete(target *db.Target) error {
-	err := f.Lock()
+func (f *FileDB) Delete(ctx context.Context, target *db.Target) error {
+	err := f.Lock(ctx)
 	if err != nil {
 		return &db.StorageError{Text: "Couldn't lock file", Err: err}
 	}
@@ -153,7 +175,7 @@ func (f *FileDB) Delete(target *db.Target) error {
 	return nil
 }
 
-func (f *FileDB) Get(target *db.Target) error {
+func (f *FileDB) Get(ctx context.Context, target *db.Target) error {
 	targets, err := f.readFile()
 	if err != nil {
 		return err
@@ -164,10 +186,12 @@ func (f *FileDB) Get(target *db.Target) error {
 	target.Name = targets[target.ID.String()].Name
 	target.Entries = targets[target.ID.String()].Entries
 	target.Time = targets[target.ID.String()].Time
+	target.Revision = targets[target.ID.String()].Revision
+	target.ExpiresAt = targets[target.ID.String()].ExpiresAt
 	return nil
 }
 
-func (f *FileDB) GetAll(list *[]db.Target) error {
+func (f *FileDB) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
 	targets, err := f.readFile()
 	if err != nil {
 		return err
@@ -176,10 +200,81 @@ func (f *FileDB) GetAll(list *[]db.Target) error {
 	for _, v := range targets {
 		targetList = append(targetList, v)
 	}
-	*list = targetList
+	*list = query.Apply(targetList)
 	return nil
 }
 
+// Watch follows changes of the file, including changes made by other processes sharing it.
+func (f *FileDB) Watch(ctx context.Context, events chan<- db.Event) error {
+	watcher, before, err := f.startWatching()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	return f.follow(ctx, watcher, before, events)
+}
+
+// startWatching watches the directory of the file, so that the file may also be replaced,
+// and reads the targets changes are compared to.
+func (f *FileDB) startWatching() (*fsnotify.Watcher, map[db.ID]db.Target, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = watcher.Add(filepath.Dir(f.filepath)); err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+	before, err := f.readTargets()
+	if err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+	return watcher, before, nil
+}
+
+func (f *FileDB) follow(ctx context.Context, watcher *fsnotify.Watcher, before map[db.ID]db.Target, events chan<- db.Event) error {
+	name := filepath.Clean(f.filepath)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-watcher.Errors:
+			return err
+		case event := <-watcher.Events:
+			if filepath.Clean(event.Name) != name || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			// the file is read again on the next event if it is being written
+			after, err := f.readTargets()
+			if err != nil {
+				continue
+			}
+			for _, change := range db.Changes(before, after) {
+				select {
+				case events <- change:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			before = after
+		}
+	}
+}
+
+func (f *FileDB) readTargets() (map[db.ID]db.Target, error) {
+	targets, err := f.readFile()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[db.ID]db.Target, len(targets))
+	for id, target := range targets {
+		target.ID = db.ID(id)
+		byID[target.ID] = target
+	}
+	return byID, nil
+}
+
 type StorageService struct{}
 
 func (s *StorageService) ServiceID() string {
@@ -203,5 +298,7 @@ func init() {
 }
 
 var (
-	_ db.Storage = (*FileDB)(nil)
+	_ db.Storage  = (*FileDB)(nil)
+	_ db.Importer = (*FileDB)(nil)
+	_ db.Watcher  = (*FileDB)(nil)
 )
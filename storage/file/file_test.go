@@ -1,10 +1,13 @@
 package file
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"promhsd/db"
+	"promhsd/db/storagetest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -165,7 +168,7 @@ func TestFileDB_Create(t *testing.T) {
 			f := &FileDB{
 				filepath: tt.fields.filepath,
 			}
-			err := f.Create(tt.args.target)
+			err := f.Create(context.Background(), tt.args.target)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -228,7 +231,7 @@ func TestFileDB_Update(t *testing.T) {
 			f := &FileDB{
 				filepath: tt.fields.filepath,
 			}
-			err := f.Update(tt.args.target)
+			err := f.Update(context.Background(), tt.args.target)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -281,7 +284,7 @@ func TestFileDB_Delete(t *testing.T) {
 			f := &FileDB{
 				filepath: tt.fields.filepath,
 			}
-			err := f.Delete(tt.args.target)
+			err := f.Delete(context.Background(), tt.args.target)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -334,7 +337,7 @@ func TestFileDB_Get(t *testing.T) {
 			f := &FileDB{
 				filepath: tt.fields.filepath,
 			}
-			err := f.Get(tt.args.target)
+			err := f.Get(context.Background(), tt.args.target)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -378,7 +381,7 @@ func TestFileDB_GetAll(t *testing.T) {
 			f := &FileDB{
 				filepath: tt.fields.filepath,
 			}
-			err := f.GetAll(tt.args.list)
+			err := f.GetAll(context.Background(), &db.ListQuery{}, tt.args.list)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -413,3 +416,51 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestFileDB_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		service := StorageService{}
+		storage, err := service.New(filepath.Join(t.TempDir(), "db.json"))
+		assert.NoError(t, err)
+		return storage
+	})
+}
+
+func TestFileDB_Watch(t *testing.T) {
+	service := StorageService{}
+	storage, err := service.New(filepath.Join(t.TempDir(), "db.json"))
+	assert.NoError(t, err)
+	f := storage.(*FileDB)
+	watcher, before, err := f.startWatching()
+	assert.NoError(t, err)
+	defer watcher.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan db.Event)
+	go f.follow(ctx, watcher, before, events)
+
+	receive := func() db.Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event was received")
+			return db.Event{}
+		}
+	}
+	target := &db.Target{Name: "test", Entries: []db.Entry{{Targets: []string{"a:9100"}, Labels: map[string]string{"env": "prod"}}}}
+	assert.NoError(t, f.Create(context.Background(), target))
+	event := receive()
+	assert.Equal(t, db.ActionCreate, event.Action)
+	assert.Equal(t, db.ID("test"), event.Target.ID)
+
+	assert.NoError(t, f.Update(context.Background(), target))
+	event = receive()
+	assert.Equal(t, db.ActionUpdate, event.Action)
+	assert.Equal(t, int64(2), event.Target.Revision)
+
+	assert.NoError(t, f.Delete(context.Background(), target))
+	event = receive()
+	assert.Equal(t, db.ActionDelete, event.Action)
+	assert.Equal(t, db.ID("test"), event.Target.ID)
+}
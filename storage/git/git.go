@@ -0,0 +1,457 @@
+package git
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"promhsd/db"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+const (
+	StorageID   = "git"
+	fileSuffix  = ".json"
+	remoteName  = "origin"
+	remoteParam = "remote"
+	pullParam   = "pull"
+	// defaultPullInterval is how long reads serve the working tree before they fetch the remote again
+	defaultPullInterval = 10 * time.Second
+	authorName          = "PromHSD"
+	authorEmail         = "promhsd@localhost"
+)
+
+// Git keeps every target as a json file in a working tree
+// and commits each change, so that history of targets is kept in git.
+type Git struct {
+	mu     sync.RWMutex
+	path   string
+	repo   *git.Repository
+	remote string
+	// syncErr is the last failure to fetch from or push to the remote, it makes the storage unhealthy
+	syncErr error
+	// pullInterval is how often reads fetch changes pushed by other replicas
+	pullInterval time.Duration
+	// pulled is the time of the last fetch
+	pulled time.Time
+}
+
+// filename maps target ID to file name in the root of the working tree.
+func filename(id db.ID) string {
+	return url.PathEscape(id.String()) + fileSuffix
+}
+
+func (g *Git) IsHealthy(ctx context.Context) bool {
+	g.mu.RLock()
+	syncErr := g.syncErr
+	g.mu.RUnlock()
+	if syncErr != nil {
+		log.Println("Remote returns error:", syncErr.Error())
+		return false
+	}
+	repo, err := git.PlainOpen(g.path)
+	if err != nil {
+		log.Println("PlainOpen returns error:", err.Error())
+		return false
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		log.Println("Worktree returns error:", err.Error())
+		return false
+	}
+	_, err = worktree.Status()
+	if err != nil {
+		log.Println("Status returns error:", err.Error())
+		return false
+	}
+	return true
+}
+
+func (g *Git) exists(name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(g.path, name))
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+// pull resets the working tree to the branch of the remote, so that changes pushed by other replicas
+// are written upon. Every commit is pushed before a change succeeds, so no local change is lost.
+func (g *Git) pull(ctx context.Context) error {
+	if g.remote == "" {
+		return nil
+	}
+	g.pulled = time.Now()
+	err := g.repo.FetchContext(ctx, &git.FetchOptions{RemoteName: remoteName})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		g.syncErr = err
+		return &db.StorageError{Text: "Couldn't fetch", Err: err}
+	}
+	g.syncErr = nil
+	return g.reset()
+}
+
+// refresh pulls before a read once pullInterval has passed since the last fetch.
+// A failed fetch makes the storage unhealthy, the read is served from the working tree.
+func (g *Git) refresh(ctx context.Context) {
+	if g.remote == "" {
+		return
+	}
+	g.mu.RLock()
+	fresh := time.Since(g.pulled) < g.pullInterval
+	g.mu.RUnlock()
+	if fresh {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.pulled) < g.pullInterval {
+		return
+	}
+	if err := g.pull(ctx); err != nil {
+		log.Println("Failed to Pull:", err)
+	}
+}
+
+// reset moves the branch and the working tree to the fetched branch of the remote, if there is one.
+func (g *Git) reset() error {
+	head, err := g.repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't read HEAD", Err: err}
+	}
+	remoteRef, err := g.repo.Reference(plumbing.NewRemoteReferenceName(remoteName, head.Target().Short()), true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil
+	}
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't read the remote branch", Err: err}
+	}
+	// the branch of a repository which was initialized before anything was pushed has no commits yet
+	if _, err = g.repo.Reference(head.Target(), false); errors.Is(err, plumbing.ErrReferenceNotFound) {
+		if err = g.repo.Storer.SetReference(plumbing.NewHashReference(head.Target(), remoteRef.Hash())); err != nil {
+			return &db.StorageError{Text: "Couldn't create the branch", Err: err}
+		}
+	}
+	worktree, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err = worktree.Reset(&git.ResetOptions{Commit: remoteRef.Hash(), Mode: git.HardReset}); err != nil {
+		return &db.StorageError{Text: "Couldn't reset to the remote branch", Err: err}
+	}
+	return nil
+}
+
+// commit records the change made by stage and pushes it if remote is configured.
+// A failed push is undone locally: a push rejected because another replica pushed first is a conflict.
+func (g *Git) commit(ctx context.Context, message string, stage func(*git.Worktree) error) error {
+	worktree, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err = stage(worktree); err != nil {
+		g.discard()
+		return err
+	}
+	// deleting the last target leaves the index empty,
+	// go-git refuses to commit it unless empty commits are allowed
+	_, err = worktree.Commit(message, &git.CommitOptions{
+		Author:            &object.Signature{Name: authorName, Email: authorEmail, When: time.Now()},
+		AllowEmptyCommits: true,
+	})
+	if err != nil {
+		g.discard()
+		return &db.StorageError{Text: "Couldn't commit", Err: err}
+	}
+	if g.remote == "" {
+		return nil
+	}
+	err = g.repo.PushContext(ctx, &git.PushOptions{RemoteName: remoteName})
+	if err == nil || errors.Is(err, git.NoErrAlreadyUpToDate) {
+		g.syncErr = nil
+		return nil
+	}
+	log.Println("Failed to Push:", err)
+	if resetErr := g.reset(); resetErr != nil {
+		log.Println("Failed to undo the commit:", resetErr)
+	}
+	if errors.Is(err, git.ErrForceNeeded) {
+		return db.ErrConflict
+	}
+	g.syncErr = err
+	return &db.StorageError{Text: "Couldn't push", Err: err}
+}
+
+// discard drops the uncommitted change of the working tree and the index.
+func (g *Git) discard() {
+	worktree, err := g.repo.Worktree()
+	if err != nil {
+		log.Println("Failed to discard the change:", err)
+		return
+	}
+	if _, err = g.repo.Head(); err == nil {
+		err = worktree.Reset(&git.ResetOptions{Mode: git.HardReset})
+	} else {
+		// nothing is committed yet, the index has only the change
+		err = g.repo.Storer.SetIndex(&index.Index{Version: 2})
+	}
+	if err == nil {
+		// a created file isn't in HEAD, the reset leaves it untracked
+		err = worktree.Clean(&git.CleanOptions{})
+	}
+	if err != nil {
+		log.Println("Failed to discard the change:", err)
+	}
+}
+
+func (g *Git) write(target *db.Target) error {
+	value, err := json.MarshalIndent(target, "", "  ")
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	err = os.WriteFile(filepath.Join(g.path, filename(target.ID)), value, 0644)
+	if err != nil {
+		log.Println(err)
+		return &db.StorageError{Text: "Couldn't write file", Err: err}
+	}
+	return nil
+}
+
+func add(name string) func(*git.Worktree) error {
+	return func(worktree *git.Worktree) error {
+		if _, err := worktree.Add(name); err != nil {
+			return &db.StorageError{Text: "Couldn't add file", Err: err}
+		}
+		return nil
+	}
+}
+
+func remove(name string) func(*git.Worktree) error {
+	return func(worktree *git.Worktree) error {
+		if _, err := worktree.Remove(name); err != nil {
+			return &db.StorageError{Text: "Couldn't remove file", Err: err}
+		}
+		return nil
+	}
+}
+
+func (g *Git) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return g.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (g *Git) Import(ctx context.Context, target *db.Target) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.pull(ctx); err != nil {
+		return err
+	}
+	name := filename(target.ID)
+	ok, err := g.exists(name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return db.ErrConflict
+	}
+	if err = g.write(target); err != nil {
+		g.discard()
+		return err
+	}
+	return g.commit(ctx, fmt.Sprintf("Create target %s", target.Name), add(name))
+}
+
+func (g *Git) Update(ctx context.Context, target *db.Target) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.pull(ctx); err != nil {
+		return err
+	}
+	name := filename(target.ID)
+	var stored db.Target
+	if err := g.read(name, &stored); err != nil {
+		return err
+	}
+	if stored.Revision != target.Revision {
+		return db.ErrConflict
+	}
+	next := *target
+	next.Revision++
+	if err := g.write(&next); err != nil {
+		g.discard()
+		return err
+	}
+	if err := g.commit(ctx, fmt.Sprintf("Update target %s", target.Name), add(name)); err != nil {
+		return err
+	}
+	target.Revision = next.Revision
+	return nil
+}
+
+func (g *Git) Delete(ctx context.Context, target *db.Target) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.pull(ctx); err != nil {
+		return err
+	}
+	name := filename(target.ID)
+	var stored db.Target
+	if err := g.read(name, &stored); err != nil {
+		return err
+	}
+	return g.commit(ctx, fmt.Sprintf("Delete target %s", stored.Name), remove(name))
+}
+
+func (g *Git) read(name string, target *db.Target) error {
+	value, err := os.ReadFile(filepath.Join(g.path, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return db.ErrNotFound
+		}
+		return &db.StorageError{Text: "Couldn't open a file", Err: err}
+	}
+	err = json.Unmarshal(value, target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't decode json", Err: err}
+	}
+	return nil
+}
+
+func (g *Git) Get(ctx context.Context, target *db.Target) error {
+	g.refresh(ctx)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.read(filename(target.ID), target)
+}
+
+// GetAll reads all files of the working tree, the query is applied to them.
+func (g *Git) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	g.refresh(ctx)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	files, err := os.ReadDir(g.path)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't read directory", Err: err}
+	}
+	names := []string{}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), fileSuffix) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	targets := make([]db.Target, 0, len(names))
+	for _, name := range names {
+		var target db.Target
+		err = g.read(name, &target)
+		if err == db.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target)
+	}
+	*list = query.Apply(targets)
+	return nil
+}
+
+// open opens existing repository, otherwise clones remote or initializes a new one.
+func open(path, remote string) (*git.Repository, error) {
+	repo, err := git.PlainOpen(path)
+	if err == nil {
+		return repo, nil
+	}
+	if !errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil, err
+	}
+	if remote != "" {
+		repo, err = git.PlainClone(path, false, &git.CloneOptions{URL: remote, RemoteName: remoteName})
+		if err == nil {
+			return repo, nil
+		}
+		if !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			return nil, err
+		}
+		os.RemoveAll(filepath.Join(path, git.GitDirName))
+	}
+	repo, err = git.PlainInit(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if remote != "" {
+		_, err = repo.CreateRemote(&config.RemoteConfig{Name: remoteName, URLs: []string{remote}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// parseArgs splits "/data/targets?remote=git@github.com:org/targets.git&pull=1m" into its parts.
+func parseArgs(args string) (path, remote string, pullInterval time.Duration, err error) {
+	path, rawQuery, _ := strings.Cut(args, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if path == "" {
+		return "", "", 0, errors.New("path is empty")
+	}
+	pullInterval = defaultPullInterval
+	if value := query.Get(pullParam); value != "" {
+		pullInterval, err = time.ParseDuration(value)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("invalid %s: %w", pullParam, err)
+		}
+	}
+	return path, query.Get(remoteParam), pullInterval, nil
+}
+
+type StorageService struct{}
+
+func (s *StorageService) ServiceID() string {
+	return StorageID
+}
+
+func (s *StorageService) New(args string) (db.Storage, error) {
+	path, remote, pullInterval, err := parseArgs(args)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	repo, err := open(path, remote)
+	if err != nil {
+		log.Println(err)
+		return nil, &db.StorageError{Text: "Couldn't open repository", Err: err}
+	}
+	return &Git{path: path, repo: repo, remote: remote, pullInterval: pullInterval}, nil
+}
+
+func init() {
+	db.RegisterStorage(&StorageService{})
+}
+
+var (
+	_ db.Storage  = (*Git)(nil)
+	_ db.Importer = (*Git)(nil)
+)
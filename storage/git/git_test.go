@@ -0,0 +1,199 @@
+package git
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDB(t *testing.T, remote string) *Git {
+	service := StorageService{}
+	args := t.TempDir()
+	if remote != "" {
+		args += "?remote=" + remote
+	}
+	storage, err := service.New(args)
+	assert.NoError(t, err)
+	g := storage.(*Git)
+	return g
+}
+
+func commitMessages(t *testing.T, repo *git.Repository) []string {
+	messages := []string{}
+	iter, err := repo.Log(&git.LogOptions{})
+	assert.NoError(t, err)
+	iter.ForEach(func(c *object.Commit) error {
+		messages = append(messages, c.Message)
+		return nil
+	})
+	return messages
+}
+
+func TestGit_commits(t *testing.T) {
+	g := newTestDB(t, "")
+	target := &db.Target{Name: "test"}
+	assert.NoError(t, g.Create(context.Background(), target))
+	assert.FileExists(t, filepath.Join(g.path, "test.json"))
+	target.Name = "renamed"
+	assert.NoError(t, g.Update(context.Background(), target))
+	assert.NoError(t, g.Delete(context.Background(), target))
+	assert.NoFileExists(t, filepath.Join(g.path, "test.json"))
+	assert.Equal(t, []string{"Delete target renamed", "Update target renamed", "Create target test"}, commitMessages(t, g.repo))
+}
+
+func TestGit_discard(t *testing.T) {
+	g := newTestDB(t, "")
+	// nothing is committed yet
+	assert.NoError(t, g.write(&db.Target{ID: "a", Name: "a"}))
+	assert.NoError(t, add("a.json")(mustWorktree(t, g)))
+	g.discard()
+	assert.NoFileExists(t, filepath.Join(g.path, "a.json"))
+
+	assert.NoError(t, g.Create(context.Background(), &db.Target{Name: "a"}))
+	assert.NoError(t, g.write(&db.Target{ID: "a", Name: "changed"}))
+	assert.NoError(t, g.write(&db.Target{ID: "b", Name: "b"}))
+	assert.NoError(t, add("b.json")(mustWorktree(t, g)))
+	g.discard()
+	target := &db.Target{ID: "a"}
+	assert.NoError(t, g.Get(context.Background(), target))
+	assert.Equal(t, "a", target.Name)
+	assert.NoFileExists(t, filepath.Join(g.path, "b.json"))
+}
+
+func mustWorktree(t *testing.T, g *Git) *git.Worktree {
+	worktree, err := g.repo.Worktree()
+	assert.NoError(t, err)
+	return worktree
+}
+
+func TestGit_IsHealthy(t *testing.T) {
+	g := newTestDB(t, "")
+	assert.True(t, g.IsHealthy(context.Background()))
+	os.RemoveAll(filepath.Join(g.path, git.GitDirName))
+	assert.False(t, g.IsHealthy(context.Background()))
+}
+
+func TestGit_push(t *testing.T) {
+	remote := t.TempDir()
+	bare, err := git.PlainInit(remote, true)
+	assert.NoError(t, err)
+
+	g := newTestDB(t, remote)
+	assert.NoError(t, g.Create(context.Background(), &db.Target{Name: "test"}))
+	assert.NoError(t, g.Update(context.Background(), &db.Target{ID: "test", Name: "test", Revision: db.FirstRevision}))
+	assert.Equal(t, []string{"Update target test", "Create target test"}, commitMessages(t, bare))
+
+	// second replica clones the history from the remote
+	clone := newTestDB(t, remote)
+	list := []db.Target{}
+	assert.NoError(t, clone.GetAll(context.Background(), &db.ListQuery{}, &list))
+	assert.Len(t, list, 1)
+}
+
+func TestGit_pull(t *testing.T) {
+	remote := t.TempDir()
+	_, err := git.PlainInit(remote, true)
+	assert.NoError(t, err)
+	a := newTestDB(t, remote)
+	b := newTestDB(t, remote)
+
+	assert.NoError(t, a.Create(context.Background(), &db.Target{Name: "a"}))
+	// b writes upon the change pushed by a
+	assert.NoError(t, b.Create(context.Background(), &db.Target{Name: "b"}))
+	assert.Equal(t, db.ErrConflict, b.Create(context.Background(), &db.Target{Name: "a"}))
+	assert.NoError(t, b.Delete(context.Background(), &db.Target{ID: "a"}))
+
+	assert.NoError(t, a.Create(context.Background(), &db.Target{Name: "c"}))
+	list := []db.Target{}
+	assert.NoError(t, a.GetAll(context.Background(), &db.ListQuery{}, &list))
+	assert.Equal(t, []db.ID{"b", "c"}, []db.ID{list[0].ID, list[1].ID})
+	assert.Len(t, list, 2)
+
+	// reads of b fetch the change of a once the pull interval has passed
+	b.pullInterval = 0
+	assert.NoError(t, b.Get(context.Background(), &db.Target{ID: "c"}))
+}
+
+func TestGit_pushError(t *testing.T) {
+	remote := t.TempDir()
+	_, err := git.PlainInit(remote, true)
+	assert.NoError(t, err)
+	g := newTestDB(t, remote)
+	assert.NoError(t, g.Create(context.Background(), &db.Target{Name: "a"}))
+	assert.True(t, g.IsHealthy(context.Background()))
+
+	os.RemoveAll(remote)
+	err = g.Create(context.Background(), &db.Target{Name: "b"})
+	assert.IsType(t, &db.StorageError{}, err)
+	assert.False(t, g.IsHealthy(context.Background()))
+	assert.Equal(t, db.ErrNotFound, g.Get(context.Background(), &db.Target{ID: "b"}))
+}
+
+func Test_parseArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       string
+		wantPath   string
+		wantRemote string
+		wantPull   time.Duration
+		wantErr    bool
+	}{
+		{
+			name:     "pathOnly",
+			args:     "/data/targets",
+			wantPath: "/data/targets",
+			wantPull: defaultPullInterval,
+		},
+		{
+			name:       "remote",
+			args:       "/data/targets?remote=https://github.com/org/targets.git",
+			wantPath:   "/data/targets",
+			wantRemote: "https://github.com/org/targets.git",
+			wantPull:   defaultPullInterval,
+		},
+		{
+			name:       "pull",
+			args:       "/data/targets?remote=/tmp/remote&pull=1m",
+			wantPath:   "/data/targets",
+			wantRemote: "/tmp/remote",
+			wantPull:   time.Minute,
+		},
+		{
+			name:    "invalidPull",
+			args:    "/data/targets?pull=often",
+			wantErr: true,
+		},
+		{
+			name:    "emptyPath",
+			args:    "?remote=/tmp/remote",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, remote, pullInterval, err := parseArgs(tt.args)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantPath, path)
+			assert.Equal(t, tt.wantRemote, remote)
+			assert.Equal(t, tt.wantPull, pullInterval)
+		})
+	}
+}
+
+func TestGit_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		return newTestDB(t, "")
+	})
+}
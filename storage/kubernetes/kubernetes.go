@@ -0,0 +1,271 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"promhsd/db"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	StorageID        = "kubernetes"
+	defaultName      = "promhsd-targets"
+	keySuffix        = ".json"
+	encodedKeyPrefix = "b64-"
+	managedByLabel   = "app.kubernetes.io/managed-by"
+	managedByValue   = "promhsd"
+)
+
+// Kubernetes keeps all targets in a single ConfigMap, one data key per target.
+// Every change is a read-modify-write of the ConfigMap guarded by resourceVersion,
+// the change is retried when another replica has updated the ConfigMap meanwhile.
+type Kubernetes struct {
+	configMaps typedcorev1.ConfigMapInterface
+	name       string
+}
+
+// dataKey maps target ID to ConfigMap data key,
+// IDs which are not valid keys are base64 encoded.
+func dataKey(id db.ID) string {
+	key := id.String() + keySuffix
+	if !strings.HasPrefix(key, encodedKeyPrefix) && len(validation.IsConfigMapKey(key)) == 0 {
+		return key
+	}
+	return encodedKeyPrefix + base64.RawURLEncoding.EncodeToString([]byte(id)) + keySuffix
+}
+
+func (k *Kubernetes) IsHealthy(ctx context.Context) bool {
+	_, err := k.configMaps.Get(ctx, k.name, metav1.GetOptions{})
+	if err != nil {
+		log.Println("Get ConfigMap returns error:", err.Error())
+		return false
+	}
+	return true
+}
+
+// modify applies change to the latest ConfigMap and writes it back,
+// the whole cycle is repeated on resourceVersion conflicts.
+func (k *Kubernetes) modify(ctx context.Context, change func(data map[string]string) error) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := k.configMaps.Get(ctx, k.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		if err = change(configMap.Data); err != nil {
+			return err
+		}
+		_, err = k.configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	})
+	if apierrors.IsConflict(err) {
+		log.Println("Failed to Update the ConfigMap:", err)
+		return db.ErrConflict
+	}
+	return err
+}
+
+func (k *Kubernetes) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return k.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (k *Kubernetes) Import(ctx context.Context, target *db.Target) error {
+	value, err := json.Marshal(target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	key := dataKey(target.ID)
+	return k.modify(ctx, func(data map[string]string) error {
+		if _, ok := data[key]; ok {
+			return db.ErrConflict
+		}
+		data[key] = string(value)
+		return nil
+	})
+}
+
+// Update compares revisions inside modify, the resourceVersion of the ConfigMap makes the check atomic.
+func (k *Kubernetes) Update(ctx context.Context, target *db.Target) error {
+	next := *target
+	next.Revision++
+	value, err := json.Marshal(&next)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	key := dataKey(target.ID)
+	err = k.modify(ctx, func(data map[string]string) error {
+		current, ok := data[key]
+		if !ok {
+			return db.ErrNotFound
+		}
+		var stored db.Target
+		if err := json.Unmarshal([]byte(current), &stored); err != nil {
+			return &db.StorageError{Text: "Couldn't decode json", Err: err}
+		}
+		if stored.Revision != target.Revision {
+			return db.ErrConflict
+		}
+		data[key] = string(value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	target.Revision = next.Revision
+	return nil
+}
+
+func (k *Kubernetes) Delete(ctx context.Context, target *db.Target) error {
+	key := dataKey(target.ID)
+	return k.modify(ctx, func(data map[string]string) error {
+		if _, ok := data[key]; !ok {
+			return db.ErrNotFound
+		}
+		delete(data, key)
+		return nil
+	})
+}
+
+func (k *Kubernetes) Get(ctx context.Context, target *db.Target) error {
+	configMap, err := k.configMaps.Get(ctx, k.name, metav1.GetOptions{})
+	if err != nil {
+		log.Println("Failed to Get the ConfigMap:", err)
+		return err
+	}
+	value, ok := configMap.Data[dataKey(target.ID)]
+	if !ok {
+		return db.ErrNotFound
+	}
+	err = json.Unmarshal([]byte(value), target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't decode json", Err: err}
+	}
+	return nil
+}
+
+func (k *Kubernetes) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	configMap, err := k.configMaps.Get(ctx, k.name, metav1.GetOptions{})
+	if err != nil {
+		log.Println("Failed to Get the ConfigMap:", err)
+		return err
+	}
+	keys := make([]string, 0, len(configMap.Data))
+	for key := range configMap.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	targets := make([]db.Target, 0, len(keys))
+	for _, key := range keys {
+		var target db.Target
+		err = json.Unmarshal([]byte(configMap.Data[key]), &target)
+		if err != nil {
+			return &db.StorageError{Text: "Couldn't decode json", Err: err}
+		}
+		targets = append(targets, target)
+	}
+	*list = query.Apply(targets)
+	return nil
+}
+
+func (k *Kubernetes) createConfigMap() error {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   k.name,
+			Labels: map[string]string{managedByLabel: managedByValue},
+		},
+		Data: map[string]string{},
+	}
+	_, err := k.configMaps.Create(context.TODO(), configMap, metav1.CreateOptions{})
+	if err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// parseArgs accepts ConfigMap name in "name" or "namespace/name" form.
+func parseArgs(args string) (namespace, name string) {
+	namespace, name, found := strings.Cut(args, "/")
+	if !found {
+		namespace, name = "", args
+	}
+	if name == "" {
+		name = defaultName
+	}
+	return namespace, name
+}
+
+type StorageService struct{}
+
+func (s *StorageService) ServiceID() string {
+	return StorageID
+}
+
+// New uses in-cluster service account or KUBECONFIG outside of the cluster,
+// ConfigMap is created in the pod's namespace unless another one is given.
+func (s *StorageService) New(args string) (db.Storage, error) {
+	namespace, name := parseArgs(args)
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{},
+	)
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if namespace == "" {
+		namespace, _, err = clientConfig.Namespace()
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return newStorage(clientset, namespace, name)
+}
+
+func newStorage(clientset kubernetes.Interface, namespace, name string) (*Kubernetes, error) {
+	db := &Kubernetes{
+		configMaps: clientset.CoreV1().ConfigMaps(namespace),
+		name:       name,
+	}
+	err := db.createConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func init() {
+	db.RegisterStorage(&StorageService{})
+}
+
+var (
+	_ db.Storage  = (*Kubernetes)(nil)
+	_ db.Importer = (*Kubernetes)(nil)
+)
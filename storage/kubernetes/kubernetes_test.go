@@ -0,0 +1,161 @@
+package kubernetes
+
+import (
+	"context"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestDB(t *testing.T) (*Kubernetes, *fake.Clientset) {
+	clientset := fake.NewSimpleClientset()
+	k, err := newStorage(clientset, "monitoring", defaultName)
+	assert.NoError(t, err)
+	return k, clientset
+}
+
+// conflictOnUpdate makes the next n ConfigMap updates fail as if another replica won the race.
+func conflictOnUpdate(clientset *fake.Clientset, n int) {
+	clientset.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if n == 0 {
+			return false, nil, nil
+		}
+		n--
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, defaultName, nil)
+	})
+}
+
+func TestKubernetes_configMap(t *testing.T) {
+	k, clientset := newTestDB(t)
+	assert.NoError(t, k.Create(context.Background(), &db.Target{Name: "web servers"}))
+	configMap, err := clientset.CoreV1().ConfigMaps("monitoring").Get(context.TODO(), defaultName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, configMap.Data, dataKey("web servers"))
+	assert.Equal(t, managedByValue, configMap.Labels[managedByLabel])
+
+	target := &db.Target{ID: "web servers"}
+	assert.NoError(t, k.Get(context.Background(), target))
+	assert.Equal(t, "web servers", target.Name)
+}
+
+func TestKubernetes_modify(t *testing.T) {
+	tests := []struct {
+		name      string
+		conflicts int
+		wantErr   error
+	}{
+		{
+			name:      "retriedConflict",
+			conflicts: 1,
+			wantErr:   nil,
+		},
+		{
+			name:      "persistentConflict",
+			conflicts: 100,
+			wantErr:   db.ErrConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, clientset := newTestDB(t)
+			assert.NoError(t, k.Create(context.Background(), &db.Target{Name: "test"}))
+			conflictOnUpdate(clientset, tt.conflicts)
+			err := k.Update(context.Background(), &db.Target{Name: "test", ID: "test", Revision: db.FirstRevision})
+			assert.Equal(t, tt.wantErr, err)
+		})
+	}
+}
+
+func TestKubernetes_IsHealthy(t *testing.T) {
+	k, clientset := newTestDB(t)
+	assert.True(t, k.IsHealthy(context.Background()))
+	err := clientset.CoreV1().ConfigMaps("monitoring").Delete(context.TODO(), defaultName, metav1.DeleteOptions{})
+	assert.NoError(t, err)
+	assert.False(t, k.IsHealthy(context.Background()))
+}
+
+func Test_newStorage(t *testing.T) {
+	k, clientset := newTestDB(t)
+	assert.NoError(t, k.Create(context.Background(), &db.Target{Name: "test"}))
+	// existing ConfigMap is reused
+	_, err := newStorage(clientset, "monitoring", defaultName)
+	assert.NoError(t, err)
+	assert.NoError(t, k.Get(context.Background(), &db.Target{ID: "test"}))
+}
+
+func Test_dataKey(t *testing.T) {
+	tests := []struct {
+		name string
+		id   db.ID
+		want string
+	}{
+		{
+			name: "validKey",
+			id:   "node-exporter_1.prod",
+			want: "node-exporter_1.prod.json",
+		},
+		{
+			name: "invalidKey",
+			id:   "web servers",
+			want: "b64-d2ViIHNlcnZlcnM.json",
+		},
+		{
+			name: "reservedPrefix",
+			id:   "b64-test",
+			want: "b64-YjY0LXRlc3Q.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, dataKey(tt.id))
+		})
+	}
+}
+
+func Test_parseArgs(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          string
+		wantNamespace string
+		wantName      string
+	}{
+		{
+			name:     "default",
+			args:     "",
+			wantName: defaultName,
+		},
+		{
+			name:     "nameOnly",
+			args:     "targets",
+			wantName: "targets",
+		},
+		{
+			name:          "namespaceAndName",
+			args:          "monitoring/targets",
+			wantNamespace: "monitoring",
+			wantName:      "targets",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, name := parseArgs(tt.args)
+			assert.Equal(t, tt.wantNamespace, namespace)
+			assert.Equal(t, tt.wantName, name)
+		})
+	}
+}
+
+func TestKubernetes_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		storage, _ := newTestDB(t)
+		return storage
+	})
+}
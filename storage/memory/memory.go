@@ -0,0 +1,191 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"promhsd/db"
+	"sort"
+	"sync"
+)
+
+const (
+	StorageID = "memory"
+)
+
+// Memory keeps targets in process memory, nothing survives a restart.
+type Memory struct {
+	mu      sync.RWMutex
+	targets map[db.ID]db.Target
+	// audit is sorted by time, records of the same time are in the order they were written
+	audit []db.AuditRecord
+}
+
+// clone makes a deep copy, so that callers can't change stored targets.
+func clone(target db.Target) db.Target {
+	entries := make([]db.Entry, 0, len(target.Entries))
+	for _, e := range target.Entries {
+		entry := db.Entry{
+			Targets: append([]string{}, e.Targets...),
+			Labels:  make(map[string]string, len(e.Labels)),
+		}
+		for k, v := range e.Labels {
+			entry.Labels[k] = v
+		}
+		entries = append(entries, entry)
+	}
+	target.Entries = entries
+	return target
+}
+
+func (m *Memory) IsHealthy(ctx context.Context) bool {
+	return true
+}
+
+func (m *Memory) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return m.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (m *Memory) Import(ctx context.Context, target *db.Target) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.targets[target.ID]; ok {
+		return db.ErrConflict
+	}
+	m.targets[target.ID] = clone(*target)
+	return nil
+}
+
+func (m *Memory) Update(ctx context.Context, target *db.Target) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.targets[target.ID]
+	if !ok {
+		return db.ErrNotFound
+	}
+	if stored.Revision != target.Revision {
+		return db.ErrConflict
+	}
+	target.Revision++
+	m.targets[target.ID] = clone(*target)
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, target *db.Target) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.targets[target.ID]; !ok {
+		return db.ErrNotFound
+	}
+	delete(m.targets, target.ID)
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, target *db.Target) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored, ok := m.targets[target.ID]
+	if !ok {
+		return db.ErrNotFound
+	}
+	*target = clone(stored)
+	return nil
+}
+
+func (m *Memory) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	targets := make([]db.Target, 0, len(m.targets))
+	for _, target := range m.targets {
+		targets = append(targets, target)
+	}
+	targets = query.Apply(targets)
+	for i := range targets {
+		targets[i] = clone(targets[i])
+	}
+	*list = targets
+	return nil
+}
+
+// WriteAudit keeps the record along with targets, it is lost on restart as well.
+func (m *Memory) WriteAudit(ctx context.Context, record *db.AuditRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := sort.Search(len(m.audit), func(i int) bool { return m.audit[i].Time.After(record.Time) })
+	m.audit = append(m.audit, db.AuditRecord{})
+	copy(m.audit[i+1:], m.audit[i:])
+	m.audit[i] = *record
+	return nil
+}
+
+func (m *Memory) QueryAudit(ctx context.Context, query *db.AuditQuery, records *[]db.AuditRecord) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	first := 0
+	if !query.From.IsZero() {
+		first = sort.Search(len(m.audit), func(i int) bool { return !m.audit[i].Time.Before(query.From) })
+	}
+	last := len(m.audit)
+	if !query.To.IsZero() {
+		last = sort.Search(len(m.audit), func(i int) bool { return m.audit[i].Time.After(query.To) })
+	}
+	result := []db.AuditRecord{}
+	if first < last {
+		result = append(result, m.audit[first:last]...)
+	}
+	*records = result
+	return nil
+}
+
+// seed loads targets from a json file in the same format FileDB uses.
+func (m *Memory) seed(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Println(err)
+		return &db.StorageError{Text: "Couldn't open a file", Err: err}
+	}
+	targets := map[string]db.Target{}
+	err = json.Unmarshal(data, &targets)
+	if err != nil {
+		log.Println(err)
+		return &db.StorageError{Text: "Couldn't decode json", Err: err}
+	}
+	for id, target := range targets {
+		target.ID = db.ID(id)
+		m.targets[target.ID] = clone(target)
+	}
+	return nil
+}
+
+type StorageService struct{}
+
+func (s *StorageService) ServiceID() string {
+	return StorageID
+}
+
+// New returns empty storage, if path is given targets are seeded from the file.
+func (s *StorageService) New(path string) (db.Storage, error) {
+	db := &Memory{targets: map[db.ID]db.Target{}}
+	if path == "" {
+		return db, nil
+	}
+	err := db.seed(path)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func init() {
+	db.RegisterStorage(&StorageService{})
+}
+
+var (
+	_ db.Storage    = (*Memory)(nil)
+	_ db.Importer   = (*Memory)(nil)
+	_ db.AuditStore = (*Memory)(nil)
+)
@@ -0,0 +1,125 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDB(t *testing.T) *Memory {
+	service := StorageService{}
+	storage, err := service.New("")
+	assert.NoError(t, err)
+	m := storage.(*Memory)
+	return m
+}
+
+func TestMemory_GetIsolation(t *testing.T) {
+	entry := db.Entry{Targets: []string{"127.0.0.1:9100"}, Labels: map[string]string{"env": "test"}}
+	target := db.Target{Name: "test", Entries: []db.Entry{entry}}
+	m := newTestDB(t)
+	assert.NoError(t, m.Create(context.Background(), &target))
+	// changes made by the caller don't leak into the storage
+	entry.Labels["env"] = "prod"
+	got := &db.Target{ID: "test"}
+	assert.NoError(t, m.Get(context.Background(), got))
+	got.Entries[0].Targets[0] = "changed"
+	again := &db.Target{ID: "test"}
+	assert.NoError(t, m.Get(context.Background(), again))
+	assert.Equal(t, "test", again.Entries[0].Labels["env"])
+	assert.Equal(t, "127.0.0.1:9100", again.Entries[0].Targets[0])
+}
+
+func TestMemory_Concurrency(t *testing.T) {
+	m := newTestDB(t)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := &db.Target{Name: fmt.Sprintf("test%d", i)}
+			assert.NoError(t, m.Create(context.Background(), target))
+			assert.NoError(t, m.Update(context.Background(), target))
+			list := []db.Target{}
+			assert.NoError(t, m.GetAll(context.Background(), &db.ListQuery{}, &list))
+		}(i)
+	}
+	wg.Wait()
+	list := []db.Target{}
+	assert.NoError(t, m.GetAll(context.Background(), &db.ListQuery{}, &list))
+	assert.Len(t, list, 50)
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	seedOk := filepath.Join(dir, "seed.json")
+	os.WriteFile(seedOk, []byte(`{"test": {"name": "test"}, "test1": {"name": "test1"}}`), 0644)
+	seedWrong := filepath.Join(dir, "wrong.json")
+	os.WriteFile(seedWrong, []byte("----"), 0644)
+	type args struct {
+		path string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "noSeed",
+			args: args{path: ""},
+			want: 0,
+		},
+		{
+			name: "seedOk",
+			args: args{path: seedOk},
+			want: 2,
+		},
+		{
+			name:    "seedDataIsInvalid",
+			args:    args{path: seedWrong},
+			wantErr: true,
+		},
+		{
+			name:    "seedNotExist",
+			args:    args{path: filepath.Join(dir, "notExist.json")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := StorageService{}
+			got, err := service.New(tt.args.path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			list := []db.Target{}
+			assert.NoError(t, got.GetAll(context.Background(), &db.ListQuery{}, &list))
+			assert.Len(t, list, tt.want)
+			if tt.want > 0 {
+				assert.Equal(t, db.ID("test"), list[0].ID)
+			}
+		})
+	}
+}
+
+func TestMemory_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		return newTestDB(t)
+	})
+}
+
+func TestMemory_Audit(t *testing.T) {
+	storagetest.RunAudit(t, func(t *testing.T) db.Storage {
+		return newTestDB(t)
+	})
+}
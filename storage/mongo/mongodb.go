@@ -1,10 +1,13 @@
 package mongo
 
 import (
+	"errors"
 	"log"
 	"net/url"
 	"promhsd/db"
+	"regexp"
 	"strings"
+	"time"
 
 	"context"
 
@@ -17,21 +20,39 @@ import (
 const (
 	StorageID      = "mongodb"
 	collectionName = "targets"
+	// auditCollection keeps audit records apart from targets
+	auditCollection = "audit"
+	// indexTimeout limits creating indexes when the storage is opened.
+	indexTimeout = 10 * time.Second
+	// migrateTimeout limits migrating documents of older versions when the storage is opened.
+	migrateTimeout = time.Minute
 )
 
 type MongoDB struct {
 	dbName string
 	client *mongo.Client
+	// expires tells that the expiry index was created
+	expires bool
 }
 
-func (c *MongoDB) IsHealthy() bool {
-	err := c.client.Ping(context.TODO(), nil)
+func (c *MongoDB) IsHealthy(ctx context.Context) bool {
+	err := c.client.Ping(ctx, nil)
 	return err == nil
 }
 
-func (c *MongoDB) Create(target *db.Target) error {
+func (c *MongoDB) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return c.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (c *MongoDB) Import(ctx context.Context, target *db.Target) error {
 	coll := c.client.Database(c.dbName).Collection(collectionName)
-	_, err := coll.InsertOne(context.TODO(), target)
+	_, err := coll.InsertOne(ctx, target)
+	if mongo.IsDuplicateKeyError(err) {
+		return db.ErrConflict
+	}
 	if err != nil {
 		log.Println("Failed to Insert the document:", err)
 		return err
@@ -39,57 +60,301 @@ func (c *MongoDB) Create(target *db.Target) error {
 	return nil
 }
 
-func (c *MongoDB) Delete(target *db.Target) error {
-	id, _ := primitive.ObjectIDFromHex(target.ID.String())
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
+func (c *MongoDB) Delete(ctx context.Context, target *db.Target) error {
+	filter := bson.D{primitive.E{Key: "_id", Value: target.ID.String()}}
 	coll := c.client.Database(c.dbName).Collection(collectionName)
-	_, err := coll.DeleteOne(context.TODO(), filter)
+	result, err := coll.DeleteOne(ctx, filter)
 	if err != nil {
 		log.Println("Failed to Delete the document:", err)
 		return err
 	}
+	if result.DeletedCount == 0 {
+		return db.ErrNotFound
+	}
 	return nil
 }
 
-func (c *MongoDB) Get(target *db.Target) error {
-	id, _ := primitive.ObjectIDFromHex(target.ID.String())
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
+func (c *MongoDB) Get(ctx context.Context, target *db.Target) error {
+	filter := bson.D{primitive.E{Key: "_id", Value: target.ID.String()}}
 	coll := c.client.Database(c.dbName).Collection(collectionName)
-	err := coll.FindOne(context.TODO(), filter).Decode(target)
+	err := coll.FindOne(ctx, filter).Decode(target)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return db.ErrNotFound
+	}
 	if err != nil {
 		log.Println("Failed to Find the document:", err)
-		return db.ErrNotFound
+		return err
 	}
 	return nil
 }
 
-func (c *MongoDB) Update(target *db.Target) error {
-	id, _ := primitive.ObjectIDFromHex(target.ID.String())
-	filter := bson.D{primitive.E{Key: "_id", Value: id}}
+// revisionFilter matches the revision of the target,
+// documents stored before revisions have no field and match revision 0.
+func revisionFilter(revision int64) primitive.E {
+	if revision == 0 {
+		return primitive.E{Key: "revision", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{0, nil}}}}
+	}
+	return primitive.E{Key: "revision", Value: revision}
+}
+
+func (c *MongoDB) Update(ctx context.Context, target *db.Target) error {
+	filter := bson.D{primitive.E{Key: "_id", Value: target.ID.String()}, revisionFilter(target.Revision)}
 	coll := c.client.Database(c.dbName).Collection(collectionName)
-	target.ID = db.ID("")
-	_, err := coll.ReplaceOne(context.TODO(), filter, target)
+	next := *target
+	next.Revision++
+	result, err := coll.ReplaceOne(ctx, filter, &next)
 	if err != nil {
 		log.Println("Failed to Replace the document:", err)
 		return err
 	}
+	if result.MatchedCount == 0 {
+		// tell a missing document from a document with another revision
+		count, err := coll.CountDocuments(ctx, bson.D{primitive.E{Key: "_id", Value: target.ID.String()}})
+		if err != nil {
+			log.Println("Failed to Count documents:", err)
+			return err
+		}
+		if count == 0 {
+			return db.ErrNotFound
+		}
+		return db.ErrConflict
+	}
+	target.Revision = next.Revision
 	return nil
 }
 
-func (c *MongoDB) GetAll(list *[]db.Target) error {
+// listFilter translates name prefix, labels and the cursor of the query into a filter.
+func listFilter(query *db.ListQuery) bson.D {
+	and := bson.A{}
+	if query.NamePrefix != "" {
+		regex := bson.D{primitive.E{Key: "$regex", Value: "^" + regexp.QuoteMeta(query.NamePrefix)}}
+		and = append(and, bson.D{primitive.E{Key: "name", Value: regex}})
+	}
+	if len(query.Labels) > 0 {
+		match := bson.D{}
+		for k, v := range query.Labels {
+			match = append(match, primitive.E{Key: "labels." + k, Value: v})
+		}
+		and = append(and, bson.D{primitive.E{Key: "entries", Value: bson.D{primitive.E{Key: "$elemMatch", Value: match}}}})
+	}
+	if query.After != nil {
+		// targets of the same time or name go on after the ID
+		key, value := "name", interface{}(query.After.Name)
+		if query.SortBy == db.SortByTime {
+			key, value = "time", query.After.Time
+		}
+		afterID := bson.D{primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$gt", Value: query.After.ID.String()}}}}
+		and = append(and, bson.D{primitive.E{Key: "$or", Value: bson.A{
+			bson.D{primitive.E{Key: key, Value: bson.D{primitive.E{Key: "$gt", Value: value}}}},
+			append(bson.D{primitive.E{Key: key, Value: value}}, afterID...),
+		}}})
+	}
+	if len(and) == 0 {
+		return bson.D{}
+	}
+	return bson.D{primitive.E{Key: "$and", Value: and}}
+}
+
+func (c *MongoDB) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
 	coll := c.client.Database(c.dbName).Collection(collectionName)
-	cur, err := coll.Find(context.TODO(), bson.D{})
+	opts := options.Find().SetSort(listIndex().Keys)
+	if query.SortBy == db.SortByTime {
+		opts.SetSort(bson.D{primitive.E{Key: "time", Value: 1}, primitive.E{Key: "_id", Value: 1}})
+	}
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	cur, err := coll.Find(ctx, listFilter(query), opts)
 	if err != nil {
 		log.Println("Failed to Find documents", err)
 		return err
 	}
-	if err = cur.All(context.TODO(), list); err != nil {
+	if err = cur.All(ctx, list); err != nil {
 		log.Println("Failed to GetAll documents", err)
 		return err
 	}
 	return nil
 }
 
+// changeEvent is the part of a change stream event the storage needs.
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID string `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument *db.Target `bson:"fullDocument"`
+}
+
+// event translates the change, it reports false for changes which aren't about a target.
+func (c *changeEvent) event() (db.Event, bool) {
+	switch c.OperationType {
+	case "insert", "update", "replace":
+		// the document may have been deleted before it was looked up
+		if c.FullDocument == nil {
+			return db.Event{}, false
+		}
+		action := db.ActionUpdate
+		if c.OperationType == "insert" {
+			action = db.ActionCreate
+		}
+		return db.Event{Action: action, Target: *c.FullDocument}, true
+	case "delete":
+		return db.Event{Action: db.ActionDelete, Target: db.Target{ID: db.ID(c.DocumentKey.ID)}}, true
+	}
+	return db.Event{}, false
+}
+
+// Watch follows the change stream of the collection, MongoDB has to run as a replica set.
+func (c *MongoDB) Watch(ctx context.Context, events chan<- db.Event) error {
+	coll := c.client.Database(c.dbName).Collection(collectionName)
+	stream, err := coll.Watch(ctx, mongo.Pipeline{}, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	if err != nil {
+		log.Println("Failed to Watch the collection:", err)
+		return err
+	}
+	defer stream.Close(context.Background())
+	for stream.Next(ctx) {
+		change := changeEvent{}
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+		event, ok := change.event()
+		if !ok {
+			continue
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return stream.Err()
+}
+
+func (c *MongoDB) WriteAudit(ctx context.Context, record *db.AuditRecord) error {
+	coll := c.client.Database(c.dbName).Collection(auditCollection)
+	if _, err := coll.InsertOne(ctx, record); err != nil {
+		log.Println("Failed to Insert the audit record:", err)
+		return err
+	}
+	return nil
+}
+
+// auditFilter translates the time range of the query into a filter, the audit index covers it.
+func auditFilter(query *db.AuditQuery) bson.D {
+	between := bson.D{}
+	if !query.From.IsZero() {
+		between = append(between, primitive.E{Key: "$gte", Value: query.From})
+	}
+	if !query.To.IsZero() {
+		between = append(between, primitive.E{Key: "$lte", Value: query.To})
+	}
+	if len(between) == 0 {
+		return bson.D{}
+	}
+	return bson.D{primitive.E{Key: "time", Value: between}}
+}
+
+func (c *MongoDB) QueryAudit(ctx context.Context, query *db.AuditQuery, records *[]db.AuditRecord) error {
+	coll := c.client.Database(c.dbName).Collection(auditCollection)
+	// ObjectIDs keep records of the same time in the order they were written
+	opts := options.Find().SetSort(bson.D{primitive.E{Key: "time", Value: 1}, primitive.E{Key: "_id", Value: 1}})
+	cur, err := coll.Find(ctx, auditFilter(query), opts)
+	if err != nil {
+		log.Println("Failed to Find audit records", err)
+		return err
+	}
+	result := []db.AuditRecord{}
+	if err = cur.All(ctx, &result); err != nil {
+		log.Println("Failed to read audit records", err)
+		return err
+	}
+	*records = result
+	return nil
+}
+
+// listIndex keeps targets in the order they are listed by name.
+func listIndex() mongo.IndexModel {
+	return mongo.IndexModel{Keys: bson.D{primitive.E{Key: "name", Value: 1}, primitive.E{Key: "_id", Value: 1}}}
+}
+
+// auditIndex lets audit queries read only the records of their time range.
+func auditIndex() mongo.IndexModel {
+	return mongo.IndexModel{Keys: bson.D{primitive.E{Key: "time", Value: 1}}}
+}
+
+// expiryIndex makes MongoDB delete a target once its expires_at has passed, documents without it are kept.
+func expiryIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+}
+
+// createIndexes failure is only logged, the service deletes expired targets anyway,
+// lists are sorted and audit queries read the whole collection without the indexes.
+func (c *MongoDB) createIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), indexTimeout)
+	defer cancel()
+	audit := c.client.Database(c.dbName).Collection(auditCollection)
+	if _, err := audit.Indexes().CreateOne(ctx, auditIndex()); err != nil {
+		log.Println("Failed to create the audit index:", err)
+	}
+	coll := c.client.Database(c.dbName).Collection(collectionName)
+	if _, err := coll.Indexes().CreateOne(ctx, listIndex()); err != nil {
+		log.Println("Failed to create the list index:", err)
+	}
+	if _, err := coll.Indexes().CreateOne(ctx, expiryIndex()); err != nil {
+		log.Println("Failed to create the expiry index:", err)
+		return
+	}
+	c.expires = true
+}
+
+// ExpiresTargets reports whether MongoDB deletes expired targets by the expiry index.
+func (c *MongoDB) ExpiresTargets() bool {
+	return c.expires
+}
+
+// migrateObjectIDs gives documents created before targets were keyed by name a string _id,
+// the hex of their ObjectID, so that the IDs clients already know keep working.
+// The copy is inserted before the original is deleted, a copy left by an interrupted run is kept.
+func (c *MongoDB) migrateObjectIDs(ctx context.Context) error {
+	coll := c.client.Database(c.dbName).Collection(collectionName)
+	cur, err := coll.Find(ctx, bson.D{primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$type", Value: "objectId"}}}})
+	if err != nil {
+		return err
+	}
+	legacy := []bson.M{}
+	if err = cur.All(ctx, &legacy); err != nil {
+		return err
+	}
+	for _, doc := range legacy {
+		oid := doc["_id"].(primitive.ObjectID)
+		doc["_id"] = oid.Hex()
+		_, err := coll.InsertOne(ctx, doc)
+		if mongo.IsDuplicateKeyError(err) {
+			copied := bson.M{}
+			if err = coll.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: oid.Hex()}}).Decode(&copied); err != nil {
+				return err
+			}
+			if copied["name"] != doc["name"] {
+				log.Printf("Document %s isn't migrated, its ID is taken by target %v\n", oid.Hex(), copied["name"])
+				continue
+			}
+		} else if err != nil {
+			return err
+		}
+		if _, err = coll.DeleteOne(ctx, bson.D{primitive.E{Key: "_id", Value: oid}}); err != nil {
+			return err
+		}
+	}
+	if len(legacy) > 0 {
+		log.Printf("%d documents with ObjectID were migrated to string IDs\n", len(legacy))
+	}
+	return nil
+}
+
 type StorageService struct{}
 
 func (s *StorageService) ServiceID() string {
@@ -107,6 +372,12 @@ func (s *StorageService) New(connUri string) (db.Storage, error) {
 	db := new(MongoDB)
 	db.dbName = strings.Replace(u.Path, "/", "", 1)
 	db.client = client
+	db.createIndexes()
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+	if err = db.migrateObjectIDs(ctx); err != nil {
+		log.Println("Failed to migrate documents with ObjectID:", err)
+	}
 
 	return db, nil
 }
@@ -116,5 +387,9 @@ func init() {
 }
 
 var (
-	_ db.Storage = (*MongoDB)(nil)
+	_ db.Storage    = (*MongoDB)(nil)
+	_ db.Importer   = (*MongoDB)(nil)
+	_ db.Expirer    = (*MongoDB)(nil)
+	_ db.AuditStore = (*MongoDB)(nil)
+	_ db.Watcher    = (*MongoDB)(nil)
 )
@@ -0,0 +1,198 @@
+package mongo
+
+import (
+	"context"
+	"os"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testURIEnv points to a MongoDB used by tests, they are skipped when it isn't set.
+const testURIEnv = "PROMHSD_MONGODB_TEST_URI"
+
+func newTestDB(t *testing.T) *MongoDB {
+	uri := os.Getenv(testURIEnv)
+	if uri == "" {
+		t.Skip(testURIEnv + " is not set")
+	}
+	service := StorageService{}
+	storage, err := service.New(uri)
+	assert.NoError(t, err)
+	m := storage.(*MongoDB)
+	coll := m.client.Database(m.dbName).Collection(collectionName)
+	audit := m.client.Database(m.dbName).Collection(auditCollection)
+	assert.NoError(t, coll.Drop(context.TODO()))
+	assert.NoError(t, audit.Drop(context.TODO()))
+	t.Cleanup(func() {
+		coll.Drop(context.TODO())
+		audit.Drop(context.TODO())
+		m.client.Disconnect(context.TODO())
+	})
+	return m
+}
+
+func TestMongoDB_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		return newTestDB(t)
+	})
+}
+
+func TestMongoDB_Audit(t *testing.T) {
+	storagetest.RunAudit(t, func(t *testing.T) db.Storage {
+		return newTestDB(t)
+	})
+}
+
+func Test_auditFilter(t *testing.T) {
+	from := time.Date(2022, 12, 1, 10, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	assert.Equal(t, bson.D{}, auditFilter(&db.AuditQuery{Target: "web"}))
+	assert.Equal(t, bson.D{{Key: "time", Value: bson.D{{Key: "$gte", Value: from}, {Key: "$lte", Value: to}}}}, auditFilter(&db.AuditQuery{From: from, To: to}))
+}
+
+func TestMongoDB_migrateObjectIDs(t *testing.T) {
+	m := newTestDB(t)
+	coll := m.client.Database(m.dbName).Collection(collectionName)
+	oid := primitive.NewObjectID()
+	_, err := coll.InsertOne(context.TODO(), bson.D{{Key: "_id", Value: oid}, {Key: "name", Value: "legacy"}, {Key: "time", Value: time.Now()}})
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.migrateObjectIDs(context.TODO()))
+	target := &db.Target{ID: db.ID(oid.Hex())}
+	assert.NoError(t, m.Get(context.TODO(), target))
+	assert.Equal(t, "legacy", target.Name)
+	target.Name = "renamed"
+	assert.NoError(t, m.Update(context.TODO(), target))
+	count, err := coll.CountDocuments(context.TODO(), bson.D{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	// running it again changes nothing
+	assert.NoError(t, m.migrateObjectIDs(context.TODO()))
+}
+
+func Test_listFilter(t *testing.T) {
+	after := time.Date(2022, 12, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		query *db.ListQuery
+		want  bson.D
+	}{
+		{
+			name:  "all",
+			query: &db.ListQuery{},
+			want:  bson.D{},
+		},
+		{
+			name:  "prefixAndLabel",
+			query: &db.ListQuery{NamePrefix: "web.", Labels: map[string]string{"env": "prod"}},
+			want: bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: `^web\.`}}}},
+				bson.D{{Key: "entries", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "labels.env", Value: "prod"}}}}}},
+			}}},
+		},
+		{
+			name:  "afterByTime",
+			query: &db.ListQuery{SortBy: db.SortByTime, After: &db.Cursor{ID: "test", Time: after}},
+			want: bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "$or", Value: bson.A{
+					bson.D{{Key: "time", Value: bson.D{{Key: "$gt", Value: after}}}},
+					bson.D{{Key: "time", Value: after}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: "test"}}}},
+				}}},
+			}}},
+		},
+		{
+			name:  "afterByName",
+			query: &db.ListQuery{After: &db.Cursor{ID: "test", Name: "web"}},
+			want: bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "$or", Value: bson.A{
+					bson.D{{Key: "name", Value: bson.D{{Key: "$gt", Value: "web"}}}},
+					bson.D{{Key: "name", Value: "web"}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: "test"}}}},
+				}}},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, listFilter(tt.query))
+		})
+	}
+}
+
+func Test_revisionFilter(t *testing.T) {
+	assert.Equal(t, primitive.E{Key: "revision", Value: int64(2)}, revisionFilter(2))
+	// documents stored before revisions have no field
+	assert.Equal(t, primitive.E{Key: "revision", Value: bson.D{{Key: "$in", Value: bson.A{0, nil}}}}, revisionFilter(0))
+}
+
+func Test_changeEvent(t *testing.T) {
+	target := bson.D{{Key: "_id", Value: "test"}, {Key: "name", Value: "test"}, {Key: "revision", Value: int64(2)}}
+	tests := []struct {
+		name   string
+		change bson.D
+		want   db.Event
+		ok     bool
+	}{
+		{
+			name:   "insert",
+			change: bson.D{{Key: "operationType", Value: "insert"}, {Key: "documentKey", Value: bson.D{{Key: "_id", Value: "test"}}}, {Key: "fullDocument", Value: target}},
+			want:   db.Event{Action: db.ActionCreate, Target: db.Target{ID: "test", Name: "test", Revision: 2}},
+			ok:     true,
+		},
+		{
+			name:   "replace",
+			change: bson.D{{Key: "operationType", Value: "replace"}, {Key: "documentKey", Value: bson.D{{Key: "_id", Value: "test"}}}, {Key: "fullDocument", Value: target}},
+			want:   db.Event{Action: db.ActionUpdate, Target: db.Target{ID: "test", Name: "test", Revision: 2}},
+			ok:     true,
+		},
+		{
+			name:   "delete",
+			change: bson.D{{Key: "operationType", Value: "delete"}, {Key: "documentKey", Value: bson.D{{Key: "_id", Value: "test"}}}},
+			want:   db.Event{Action: db.ActionDelete, Target: db.Target{ID: "test"}},
+			ok:     true,
+		},
+		{
+			name:   "updateOfDeleted",
+			change: bson.D{{Key: "operationType", Value: "update"}, {Key: "documentKey", Value: bson.D{{Key: "_id", Value: "test"}}}, {Key: "fullDocument", Value: nil}},
+		},
+		{
+			name:   "drop",
+			change: bson.D{{Key: "operationType", Value: "drop"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := bson.Marshal(tt.change)
+			assert.NoError(t, err)
+			change := changeEvent{}
+			assert.NoError(t, bson.Unmarshal(data, &change))
+			event, ok := change.event()
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, event)
+		})
+	}
+}
+
+func Test_expiryIndex(t *testing.T) {
+	index := expiryIndex()
+	assert.Equal(t, bson.D{{Key: "expires_at", Value: 1}}, index.Keys)
+	assert.Equal(t, int32(0), *index.Options.ExpireAfterSeconds)
+
+	// the index deletes only documents whose field is a date
+	expiresAt := time.Now()
+	target := db.NewTarget()
+	target.ExpiresAt = &expiresAt
+	raw, err := bson.Marshal(target)
+	assert.NoError(t, err)
+	assert.Equal(t, bsontype.DateTime, bson.Raw(raw).Lookup("expires_at").Type)
+	raw, err = bson.Marshal(db.NewTarget())
+	assert.NoError(t, err)
+	_, err = bson.Raw(raw).LookupErr("expires_at")
+	assert.Error(t, err)
+}
@@ -0,0 +1,344 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"promhsd/db"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+const (
+	StorageID  = "postgres"
+	driverName = "pgx"
+)
+
+const (
+	createTableQuery = `CREATE TABLE IF NOT EXISTS targets (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	time TIMESTAMPTZ NOT NULL,
+	entries JSONB NOT NULL,
+	revision BIGINT NOT NULL DEFAULT 0,
+	expires_at TIMESTAMPTZ
+)`
+	// createIndexQuery keeps targets in the order they are listed by name
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS targets_name ON targets (name COLLATE "C", id COLLATE "C")`
+	insertQuery      = `INSERT INTO targets (id, name, time, entries, revision, expires_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING`
+	updateQuery      = `UPDATE targets SET name = $2, time = $3, entries = $4, expires_at = $6, revision = revision + 1 WHERE id = $1 AND revision = $5`
+	deleteQuery      = `DELETE FROM targets WHERE id = $1`
+	existsQuery      = `SELECT COUNT(*) FROM targets WHERE id = $1`
+	selectQuery      = `SELECT name, time, entries, revision, expires_at FROM targets WHERE id = $1`
+	listQuery        = `SELECT id, name, time, entries, revision, expires_at FROM targets`
+)
+
+const (
+	// audit records are kept in a table of their own, time is in nanoseconds so that ranges are exact
+	createAuditTableQuery = `CREATE TABLE IF NOT EXISTS audit (
+	seq BIGSERIAL PRIMARY KEY,
+	time BIGINT NOT NULL,
+	target TEXT NOT NULL,
+	record JSONB NOT NULL
+)`
+	createAuditIndexQuery = `CREATE INDEX IF NOT EXISTS audit_time ON audit (time)`
+	insertAuditQuery      = `INSERT INTO audit (time, target, record) VALUES ($1, $2, $3)`
+	listAuditQuery        = `SELECT record FROM audit`
+)
+
+type Postgres struct {
+	db *sql.DB
+}
+
+func (p *Postgres) IsHealthy(ctx context.Context) bool {
+	err := p.db.PingContext(ctx)
+	if err != nil {
+		log.Println("Ping returns error:", err.Error())
+		return false
+	}
+	return true
+}
+
+func (p *Postgres) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return p.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (p *Postgres) Import(ctx context.Context, target *db.Target) error {
+	entries, err := json.Marshal(target.Entries)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode entries", Err: err}
+	}
+	result, err := p.db.ExecContext(ctx, insertQuery, target.ID.String(), target.Name, target.Time, entries, target.Revision, target.ExpiresAt)
+	if err != nil {
+		log.Println("Failed to Insert the row:", err)
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return db.ErrConflict
+	}
+	return nil
+}
+
+func (p *Postgres) Update(ctx context.Context, target *db.Target) error {
+	entries, err := json.Marshal(target.Entries)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode entries", Err: err}
+	}
+	result, err := p.db.ExecContext(ctx, updateQuery, target.ID.String(), target.Name, target.Time, entries, target.Revision, target.ExpiresAt)
+	if err != nil {
+		log.Println("Failed to Update the row:", err)
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return p.updateError(ctx, target.ID)
+	}
+	target.Revision++
+	return nil
+}
+
+// updateError tells a missing row from a row with another revision.
+func (p *Postgres) updateError(ctx context.Context, id db.ID) error {
+	var count int
+	err := p.db.QueryRowContext(ctx, existsQuery, id.String()).Scan(&count)
+	if err != nil {
+		log.Println("Failed to Select the row:", err)
+		return err
+	}
+	if count == 0 {
+		return db.ErrNotFound
+	}
+	return db.ErrConflict
+}
+
+func (p *Postgres) Delete(ctx context.Context, target *db.Target) error {
+	result, err := p.db.ExecContext(ctx, deleteQuery, target.ID.String())
+	if err != nil {
+		log.Println("Failed to Delete the row:", err)
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (p *Postgres) Get(ctx context.Context, target *db.Target) error {
+	var (
+		entries   []byte
+		expiresAt sql.NullTime
+	)
+	err := p.db.QueryRowContext(ctx, selectQuery, target.ID.String()).Scan(&target.Name, &target.Time, &entries, &target.Revision, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return db.ErrNotFound
+		}
+		log.Println("Failed to Select the row:", err)
+		return err
+	}
+	err = json.Unmarshal(entries, &target.Entries)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't decode entries", Err: err}
+	}
+	target.ExpiresAt = expiryTime(expiresAt)
+	return nil
+}
+
+// expiryTime returns the expiry of the row, NULL means the target never expires.
+func expiryTime(expiresAt sql.NullTime) *time.Time {
+	if !expiresAt.Valid {
+		return nil
+	}
+	return &expiresAt.Time
+}
+
+// listSQL adds conditions, order and limit of the query to listQuery.
+// Names and IDs are compared in "C" collation to keep the byte order other storages use.
+func listSQL(query *db.ListQuery) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if query.NamePrefix != "" {
+		conditions = append(conditions, "starts_with(name, "+arg(query.NamePrefix)+")")
+	}
+	if len(query.Labels) > 0 {
+		// containment matches targets which have an entry with all the labels
+		labels, _ := json.Marshal([]map[string]map[string]string{{"labels": query.Labels}})
+		conditions = append(conditions, "entries @> "+arg(string(labels))+"::jsonb")
+	}
+	order := `name COLLATE "C", id COLLATE "C"`
+	if query.SortBy == db.SortByTime {
+		order = `time, id COLLATE "C"`
+		if query.After != nil {
+			conditions = append(conditions, `(time, id COLLATE "C") > (`+arg(query.After.Time)+", "+arg(query.After.ID.String())+")")
+		}
+	} else if query.After != nil {
+		conditions = append(conditions, `(name COLLATE "C", id COLLATE "C") > (`+arg(query.After.Name)+", "+arg(query.After.ID.String())+")")
+	}
+	statement := listQuery
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY " + order
+	if query.Limit > 0 {
+		statement += " LIMIT " + arg(query.Limit)
+	}
+	return statement, args
+}
+
+func (p *Postgres) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	statement, args := listSQL(query)
+	rows, err := p.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		log.Println("Failed to Select rows:", err)
+		return err
+	}
+	defer rows.Close()
+	targets := []db.Target{}
+	for rows.Next() {
+		var (
+			target    db.Target
+			entries   []byte
+			expiresAt sql.NullTime
+		)
+		err = rows.Scan(&target.ID, &target.Name, &target.Time, &entries, &target.Revision, &expiresAt)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(entries, &target.Entries)
+		if err != nil {
+			return &db.StorageError{Text: "Couldn't decode entries", Err: err}
+		}
+		target.ExpiresAt = expiryTime(expiresAt)
+		targets = append(targets, target)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	*list = targets
+	return nil
+}
+
+func (p *Postgres) WriteAudit(ctx context.Context, record *db.AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	_, err = p.db.ExecContext(ctx, insertAuditQuery, record.Time.UnixNano(), record.Target.String(), data)
+	if err != nil {
+		log.Println("Failed to Insert the audit row:", err)
+	}
+	return err
+}
+
+// auditSQL adds the time range of the query to listAuditQuery.
+func auditSQL(query *db.AuditQuery) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	if !query.From.IsZero() {
+		args = append(args, query.From.UnixNano())
+		conditions = append(conditions, fmt.Sprintf("time >= $%d", len(args)))
+	}
+	if !query.To.IsZero() {
+		args = append(args, query.To.UnixNano())
+		conditions = append(conditions, fmt.Sprintf("time <= $%d", len(args)))
+	}
+	statement := listAuditQuery
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return statement + " ORDER BY time, seq", args
+}
+
+func (p *Postgres) QueryAudit(ctx context.Context, query *db.AuditQuery, records *[]db.AuditRecord) error {
+	statement, args := auditSQL(query)
+	rows, err := p.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		log.Println("Failed to Select audit rows:", err)
+		return err
+	}
+	defer rows.Close()
+	result := []db.AuditRecord{}
+	for rows.Next() {
+		var data []byte
+		if err = rows.Scan(&data); err != nil {
+			return err
+		}
+		var record db.AuditRecord
+		if err = json.Unmarshal(data, &record); err != nil {
+			return &db.StorageError{Text: "Couldn't decode audit record", Err: err}
+		}
+		result = append(result, record)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	*records = result
+	return nil
+}
+
+// createQueries create the tables and their indexes.
+var createQueries = []string{createTableQuery, createIndexQuery, createAuditTableQuery, createAuditIndexQuery}
+
+func (p *Postgres) createTable() error {
+	for _, query := range createQueries {
+		if _, err := p.db.Exec(query); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+type StorageService struct{}
+
+func (s *StorageService) ServiceID() string {
+	return StorageID
+}
+
+func (s *StorageService) New(dsn string) (db.Storage, error) {
+	conn, err := sql.Open(driverName, dsn)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	db := &Postgres{db: conn}
+	err = db.createTable()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func init() {
+	db.RegisterStorage(&StorageService{})
+}
+
+var (
+	_ db.Storage    = (*Postgres)(nil)
+	_ db.Importer   = (*Postgres)(nil)
+	_ db.AuditStore = (*Postgres)(nil)
+)
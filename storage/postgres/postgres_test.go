@@ -0,0 +1,410 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMock(t *testing.T) (*Postgres, sqlmock.Sqlmock) {
+	conn, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &Postgres{db: conn}, mock
+}
+
+func TestPostgres_Create(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  sql.Result
+		err     error
+		wantErr error
+	}{
+		{
+			name:    "NoError",
+			result:  sqlmock.NewResult(0, 1),
+			wantErr: nil,
+		},
+		{
+			name:    "ConflictError",
+			result:  sqlmock.NewResult(0, 0),
+			wantErr: db.ErrConflict,
+		},
+		{
+			name:    "StorageError",
+			err:     errors.New("connection refused"),
+			wantErr: errors.New("connection refused"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newMock(t)
+			exec := mock.ExpectExec(regexp.QuoteMeta(insertQuery)).
+				WithArgs("test", "test", sqlmock.AnyArg(), sqlmock.AnyArg(), db.FirstRevision, nil)
+			if tt.err != nil {
+				exec.WillReturnError(tt.err)
+			} else {
+				exec.WillReturnResult(tt.result)
+			}
+			target := &db.Target{Name: "test"}
+			err := p.Create(context.Background(), target)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, db.ID("test"), target.ID)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPostgres_Update(t *testing.T) {
+	tests := []struct {
+		name         string
+		result       sql.Result
+		count        int
+		wantErr      error
+		wantRevision int64
+	}{
+		{
+			name:         "NoError",
+			result:       sqlmock.NewResult(0, 1),
+			wantErr:      nil,
+			wantRevision: db.FirstRevision + 1,
+		},
+		{
+			name:         "NotFoundError",
+			result:       sqlmock.NewResult(0, 0),
+			count:        0,
+			wantErr:      db.ErrNotFound,
+			wantRevision: db.FirstRevision,
+		},
+		{
+			name:         "ConflictError",
+			result:       sqlmock.NewResult(0, 0),
+			count:        1,
+			wantErr:      db.ErrConflict,
+			wantRevision: db.FirstRevision,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newMock(t)
+			mock.ExpectExec(regexp.QuoteMeta(updateQuery)).
+				WithArgs("test", "test", sqlmock.AnyArg(), sqlmock.AnyArg(), db.FirstRevision, nil).
+				WillReturnResult(tt.result)
+			if tt.wantErr != nil {
+				mock.ExpectQuery(regexp.QuoteMeta(existsQuery)).
+					WithArgs("test").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.count))
+			}
+			target := &db.Target{ID: "test", Name: "test", Revision: db.FirstRevision}
+			err := p.Update(context.Background(), target)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.wantRevision, target.Revision)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPostgres_Delete(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  sql.Result
+		wantErr error
+	}{
+		{
+			name:    "NoError",
+			result:  sqlmock.NewResult(0, 1),
+			wantErr: nil,
+		},
+		{
+			name:    "NotFoundError",
+			result:  sqlmock.NewResult(0, 0),
+			wantErr: db.ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newMock(t)
+			mock.ExpectExec(regexp.QuoteMeta(deleteQuery)).
+				WithArgs("test").
+				WillReturnResult(tt.result)
+			err := p.Delete(context.Background(), &db.Target{ID: "test"})
+			assert.Equal(t, tt.wantErr, err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPostgres_Get(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		rows    *sqlmock.Rows
+		wantErr error
+	}{
+		{
+			name: "NoError",
+			rows: sqlmock.NewRows([]string{"name", "time", "entries", "revision", "expires_at"}).
+				AddRow("test", now, []byte(`[{"targets":["127.0.0.1:9100"],"labels":{"env":"test"}}]`), 2, now.Add(time.Hour)),
+			wantErr: nil,
+		},
+		{
+			name:    "NotFoundError",
+			rows:    sqlmock.NewRows([]string{"name", "time", "entries", "revision", "expires_at"}),
+			wantErr: db.ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newMock(t)
+			mock.ExpectQuery(regexp.QuoteMeta(selectQuery)).
+				WithArgs("test").
+				WillReturnRows(tt.rows)
+			target := db.NewTarget()
+			target.ID = "test"
+			err := p.Get(context.Background(), target)
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr == nil {
+				assert.Equal(t, "test", target.Name)
+				assert.Len(t, target.Entries, 1)
+				assert.Equal(t, int64(2), target.Revision)
+				assert.True(t, now.Add(time.Hour).Equal(*target.ExpiresAt))
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPostgres_GetAll(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    *sqlmock.Rows
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "NoError",
+			rows: sqlmock.NewRows([]string{"id", "name", "time", "entries", "revision", "expires_at"}).
+				AddRow("test", "test", time.Now(), []byte(`[]`), 1, nil).
+				AddRow("test1", "test1", time.Now(), []byte(`[]`), 1, time.Now()),
+			want:    2,
+			wantErr: false,
+		},
+		{
+			name:    "Empty",
+			rows:    sqlmock.NewRows([]string{"id", "name", "time", "entries", "revision", "expires_at"}),
+			want:    0,
+			wantErr: false,
+		},
+		{
+			name: "InvalidEntries",
+			rows: sqlmock.NewRows([]string{"id", "name", "time", "entries", "revision", "expires_at"}).
+				AddRow("test", "test", time.Now(), []byte(`----`), 1, nil),
+			want:    0,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newMock(t)
+			mock.ExpectQuery(regexp.QuoteMeta(listQuery)).WillReturnRows(tt.rows)
+			list := []db.Target{}
+			err := p.GetAll(context.Background(), &db.ListQuery{}, &list)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, list, tt.want)
+		})
+	}
+}
+
+func TestPostgres_IsHealthy(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "NoError",
+			want: true,
+		},
+		{
+			name: "PingError",
+			err:  errors.New("connection refused"),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newMock(t)
+			mock.ExpectPing().WillReturnError(tt.err)
+			assert.Equal(t, tt.want, p.IsHealthy(context.Background()))
+		})
+	}
+}
+
+func TestPostgres_createTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing string
+		wantErr bool
+	}{
+		{
+			name:    "NoError",
+			wantErr: false,
+		},
+		{
+			name:    "Error",
+			failing: createTableQuery,
+			wantErr: true,
+		},
+		{
+			name:    "IndexError",
+			failing: createIndexQuery,
+			wantErr: true,
+		},
+		{
+			name:    "AuditTableError",
+			failing: createAuditTableQuery,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newMock(t)
+			for _, query := range createQueries {
+				exec := mock.ExpectExec(regexp.QuoteMeta(query))
+				if query == tt.failing {
+					exec.WillReturnError(errors.New("permission denied"))
+					break
+				}
+				exec.WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			err := p.createTable()
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func Test_auditSQL(t *testing.T) {
+	from := time.Date(2022, 12, 1, 10, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	tests := []struct {
+		name     string
+		query    *db.AuditQuery
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{
+			name:    "all",
+			query:   &db.AuditQuery{Target: "web"},
+			wantSQL: listAuditQuery + ` ORDER BY time, seq`,
+		},
+		{
+			name:     "to",
+			query:    &db.AuditQuery{To: to},
+			wantSQL:  listAuditQuery + ` WHERE time <= $1 ORDER BY time, seq`,
+			wantArgs: []interface{}{to.UnixNano()},
+		},
+		{
+			name:     "range",
+			query:    &db.AuditQuery{From: from, To: to},
+			wantSQL:  listAuditQuery + ` WHERE time >= $1 AND time <= $2 ORDER BY time, seq`,
+			wantArgs: []interface{}{from.UnixNano(), to.UnixNano()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statement, args := auditSQL(tt.query)
+			assert.Equal(t, tt.wantSQL, statement)
+			if tt.wantArgs == nil {
+				assert.Empty(t, args)
+				return
+			}
+			assert.Equal(t, tt.wantArgs, args)
+		})
+	}
+}
+
+func Test_listSQL(t *testing.T) {
+	after := time.Date(2022, 12, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		query    *db.ListQuery
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{
+			name:    "all",
+			query:   &db.ListQuery{},
+			wantSQL: listQuery + ` ORDER BY name COLLATE "C", id COLLATE "C"`,
+		},
+		{
+			name:     "prefixAndLabels",
+			query:    &db.ListQuery{NamePrefix: "web", Labels: map[string]string{"env": "prod"}, Limit: 10},
+			wantSQL:  listQuery + ` WHERE starts_with(name, $1) AND entries @> $2::jsonb ORDER BY name COLLATE "C", id COLLATE "C" LIMIT $3`,
+			wantArgs: []interface{}{"web", `[{"labels":{"env":"prod"}}]`, 10},
+		},
+		{
+			name:     "afterByName",
+			query:    &db.ListQuery{After: &db.Cursor{ID: "test", Name: "web"}},
+			wantSQL:  listQuery + ` WHERE (name COLLATE "C", id COLLATE "C") > ($1, $2) ORDER BY name COLLATE "C", id COLLATE "C"`,
+			wantArgs: []interface{}{"web", "test"},
+		},
+		{
+			name:     "afterByTime",
+			query:    &db.ListQuery{SortBy: db.SortByTime, After: &db.Cursor{ID: "test", Time: after}},
+			wantSQL:  listQuery + ` WHERE (time, id COLLATE "C") > ($1, $2) ORDER BY time, id COLLATE "C"`,
+			wantArgs: []interface{}{after, "test"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statement, args := listSQL(tt.query)
+			assert.Equal(t, tt.wantSQL, statement)
+			if tt.wantArgs == nil {
+				assert.Empty(t, args)
+				return
+			}
+			assert.Equal(t, tt.wantArgs, args)
+		})
+	}
+}
+
+// testDSNEnv points to a PostgreSQL used by conformance tests, they are skipped when it isn't set.
+const testDSNEnv = "PROMHSD_POSTGRES_TEST_DSN"
+
+// newTestStorage connects to the PostgreSQL of testDSNEnv and empties it.
+func newTestStorage(t *testing.T) db.Storage {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skip(testDSNEnv + " is not set")
+	}
+	service := StorageService{}
+	storage, err := service.New(dsn)
+	assert.NoError(t, err)
+	p := storage.(*Postgres)
+	_, err = p.db.Exec(`TRUNCATE targets, audit`)
+	assert.NoError(t, err)
+	t.Cleanup(func() { p.db.Close() })
+	return p
+}
+
+func TestPostgres_Conformance(t *testing.T) {
+	storagetest.Run(t, newTestStorage)
+}
+
+func TestPostgres_Audit(t *testing.T) {
+	storagetest.RunAudit(t, newTestStorage)
+}
@@ -0,0 +1,349 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"promhsd/db"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	StorageID     = "redis"
+	defaultPrefix = "promhsd"
+	prefixParam   = "prefix"
+)
+
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// updateScript replaces a field only when it already exists and has the expected revision,
+// so that Update can't resurrect a target deleted or overwrite one changed by another replica.
+var updateScript = redis.NewScript(`
+local current = redis.call("HGET", KEYS[1], ARGV[1])
+if not current then
+	return -1
+end
+if (cjson.decode(current).revision or 0) ~= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+var errEventsClosed = errors.New("events channel was closed")
+
+// Event is published to the events channel after every successful change,
+// Watch of every replica sharing the same Redis turns it into a db.Event.
+type Event struct {
+	Type string `json:"type"`
+	ID   db.ID  `json:"id"`
+}
+
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+func (r *Redis) targetsKey() string {
+	return r.prefix + ":targets"
+}
+
+// auditKey is a sorted set of records scored by their time in milliseconds,
+// members are the sequence of auditSeqKey followed by the record.
+func (r *Redis) auditKey() string {
+	return r.prefix + ":audit"
+}
+
+func (r *Redis) auditSeqKey() string {
+	return r.prefix + ":audit:seq"
+}
+
+func (r *Redis) eventsChannel() string {
+	return r.prefix + ":events"
+}
+
+func (r *Redis) publish(ctx context.Context, eventType string, id db.ID) {
+	message, _ := json.Marshal(Event{Type: eventType, ID: id})
+	err := r.client.Publish(ctx, r.eventsChannel(), message).Err()
+	if err != nil {
+		log.Println("Failed to Publish the event:", err)
+	}
+}
+
+// Subscribe returns events published by any replica until ctx is done.
+func (r *Redis) Subscribe(ctx context.Context) (<-chan Event, error) {
+	pubsub := r.client.Subscribe(ctx, r.eventsChannel())
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				event := Event{}
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					log.Println("Failed to decode the event:", err)
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Watch turns events published by any replica into changes of targets, created and updated
+// targets are read back, so that the event holds the target as it is now.
+func (r *Redis) Watch(ctx context.Context, events chan<- db.Event) error {
+	changes, err := r.Subscribe(ctx)
+	if err != nil {
+		log.Println("Failed to Subscribe to the events:", err)
+		return err
+	}
+	for change := range changes {
+		event := db.Event{Action: db.Action(change.Type), Target: db.Target{ID: change.ID}}
+		if event.Action != db.ActionDelete {
+			err := r.Get(ctx, &event.Target)
+			if errors.Is(err, db.ErrNotFound) {
+				// deleted since, its own event follows
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errEventsClosed
+}
+
+func (r *Redis) IsHealthy(ctx context.Context) bool {
+	err := r.client.Ping(ctx).Err()
+	if err != nil {
+		log.Println("Ping returns error:", err.Error())
+		return false
+	}
+	return true
+}
+
+func (r *Redis) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return r.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (r *Redis) Import(ctx context.Context, target *db.Target) error {
+	value, err := json.Marshal(target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	created, err := r.client.HSetNX(ctx, r.targetsKey(), target.ID.String(), value).Result()
+	if err != nil {
+		log.Println("Failed to Create the target:", err)
+		return err
+	}
+	if !created {
+		return db.ErrConflict
+	}
+	r.publish(ctx, EventCreate, target.ID)
+	return nil
+}
+
+func (r *Redis) Update(ctx context.Context, target *db.Target) error {
+	next := *target
+	next.Revision++
+	value, err := json.Marshal(&next)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	updated, err := updateScript.Run(ctx, r.client, []string{r.targetsKey()}, target.ID.String(), value, target.Revision).Int()
+	if err != nil {
+		log.Println("Failed to Update the target:", err)
+		return err
+	}
+	switch updated {
+	case -1:
+		return db.ErrNotFound
+	case 0:
+		return db.ErrConflict
+	}
+	target.Revision = next.Revision
+	r.publish(ctx, EventUpdate, target.ID)
+	return nil
+}
+
+func (r *Redis) Delete(ctx context.Context, target *db.Target) error {
+	deleted, err := r.client.HDel(ctx, r.targetsKey(), target.ID.String()).Result()
+	if err != nil {
+		log.Println("Failed to Delete the target:", err)
+		return err
+	}
+	if deleted == 0 {
+		return db.ErrNotFound
+	}
+	r.publish(ctx, EventDelete, target.ID)
+	return nil
+}
+
+func (r *Redis) Get(ctx context.Context, target *db.Target) error {
+	value, err := r.client.HGet(ctx, r.targetsKey(), target.ID.String()).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return db.ErrNotFound
+		}
+		log.Println("Failed to Get the target:", err)
+		return err
+	}
+	err = json.Unmarshal(value, target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't decode json", Err: err}
+	}
+	return nil
+}
+
+func (r *Redis) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	// fields are IDs, the name prefix is matched by the query
+	values, err := r.client.HVals(ctx, r.targetsKey()).Result()
+	if err != nil {
+		log.Println("Failed to GetAll targets:", err)
+		return err
+	}
+	targets := make([]db.Target, 0, len(values))
+	for _, value := range values {
+		var target db.Target
+		err = json.Unmarshal([]byte(value), &target)
+		if err != nil {
+			return &db.StorageError{Text: "Couldn't decode json", Err: err}
+		}
+		targets = append(targets, target)
+	}
+	*list = query.Apply(targets)
+	return nil
+}
+
+func (r *Redis) WriteAudit(ctx context.Context, record *db.AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	// the sequence makes members of equal records unique and sorts records of the same score
+	seq, err := r.client.Incr(ctx, r.auditSeqKey()).Result()
+	if err != nil {
+		log.Println("Failed to Incr the audit sequence:", err)
+		return err
+	}
+	member := fmt.Sprintf("%020d:%s", seq, data)
+	err = r.client.ZAdd(ctx, r.auditKey(), &redis.Z{Score: float64(record.Time.UnixMilli()), Member: member}).Err()
+	if err != nil {
+		log.Println("Failed to Add the audit record:", err)
+	}
+	return err
+}
+
+// QueryAudit reads the scores of the time range, which are rounded out to milliseconds.
+func (r *Redis) QueryAudit(ctx context.Context, query *db.AuditQuery, records *[]db.AuditRecord) error {
+	scores := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !query.From.IsZero() {
+		scores.Min = strconv.FormatInt(query.From.Truncate(time.Millisecond).UnixMilli(), 10)
+	}
+	if !query.To.IsZero() {
+		scores.Max = strconv.FormatInt(query.To.Add(time.Millisecond-1).UnixMilli(), 10)
+	}
+	members, err := r.client.ZRangeByScore(ctx, r.auditKey(), scores).Result()
+	if err != nil {
+		log.Println("Failed to read audit records:", err)
+		return err
+	}
+	result := make([]db.AuditRecord, 0, len(members))
+	for _, member := range members {
+		var record db.AuditRecord
+		_, data, _ := strings.Cut(member, ":")
+		if err = json.Unmarshal([]byte(data), &record); err != nil {
+			return &db.StorageError{Text: "Couldn't decode audit record", Err: err}
+		}
+		result = append(result, record)
+	}
+	*records = result
+	return nil
+}
+
+// parseURL splits the prefix parameter off the URL,
+// the rest of it is handled by redis.ParseURL.
+func parseURL(redisURL string) (*redis.Options, string, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, "", err
+	}
+	query := u.Query()
+	prefix := query.Get(prefixParam)
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	query.Del(prefixParam)
+	u.RawQuery = query.Encode()
+	opt, err := redis.ParseURL(u.String())
+	if err != nil {
+		return nil, "", err
+	}
+	return opt, prefix, nil
+}
+
+type StorageService struct{}
+
+func (s *StorageService) ServiceID() string {
+	return StorageID
+}
+
+func (s *StorageService) New(redisURL string) (db.Storage, error) {
+	opt, prefix, err := parseURL(redisURL)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	db := &Redis{client: redis.NewClient(opt), prefix: prefix}
+	return db, nil
+}
+
+func init() {
+	db.RegisterStorage(&StorageService{})
+}
+
+var (
+	_ db.Storage    = (*Redis)(nil)
+	_ db.Importer   = (*Redis)(nil)
+	_ db.Watcher    = (*Redis)(nil)
+	_ db.AuditStore = (*Redis)(nil)
+)
@@ -0,0 +1,156 @@
+package redis
+
+import (
+	"context"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDB(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	service := StorageService{}
+	storage, err := service.New("redis://" + server.Addr() + "/0?prefix=test")
+	assert.NoError(t, err)
+	r := storage.(*Redis)
+	t.Cleanup(func() { r.client.Close() })
+	return r, server
+}
+
+func TestRedis_keyPrefix(t *testing.T) {
+	r, server := newTestDB(t)
+	assert.NoError(t, r.Create(context.Background(), &db.Target{Name: "test"}))
+	assert.True(t, server.Exists("test:targets"))
+}
+
+func TestRedis_IsHealthy(t *testing.T) {
+	r, server := newTestDB(t)
+	assert.True(t, r.IsHealthy(context.Background()))
+	server.Close()
+	assert.False(t, r.IsHealthy(context.Background()))
+}
+
+func TestRedis_Subscribe(t *testing.T) {
+	r, _ := newTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := r.Subscribe(ctx)
+	assert.NoError(t, err)
+
+	target := &db.Target{Name: "test"}
+	assert.NoError(t, r.Create(context.Background(), target))
+	assert.NoError(t, r.Update(context.Background(), target))
+	assert.NoError(t, r.Delete(context.Background(), target))
+
+	for _, want := range []string{EventCreate, EventUpdate, EventDelete} {
+		select {
+		case event := <-events:
+			assert.Equal(t, Event{Type: want, ID: "test"}, event)
+		case <-time.After(time.Second):
+			t.Fatalf("event %s was not received", want)
+		}
+	}
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+func TestRedis_Watch(t *testing.T) {
+	r, server := newTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan db.Event)
+	done := make(chan error, 1)
+	go func() { done <- r.Watch(ctx, events) }()
+
+	// changes are made by another replica sharing the same Redis
+	service := StorageService{}
+	storage, err := service.New("redis://" + server.Addr() + "/0?prefix=test")
+	assert.NoError(t, err)
+	replica := storage.(*Redis)
+	defer replica.client.Close()
+	assert.Eventually(t, func() bool {
+		return server.PubSubNumSub("test:events")["test:events"] > 0
+	}, time.Second, 10*time.Millisecond)
+	target := &db.Target{Name: "test"}
+	tests := []struct {
+		change       func(context.Context, *db.Target) error
+		wantAction   db.Action
+		wantRevision int64
+	}{
+		{change: replica.Create, wantAction: db.ActionCreate, wantRevision: db.FirstRevision},
+		{change: replica.Update, wantAction: db.ActionUpdate, wantRevision: db.FirstRevision + 1},
+		{change: replica.Delete, wantAction: db.ActionDelete},
+	}
+	for _, tt := range tests {
+		assert.NoError(t, tt.change(context.Background(), target))
+		select {
+		case event := <-events:
+			assert.Equal(t, tt.wantAction, event.Action)
+			assert.Equal(t, db.ID("test"), event.Target.ID)
+			// created and updated targets are read back
+			assert.Equal(t, tt.wantRevision, event.Target.Revision)
+		case <-time.After(time.Second):
+			t.Fatalf("event %s was not received", tt.wantAction)
+		}
+	}
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func Test_parseURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		wantAddr   string
+		wantPrefix string
+		wantErr    bool
+	}{
+		{
+			name:       "defaultPrefix",
+			url:        "redis://localhost:6379/0",
+			wantAddr:   "localhost:6379",
+			wantPrefix: defaultPrefix,
+		},
+		{
+			name:       "customPrefix",
+			url:        "redis://localhost:6380/1?prefix=team1&dial_timeout=3s",
+			wantAddr:   "localhost:6380",
+			wantPrefix: "team1",
+		},
+		{
+			name:    "wrongScheme",
+			url:     "http://localhost:6379",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt, prefix, err := parseURL(tt.url)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantAddr, opt.Addr)
+			assert.Equal(t, tt.wantPrefix, prefix)
+		})
+	}
+}
+
+func TestRedis_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		storage, _ := newTestDB(t)
+		return storage
+	})
+}
+
+func TestRedis_Audit(t *testing.T) {
+	storagetest.RunAudit(t, func(t *testing.T) db.Storage {
+		storage, _ := newTestDB(t)
+		return storage
+	})
+}
@@ -0,0 +1,497 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"promhsd/db"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	StorageID     = "s3"
+	objectSuffix  = ".json"
+	endpointParam = "endpoint"
+	// namesBatch is how many keys of the names index are listed at once
+	namesBatch = 100
+)
+
+type ICreateBucket interface {
+	CreateBucketWithContext(aws.Context, *s3.CreateBucketInput, ...request.Option) (*s3.CreateBucketOutput, error)
+}
+
+type IHeadBucket interface {
+	HeadBucketWithContext(aws.Context, *s3.HeadBucketInput, ...request.Option) (*s3.HeadBucketOutput, error)
+}
+
+type IHeadObject interface {
+	HeadObjectWithContext(aws.Context, *s3.HeadObjectInput, ...request.Option) (*s3.HeadObjectOutput, error)
+}
+
+type IGetObject interface {
+	GetObjectWithContext(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error)
+}
+
+type IPutObject interface {
+	PutObjectWithContext(aws.Context, *s3.PutObjectInput, ...request.Option) (*s3.PutObjectOutput, error)
+}
+
+type IDeleteObject interface {
+	DeleteObjectWithContext(aws.Context, *s3.DeleteObjectInput, ...request.Option) (*s3.DeleteObjectOutput, error)
+}
+
+type IListObjects interface {
+	ListObjectsV2PagesWithContext(aws.Context, *s3.ListObjectsV2Input, func(*s3.ListObjectsV2Output, bool) bool, ...request.Option) error
+}
+
+type S3 struct {
+	ICreateBucket
+	IHeadBucket
+	IHeadObject
+	IGetObject
+	IPutObject
+	IDeleteObject
+	IListObjects
+	bucket string
+	prefix string
+	mu     sync.Mutex
+	// named tells that targets stored by older versions got their keys in the names index
+	named bool
+}
+
+func (s *S3) key(id db.ID) string {
+	return s.prefix + id.String() + objectSuffix
+}
+
+// namesPrefix keeps the names index next to the targets so listing the targets doesn't see it.
+func (s *S3) namesPrefix() string {
+	return strings.TrimSuffix(s.prefix, "/") + ".names/"
+}
+
+// nameKey orders the index by name and then by ID,
+// hex keeps the byte order and '-' sorts before any hex digit.
+func (s *S3) nameKey(name string, id db.ID) string {
+	return s.namesPrefix() + hex.EncodeToString([]byte(name)) + "-" + hex.EncodeToString([]byte(id))
+}
+
+// parseNameKey returns the ID of the target the key of the names index points at.
+func (s *S3) parseNameKey(key string) (db.ID, bool) {
+	_, encoded, ok := strings.Cut(strings.TrimPrefix(key, s.namesPrefix()), "-")
+	if !ok {
+		return "", false
+	}
+	id, err := hex.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return db.ID(id), true
+}
+
+// putName adds an empty object to the names index. The index can't be written together with the target,
+// so it's written before the target and GetAll skips keys which don't match the name of the target.
+func (s *S3) putName(ctx context.Context, name string, id db.ID) error {
+	_, err := s.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.nameKey(name, id)),
+		Body:   bytes.NewReader(nil),
+	})
+	return err
+}
+
+func (s *S3) deleteName(ctx context.Context, name string, id db.ID) error {
+	_, err := s.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.nameKey(name, id)),
+	})
+	return err
+}
+
+func isStatus(err error, code int) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode() == code
+	}
+	return false
+}
+
+// withHeader adds conditional header to the request,
+// MinIO and S3 reject the write with 412 if the condition doesn't hold.
+func withHeader(name, value string) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set(name, value)
+	}
+}
+
+func (s *S3) IsHealthy(ctx context.Context) bool {
+	_, err := s.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if err != nil {
+		log.Println("HeadBucket returns error:", err.Error())
+		return false
+	}
+	return true
+}
+
+// etag returns current ETag of the target object, ErrNotFound if there is no object.
+func (s *S3) etag(ctx context.Context, id db.ID) (string, error) {
+	result, err := s.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			return "", db.ErrNotFound
+		}
+		return "", err
+	}
+	return aws.StringValue(result.ETag), nil
+}
+
+func (s *S3) put(ctx context.Context, target *db.Target, condition request.Option) error {
+	body, err := json.Marshal(target)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	_, err = s.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key(target.ID)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}, condition)
+	if err != nil {
+		if isStatus(err, http.StatusPreconditionFailed) {
+			return db.ErrConflict
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *S3) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return s.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (s *S3) Import(ctx context.Context, target *db.Target) error {
+	_, err := s.etag(ctx, target.ID)
+	if err == nil {
+		return db.ErrConflict
+	}
+	if err != db.ErrNotFound {
+		return err
+	}
+	err = s.putName(ctx, target.Name, target.ID)
+	if err != nil {
+		return err
+	}
+	return s.put(ctx, target, withHeader("If-None-Match", "*"))
+}
+
+// Update compares the revision of the stored object,
+// If-Match on its ETag keeps the object from being changed between read and write.
+func (s *S3) Update(ctx context.Context, target *db.Target) error {
+	var stored db.Target
+	etag, err := s.getObject(ctx, s.key(target.ID), &stored)
+	if err != nil {
+		return err
+	}
+	if stored.Revision != target.Revision {
+		return db.ErrConflict
+	}
+	renamed := stored.Name != target.Name
+	if renamed {
+		err = s.putName(ctx, target.Name, target.ID)
+		if err != nil {
+			return err
+		}
+	}
+	next := *target
+	next.Revision++
+	err = s.put(ctx, &next, withHeader("If-Match", etag))
+	if err != nil {
+		return err
+	}
+	target.Revision = next.Revision
+	if renamed {
+		return s.deleteName(ctx, stored.Name, target.ID)
+	}
+	return nil
+}
+
+func (s *S3) Delete(ctx context.Context, target *db.Target) error {
+	var stored db.Target
+	_, err := s.getObject(ctx, s.key(target.ID), &stored)
+	if err != nil {
+		return err
+	}
+	_, err = s.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(target.ID)),
+	})
+	if err != nil {
+		return err
+	}
+	return s.deleteName(ctx, stored.Name, target.ID)
+}
+
+func (s *S3) Get(ctx context.Context, target *db.Target) error {
+	_, err := s.getObject(ctx, s.key(target.ID), target)
+	return err
+}
+
+// getObject decodes the object into target and returns its ETag.
+func (s *S3) getObject(ctx context.Context, key string, target *db.Target) (string, error) {
+	result, err := s.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			return "", db.ErrNotFound
+		}
+		return "", err
+	}
+	defer result.Body.Close()
+	body, err := io.ReadAll(result.Body)
+	if err != nil {
+		return "", err
+	}
+	err = json.Unmarshal(body, target)
+	if err != nil {
+		return "", &db.StorageError{Text: "Couldn't decode json", Err: err}
+	}
+	return aws.StringValue(result.ETag), nil
+}
+
+// GetAll lists the names index starting right after the cursor when targets are sorted by name,
+// listing stops once the page is full. Targets sorted by time are all read.
+func (s *S3) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	if query.SortBy == db.SortByTime {
+		targets, err := s.readAll(ctx)
+		if err != nil {
+			return err
+		}
+		*list = query.Apply(targets)
+		return nil
+	}
+	if err := s.fillNames(ctx); err != nil {
+		return err
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(s.namesPrefix()),
+		MaxKeys: aws.Int64(namesBatch),
+	}
+	if query.After != nil {
+		input.StartAfter = aws.String(s.nameKey(query.After.Name, query.After.ID))
+	}
+	targets := []db.Target{}
+	var getErr error
+	err := s.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			id, ok := s.parseNameKey(key)
+			if !ok {
+				continue
+			}
+			var target db.Target
+			_, getErr = s.getObject(ctx, s.key(id), &target)
+			if getErr == db.ErrNotFound {
+				// deleted after listing or the write of the target failed
+				getErr = nil
+				continue
+			}
+			if getErr != nil {
+				return false
+			}
+			// the target may have been renamed after the index was listed
+			if key == s.nameKey(target.Name, target.ID) && query.Match(&target) {
+				targets = append(targets, target)
+				if query.Limit > 0 && len(targets) == query.Limit {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if getErr != nil {
+		return getErr
+	}
+	*list = query.Apply(targets)
+	return nil
+}
+
+// readAll lists and reads all target objects.
+func (s *S3) readAll(ctx context.Context) ([]db.Target, error) {
+	keys := []string{}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	}
+	err := s.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if strings.HasSuffix(aws.StringValue(object.Key), objectSuffix) {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]db.Target, 0, len(keys))
+	for _, key := range keys {
+		var target db.Target
+		_, err = s.getObject(ctx, key, &target)
+		if err == db.ErrNotFound {
+			// deleted after listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// fillNames adds keys of targets stored by older versions to the names index, once the index has a key
+// or there are no targets it isn't checked again.
+func (s *S3) fillNames(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.named {
+		return nil
+	}
+	empty := true
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(s.namesPrefix()),
+		MaxKeys: aws.Int64(1),
+	}
+	err := s.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		empty = len(page.Contents) == 0
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if empty {
+		targets, err := s.readAll(ctx)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			err = s.putName(ctx, target.Name, target.ID)
+			if err != nil {
+				log.Println("Failed to fill the names index:", err)
+				return err
+			}
+		}
+	}
+	s.named = true
+	return nil
+}
+
+func (s *S3) createBucket() error {
+	_, err := s.HeadBucketWithContext(aws.BackgroundContext(), &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if err == nil {
+		return nil
+	}
+	if !isStatus(err, http.StatusNotFound) {
+		log.Println(err.Error())
+		return err
+	}
+	_, err = s.CreateBucketWithContext(aws.BackgroundContext(), &s3.CreateBucketInput{Bucket: aws.String(s.bucket)})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+			return nil
+		}
+		log.Println(err.Error())
+		return err
+	}
+	return nil
+}
+
+// parseArgs splits "bucket/prefix?endpoint=http://minio:9000" into its parts.
+func parseArgs(args string) (bucket, prefix, endpoint string, err error) {
+	path, rawQuery, _ := strings.Cut(args, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", "", "", err
+	}
+	bucket, prefix, _ = strings.Cut(strings.Trim(path, "/"), "/")
+	if bucket == "" {
+		return "", "", "", errors.New("bucket name is empty")
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return bucket, prefix, query.Get(endpointParam), nil
+}
+
+type StorageService struct{}
+
+func (s *StorageService) ServiceID() string {
+	return StorageID
+}
+
+func (s *StorageService) New(args string) (db.Storage, error) {
+	bucket, prefix, endpoint, err := parseArgs(args)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	config := aws.NewConfig()
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	svc := s3.New(sess)
+	db := &S3{
+		ICreateBucket: svc,
+		IHeadBucket:   svc,
+		IHeadObject:   svc,
+		IGetObject:    svc,
+		IPutObject:    svc,
+		IDeleteObject: svc,
+		IListObjects:  svc,
+		bucket:        bucket,
+		prefix:        prefix,
+	}
+	err = db.createBucket()
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func init() {
+	db.RegisterStorage(&StorageService{})
+}
+
+var (
+	_ db.Storage  = (*S3)(nil)
+	_ db.Importer = (*S3)(nil)
+)
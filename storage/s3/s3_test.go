@@ -0,0 +1,283 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func testFailure(code int) error {
+	return awserr.NewRequestFailure(awserr.New(http.StatusText(code), "", nil), code, "")
+}
+
+type testObject struct {
+	body []byte
+	etag string
+}
+
+// testBucket keeps objects in memory and honours If-Match/If-None-Match on PUT.
+type testBucket struct {
+	objects  map[string]testObject
+	version  int
+	pageSize int
+	gets     int
+	err      error
+}
+
+func newTestBucket() *testBucket {
+	return &testBucket{objects: map[string]testObject{}, pageSize: 1}
+}
+
+func (b *testBucket) CreateBucketWithContext(aws.Context, *s3.CreateBucketInput, ...request.Option) (*s3.CreateBucketOutput, error) {
+	return &s3.CreateBucketOutput{}, b.err
+}
+
+func (b *testBucket) HeadBucketWithContext(aws.Context, *s3.HeadBucketInput, ...request.Option) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, b.err
+}
+
+func (b *testBucket) HeadObjectWithContext(_ aws.Context, input *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	object, ok := b.objects[*input.Key]
+	if !ok {
+		return nil, testFailure(http.StatusNotFound)
+	}
+	return &s3.HeadObjectOutput{ETag: aws.String(object.etag)}, nil
+}
+
+func (b *testBucket) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	b.gets++
+	object, ok := b.objects[*input.Key]
+	if !ok {
+		return nil, testFailure(http.StatusNotFound)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(object.body)), ETag: aws.String(object.etag)}, nil
+}
+
+func (b *testBucket) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	r.ApplyOptions(opts...)
+	object, exists := b.objects[*input.Key]
+	if r.HTTPRequest.Header.Get("If-None-Match") == "*" && exists {
+		return nil, testFailure(http.StatusPreconditionFailed)
+	}
+	if etag := r.HTTPRequest.Header.Get("If-Match"); etag != "" && (!exists || object.etag != etag) {
+		return nil, testFailure(http.StatusPreconditionFailed)
+	}
+	body, _ := io.ReadAll(input.Body)
+	b.version++
+	b.objects[*input.Key] = testObject{body: body, etag: fmt.Sprintf(`"%d"`, b.version)}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (b *testBucket) DeleteObjectWithContext(_ aws.Context, input *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	delete(b.objects, *input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (b *testBucket) ListObjectsV2PagesWithContext(_ aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	if b.err != nil {
+		return b.err
+	}
+	keys := []string{}
+	for key := range b.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) && key > aws.StringValue(input.StartAfter) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	pageSize := b.pageSize
+	if input.MaxKeys != nil {
+		pageSize = min(pageSize, int(*input.MaxKeys))
+	}
+	for i := 0; i == 0 || i < len(keys); i += pageSize {
+		page := &s3.ListObjectsV2Output{}
+		for _, key := range keys[i:min(i+pageSize, len(keys))] {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key)})
+		}
+		if !fn(page, i+pageSize >= len(keys)) {
+			break
+		}
+	}
+	return nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func newTestDB(t *testing.T) (*S3, *testBucket) {
+	bucket := newTestBucket()
+	s := &S3{
+		ICreateBucket: bucket,
+		IHeadBucket:   bucket,
+		IHeadObject:   bucket,
+		IGetObject:    bucket,
+		IPutObject:    bucket,
+		IDeleteObject: bucket,
+		IListObjects:  bucket,
+		bucket:        "bucket",
+		prefix:        "targets/",
+	}
+	return s, bucket
+}
+
+func TestS3_objectKey(t *testing.T) {
+	s, bucket := newTestDB(t)
+	target := &db.Target{Name: "test"}
+	assert.NoError(t, s.Create(context.Background(), target))
+	assert.Contains(t, bucket.objects, "targets/test.json")
+	etag := bucket.objects["targets/test.json"].etag
+	assert.NoError(t, s.Update(context.Background(), target))
+	assert.NotEqual(t, etag, bucket.objects["targets/test.json"].etag)
+}
+
+func TestS3_put(t *testing.T) {
+	s, bucket := newTestDB(t)
+	assert.NoError(t, s.Create(context.Background(), &db.Target{Name: "test"}))
+	// object was changed by another replica after its ETag had been read
+	err := s.put(context.Background(), &db.Target{ID: "test", Name: "test"}, withHeader("If-Match", `"0"`))
+	assert.Equal(t, db.ErrConflict, err)
+
+	bucket.err = errors.New("connection refused")
+	err = s.put(context.Background(), &db.Target{ID: "test", Name: "test"}, withHeader("If-Match", `"1"`))
+	assert.Equal(t, bucket.err, err)
+}
+
+func TestS3_GetAll(t *testing.T) {
+	s, bucket := newTestDB(t)
+	for _, name := range []string{"d", "c", "b", "a"} {
+		assert.NoError(t, s.Create(context.Background(), &db.Target{Name: name}))
+	}
+	bucket.gets = 0
+	list := []db.Target{}
+	query := &db.ListQuery{Limit: 2, After: &db.Cursor{ID: "a", Name: "a"}}
+	assert.NoError(t, s.GetAll(context.Background(), query, &list))
+	assert.Equal(t, []db.ID{"b", "c"}, []db.ID{list[0].ID, list[1].ID})
+	// listing stops once the page is full
+	assert.Equal(t, 2, bucket.gets)
+}
+
+func TestS3_fillNames(t *testing.T) {
+	s, bucket := newTestDB(t)
+	// targets stored by older versions have no key in the names index
+	bucket.objects[s.key("old")] = testObject{body: []byte(`{"id":"old","name":"renamed","entries":[]}`)}
+	list := []db.Target{}
+	assert.NoError(t, s.GetAll(context.Background(), &db.ListQuery{Limit: 1}, &list))
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, db.ID("old"), list[0].ID)
+	}
+	assert.NoError(t, s.Delete(context.Background(), &db.Target{ID: "old"}))
+	assert.Empty(t, bucket.objects)
+}
+
+func TestS3_IsHealthy(t *testing.T) {
+	s, bucket := newTestDB(t)
+	assert.True(t, s.IsHealthy(context.Background()))
+	bucket.err = testFailure(http.StatusForbidden)
+	assert.False(t, s.IsHealthy(context.Background()))
+}
+
+func TestS3_createBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{
+			name:    "BucketExists",
+			err:     nil,
+			wantErr: false,
+		},
+		{
+			name:    "AccessDenied",
+			err:     testFailure(http.StatusForbidden),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, bucket := newTestDB(t)
+			bucket.err = tt.err
+			err := s.createBucket()
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func Test_parseArgs(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         string
+		wantBucket   string
+		wantPrefix   string
+		wantEndpoint string
+		wantErr      bool
+	}{
+		{
+			name:       "bucketOnly",
+			args:       "promhsd",
+			wantBucket: "promhsd",
+		},
+		{
+			name:         "prefixAndEndpoint",
+			args:         "promhsd/prod/targets?endpoint=http://minio:9000",
+			wantBucket:   "promhsd",
+			wantPrefix:   "prod/targets/",
+			wantEndpoint: "http://minio:9000",
+		},
+		{
+			name:    "emptyBucket",
+			args:    "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, prefix, endpoint, err := parseArgs(tt.args)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantBucket, bucket)
+			assert.Equal(t, tt.wantPrefix, prefix)
+			assert.Equal(t, tt.wantEndpoint, endpoint)
+		})
+	}
+}
+
+func TestS3_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		storage, _ := newTestDB(t)
+		return storage
+	})
+}
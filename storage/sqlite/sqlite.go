@@ -0,0 +1,366 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"promhsd/db"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	StorageID  = "sqlite"
+	driverName = "sqlite"
+	// WAL journal gives concurrent readers while a write is in progress,
+	// busy_timeout makes writers wait for the lock instead of failing at once,
+	// times are written in a sortable format, targets keep them in UTC.
+	dsnPragmas = "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)&_time_format=sqlite"
+)
+
+const (
+	createTableQuery = `CREATE TABLE IF NOT EXISTS targets (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	time DATETIME NOT NULL,
+	entries TEXT NOT NULL,
+	revision INTEGER NOT NULL DEFAULT 0,
+	expires_at DATETIME
+)`
+	// createIndexQuery keeps targets in the order they are listed by name
+	createIndexQuery = `CREATE INDEX IF NOT EXISTS targets_name ON targets (name, id)`
+	insertQuery      = `INSERT INTO targets (id, name, time, entries, revision, expires_at) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`
+	updateQuery      = `UPDATE targets SET name = ?, time = ?, entries = ?, expires_at = ?, revision = revision + 1 WHERE id = ? AND revision = ?`
+	deleteQuery      = `DELETE FROM targets WHERE id = ?`
+	existsQuery      = `SELECT COUNT(*) FROM targets WHERE id = ?`
+	selectQuery      = `SELECT name, time, entries, revision, expires_at FROM targets WHERE id = ?`
+	listQuery        = `SELECT id, name, time, entries, revision, expires_at FROM targets`
+)
+
+const (
+	// audit records are kept in a table of their own, time is in nanoseconds so that ranges are exact
+	createAuditTableQuery = `CREATE TABLE IF NOT EXISTS audit (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	time INTEGER NOT NULL,
+	target TEXT NOT NULL,
+	record TEXT NOT NULL
+)`
+	createAuditIndexQuery = `CREATE INDEX IF NOT EXISTS audit_time ON audit (time)`
+	insertAuditQuery      = `INSERT INTO audit (time, target, record) VALUES (?, ?, ?)`
+	listAuditQuery        = `SELECT record FROM audit`
+)
+
+type SQLite struct {
+	db *sql.DB
+}
+
+func (s *SQLite) IsHealthy(ctx context.Context) bool {
+	err := s.db.PingContext(ctx)
+	if err != nil {
+		log.Println("Ping returns error:", err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *SQLite) Create(ctx context.Context, target *db.Target) error {
+	target.ID = db.ID(target.Name)
+	target.Revision = db.FirstRevision
+	return s.Import(ctx, target)
+}
+
+// Import stores the target with its own ID and revision.
+func (s *SQLite) Import(ctx context.Context, target *db.Target) error {
+	entries, err := json.Marshal(target.Entries)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode entries", Err: err}
+	}
+	result, err := s.db.ExecContext(ctx, insertQuery, target.ID.String(), target.Name, target.Time.UTC(), string(entries), target.Revision, expiryValue(target.ExpiresAt))
+	if err != nil {
+		log.Println("Failed to Insert the row:", err)
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return db.ErrConflict
+	}
+	return nil
+}
+
+func (s *SQLite) Update(ctx context.Context, target *db.Target) error {
+	entries, err := json.Marshal(target.Entries)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode entries", Err: err}
+	}
+	result, err := s.db.ExecContext(ctx, updateQuery, target.Name, target.Time.UTC(), string(entries), expiryValue(target.ExpiresAt), target.ID.String(), target.Revision)
+	if err != nil {
+		log.Println("Failed to Update the row:", err)
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return s.updateError(ctx, target.ID)
+	}
+	target.Revision++
+	return nil
+}
+
+// updateError tells a missing row from a row with another revision.
+func (s *SQLite) updateError(ctx context.Context, id db.ID) error {
+	var count int
+	err := s.db.QueryRowContext(ctx, existsQuery, id.String()).Scan(&count)
+	if err != nil {
+		log.Println("Failed to Select the row:", err)
+		return err
+	}
+	if count == 0 {
+		return db.ErrNotFound
+	}
+	return db.ErrConflict
+}
+
+func (s *SQLite) Delete(ctx context.Context, target *db.Target) error {
+	result, err := s.db.ExecContext(ctx, deleteQuery, target.ID.String())
+	if err != nil {
+		log.Println("Failed to Delete the row:", err)
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) Get(ctx context.Context, target *db.Target) error {
+	var (
+		entries   string
+		expiresAt sql.NullTime
+	)
+	err := s.db.QueryRowContext(ctx, selectQuery, target.ID.String()).Scan(&target.Name, &target.Time, &entries, &target.Revision, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return db.ErrNotFound
+		}
+		log.Println("Failed to Select the row:", err)
+		return err
+	}
+	err = json.Unmarshal([]byte(entries), &target.Entries)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't decode entries", Err: err}
+	}
+	target.ExpiresAt = expiryTime(expiresAt)
+	return nil
+}
+
+// expiryValue writes the expiry in UTC like times of targets, NULL means the target never expires.
+func expiryValue(expiresAt *time.Time) interface{} {
+	if expiresAt == nil {
+		return nil
+	}
+	return expiresAt.UTC()
+}
+
+func expiryTime(expiresAt sql.NullTime) *time.Time {
+	if !expiresAt.Valid {
+		return nil
+	}
+	return &expiresAt.Time
+}
+
+// labelCondition matches targets which have an entry with the label,
+// it is repeated for every label of the query inside a single entry.
+const labelCondition = `EXISTS (SELECT 1 FROM json_each(e.value, '$.labels') l WHERE l.key = ? AND l.value = ?)`
+
+// listSQL adds conditions, order and limit of the query to listQuery.
+func listSQL(query *db.ListQuery) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	if query.NamePrefix != "" {
+		conditions = append(conditions, "substr(name, 1, ?) = ?")
+		args = append(args, utf8.RuneCountInString(query.NamePrefix), query.NamePrefix)
+	}
+	if len(query.Labels) > 0 {
+		labels := []string{}
+		for k, v := range query.Labels {
+			labels = append(labels, labelCondition)
+			args = append(args, k, v)
+		}
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(entries) e WHERE "+strings.Join(labels, " AND ")+")")
+	}
+	order := "name, id"
+	if query.SortBy == db.SortByTime {
+		order = "time, id"
+		if query.After != nil {
+			conditions = append(conditions, "(time, id) > (?, ?)")
+			args = append(args, query.After.Time.UTC(), query.After.ID.String())
+		}
+	} else if query.After != nil {
+		conditions = append(conditions, "(name, id) > (?, ?)")
+		args = append(args, query.After.Name, query.After.ID.String())
+	}
+	statement := listQuery
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY " + order
+	if query.Limit > 0 {
+		statement += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+	return statement, args
+}
+
+func (s *SQLite) GetAll(ctx context.Context, query *db.ListQuery, list *[]db.Target) error {
+	statement, args := listSQL(query)
+	rows, err := s.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		log.Println("Failed to Select rows:", err)
+		return err
+	}
+	defer rows.Close()
+	targets := []db.Target{}
+	for rows.Next() {
+		var (
+			target    db.Target
+			entries   string
+			expiresAt sql.NullTime
+		)
+		err = rows.Scan(&target.ID, &target.Name, &target.Time, &entries, &target.Revision, &expiresAt)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal([]byte(entries), &target.Entries)
+		if err != nil {
+			return &db.StorageError{Text: "Couldn't decode entries", Err: err}
+		}
+		target.ExpiresAt = expiryTime(expiresAt)
+		targets = append(targets, target)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	*list = targets
+	return nil
+}
+
+func (s *SQLite) WriteAudit(ctx context.Context, record *db.AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return &db.StorageError{Text: "Couldn't encode to json", Err: err}
+	}
+	_, err = s.db.ExecContext(ctx, insertAuditQuery, record.Time.UnixNano(), record.Target.String(), string(data))
+	if err != nil {
+		log.Println("Failed to Insert the audit row:", err)
+	}
+	return err
+}
+
+// auditSQL adds the time range of the query to listAuditQuery.
+func auditSQL(query *db.AuditQuery) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	if !query.From.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, query.From.UnixNano())
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, "time <= ?")
+		args = append(args, query.To.UnixNano())
+	}
+	statement := listAuditQuery
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return statement + " ORDER BY time, seq", args
+}
+
+func (s *SQLite) QueryAudit(ctx context.Context, query *db.AuditQuery, records *[]db.AuditRecord) error {
+	statement, args := auditSQL(query)
+	rows, err := s.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		log.Println("Failed to Select audit rows:", err)
+		return err
+	}
+	defer rows.Close()
+	result := []db.AuditRecord{}
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return err
+		}
+		var record db.AuditRecord
+		if err = json.Unmarshal([]byte(data), &record); err != nil {
+			return &db.StorageError{Text: "Couldn't decode audit record", Err: err}
+		}
+		result = append(result, record)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	*records = result
+	return nil
+}
+
+func (s *SQLite) createTable() error {
+	for _, query := range []string{createTableQuery, createIndexQuery, createAuditTableQuery, createAuditIndexQuery} {
+		if _, err := s.db.Exec(query); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// dsn appends the pragmas to the path, which may already have its own query parameters.
+func dsn(path string) string {
+	if strings.Contains(path, "?") {
+		return path + "&" + dsnPragmas
+	}
+	return path + "?" + dsnPragmas
+}
+
+type StorageService struct{}
+
+func (s *StorageService) ServiceID() string {
+	return StorageID
+}
+
+func (s *StorageService) New(path string) (db.Storage, error) {
+	conn, err := sql.Open(driverName, dsn(path))
+	if err != nil {
+		log.Println(err)
+		return nil, &db.StorageError{Text: "Couldn't open database", Err: err}
+	}
+	db := &SQLite{db: conn}
+	err = db.createTable()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func init() {
+	db.RegisterStorage(&StorageService{})
+}
+
+var (
+	_ db.Storage    = (*SQLite)(nil)
+	_ db.Importer   = (*SQLite)(nil)
+	_ db.AuditStore = (*SQLite)(nil)
+)
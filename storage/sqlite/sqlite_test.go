@@ -0,0 +1,90 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"promhsd/db"
+	"promhsd/db/storagetest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDB(t *testing.T) *SQLite {
+	service := StorageService{}
+	storage, err := service.New(filepath.Join(t.TempDir(), "promhsd.db"))
+	assert.NoError(t, err)
+	s := storage.(*SQLite)
+	t.Cleanup(func() { s.db.Close() })
+	return s
+}
+
+func TestSQLite_IsHealthy(t *testing.T) {
+	s := newTestDB(t)
+	assert.True(t, s.IsHealthy(context.Background()))
+	s.db.Close()
+	assert.False(t, s.IsHealthy(context.Background()))
+}
+
+func TestNew(t *testing.T) {
+	type args struct {
+		path string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "testFile",
+			args: args{
+				path: filepath.Join(t.TempDir(), "test.db"),
+			},
+			wantErr: false,
+		},
+		{
+			name: "uriWithParameters",
+			args: args{
+				path: "file:" + filepath.Join(t.TempDir(), "test.db") + "?mode=rwc",
+			},
+			wantErr: false,
+		},
+		{
+			name: "filenameWrong",
+			args: args{
+				path: filepath.Join("dirNotExist", "wrong.db"),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := StorageService{}
+			got, err := service.New(tt.args.path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, got)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotNil(t, got)
+		})
+	}
+}
+
+func Test_dsn(t *testing.T) {
+	assert.Equal(t, "test.db?"+dsnPragmas, dsn("test.db"))
+	assert.Equal(t, "file:test.db?mode=ro&"+dsnPragmas, dsn("file:test.db?mode=ro"))
+}
+
+func TestSQLite_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.Storage {
+		return newTestDB(t)
+	})
+}
+
+func TestSQLite_Audit(t *testing.T) {
+	storagetest.RunAudit(t, func(t *testing.T) db.Storage {
+		return newTestDB(t)
+	})
+}